@@ -3,15 +3,13 @@ package cipher
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
 	"crypto/rand"
-	"encoding/hex"
 	"io"
 )
 
+// HashKey hashes the key with MD5, the original key hash.
 func HashKey(key string) string {
-	hash := md5.Sum([]byte(key))
-	return hex.EncodeToString(hash[:])
+	return MD5.HashKey(key)
 }
 
 func NewEncryptionKey() []byte {
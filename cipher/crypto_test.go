@@ -2,6 +2,8 @@ package cipher
 
 import (
 	"bytes"
+	"crypto/aes"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,3 +26,39 @@ func TestEncrypt(t *testing.T) {
 
 	assert.Equal(t, data, out.Bytes())
 }
+
+func TestDecryptReaderSeek(t *testing.T) {
+	// Long enough for the counter to carry into the next byte.
+	data := make([]byte, 300*aes.BlockSize+7)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	key := NewEncryptionKey()
+
+	encrypted := new(bytes.Buffer)
+	w, err := NewEncryptWriter(key, encrypted)
+	assert.Nil(t, err)
+	_, err = w.Write(data)
+	assert.Nil(t, err)
+
+	r, err := NewDecryptReader(key, bytes.NewReader(encrypted.Bytes()))
+	assert.Nil(t, err)
+
+	all, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, all)
+
+	for _, offset := range []int64{0, 5, aes.BlockSize, 256*aes.BlockSize + 3, int64(len(data))} {
+		pos, err := r.Seek(offset, io.SeekStart)
+		assert.Nil(t, err)
+		assert.Equal(t, offset, pos)
+
+		rest, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, data[offset:], rest)
+	}
+
+	pos, err := r.Seek(-7, io.SeekEnd)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)-7), pos)
+}
@@ -0,0 +1,80 @@
+package cipher
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+// KeyHash hashes keys into the names files are laid out on disk and sent to
+// peers under. Every node of a network has to use the same one.
+type KeyHash interface {
+	// Name identifies the algorithm, it's recorded in the metadata of the
+	// stored files.
+	Name() string
+	// HashKey returns the hex encoded hash of the key.
+	HashKey(key string) string
+}
+
+// Names of the available key hashes.
+const (
+	HashMD5    = "md5"
+	HashSHA256 = "sha256"
+	HashBLAKE3 = "blake3"
+	HashHMAC   = "hmac-sha256"
+)
+
+var (
+	// MD5 is the original key hash, kept for the stores laid out with it.
+	// It's prone to collisions, don't use it for new stores.
+	MD5 KeyHash = keyHash{name: HashMD5, new: md5.New}
+	// SHA256 is the default key hash.
+	SHA256 KeyHash = keyHash{name: HashSHA256, new: sha256.New}
+	BLAKE3 KeyHash = keyHash{name: HashBLAKE3, new: func() hash.Hash { return blake3.New(32, nil) }}
+)
+
+// NewHMAC returns a key hash keyed with secret, which hides the keys from
+// whoever doesn't know the secret, e.g. the owners of the peers.
+func NewHMAC(secret []byte) KeyHash {
+	return keyHash{name: HashHMAC, new: func() hash.Hash { return hmac.New(sha256.New, secret) }}
+}
+
+// KeyHashByName returns the key hash with the given name. The secret is only
+// used, and required, by HMAC.
+func KeyHashByName(name string, secret []byte) (KeyHash, error) {
+	switch name {
+	case HashMD5:
+		return MD5, nil
+	case HashSHA256:
+		return SHA256, nil
+	case HashBLAKE3:
+		return BLAKE3, nil
+	case HashHMAC:
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("%s requires a secret", name)
+		}
+		return NewHMAC(secret), nil
+	}
+
+	return nil, fmt.Errorf("unknown hash algorithm %q", name)
+}
+
+type keyHash struct {
+	name string
+	new  func() hash.Hash
+}
+
+func (h keyHash) Name() string {
+	return h.name
+}
+
+func (h keyHash) HashKey(key string) string {
+	sum := h.new()
+	sum.Write([]byte(key))
+	return hex.EncodeToString(sum.Sum(nil))
+}
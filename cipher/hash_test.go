@@ -0,0 +1,25 @@
+package cipher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyHash(t *testing.T) {
+	assert.Equal(t, "b10a8db164e0754105b7a99be72e3fe5", MD5.HashKey("Hello World"))
+	assert.Equal(t, "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e", SHA256.HashKey("Hello World"))
+	assert.Len(t, BLAKE3.HashKey("Hello World"), 64)
+
+	secret := NewEncryptionKey()
+	hmac, err := KeyHashByName(HashHMAC, secret)
+	assert.Nil(t, err)
+	assert.Equal(t, HashHMAC, hmac.Name())
+	assert.Equal(t, hmac.HashKey("Hello World"), NewHMAC(secret).HashKey("Hello World"))
+	assert.NotEqual(t, hmac.HashKey("Hello World"), NewHMAC(NewEncryptionKey()).HashKey("Hello World"))
+
+	_, err = KeyHashByName(HashHMAC, nil)
+	assert.NotNil(t, err)
+	_, err = KeyHashByName("crc32", nil)
+	assert.NotNil(t, err)
+}
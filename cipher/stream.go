@@ -0,0 +1,250 @@
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// IVSize is the size of the IV prepended to encrypted streams.
+const IVSize = aes.BlockSize
+
+// NewEncryptWriter returns a writer encrypting what's written to it into
+// dst, in the format of CopyEncrypt. The IV is written right away.
+func NewEncryptWriter(key []byte, dst io.Writer) (io.Writer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	if _, err := dst.Write(iv); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{stream: cipher.NewCTR(block, iv), dst: dst}, nil
+}
+
+// encryptWriter encrypts through a buffer of its own, unlike
+// cipher.StreamWriter which allocates one for every write.
+type encryptWriter struct {
+	stream cipher.Stream
+	dst    io.Writer
+	buf    []byte
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.buf == nil {
+		w.buf = make([]byte, 32*1024)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		chunk := w.buf[:min(len(p), len(w.buf))]
+		w.stream.XORKeyStream(chunk, p[:len(chunk)])
+
+		n, err := w.dst.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// EncryptReader encrypts what's read from src, the IV comes first as in
+// the format of CopyEncrypt. It can seek back to the start when src can,
+// the same IV is used again.
+type EncryptReader struct {
+	src    io.Reader
+	block  cipher.Block
+	iv     []byte
+	ivLeft []byte
+	stream cipher.Stream
+}
+
+func NewEncryptReader(key []byte, src io.Reader) (*EncryptReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	return &EncryptReader{
+		src:    src,
+		block:  block,
+		iv:     iv,
+		ivLeft: iv,
+		stream: cipher.NewCTR(block, iv),
+	}, nil
+}
+
+func (r *EncryptReader) Read(p []byte) (int, error) {
+	if len(r.ivLeft) > 0 {
+		n := copy(p, r.ivLeft)
+		r.ivLeft = r.ivLeft[n:]
+		return n, nil
+	}
+
+	n, err := r.src.Read(p)
+	r.stream.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Seek only supports going back to the start of the stream.
+func (r *EncryptReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.src.(io.Seeker)
+	if !ok || offset != 0 || whence != io.SeekStart {
+		return 0, errors.New("an encrypted stream can only be rewound")
+	}
+
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r.ivLeft = r.iv
+	r.stream = cipher.NewCTR(r.block, r.iv)
+
+	return 0, nil
+}
+
+// DecryptReader decrypts a stream in the format of CopyEncrypt as it's
+// read. It can seek when the encrypted stream can, the key stream is moved
+// to the new offset instead of decrypting what's skipped.
+type DecryptReader struct {
+	src    io.Reader
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+	offset int64
+}
+
+// NewDecryptReader reads the IV from src and returns the reader of the
+// plaintext that follows it.
+func NewDecryptReader(key []byte, src io.Reader) (*DecryptReader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, block.BlockSize())
+	if _, err := io.ReadFull(src, iv); err != nil {
+		return nil, fmt.Errorf("reading IV: %w", err)
+	}
+
+	return &DecryptReader{
+		src:    src,
+		block:  block,
+		iv:     iv,
+		stream: cipher.NewCTR(block, iv),
+	}, nil
+}
+
+func (r *DecryptReader) Read(p []byte) (int, error) {
+	n, err := r.src.Read(p)
+	r.stream.XORKeyStream(p[:n], p[:n])
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek moves to an offset of the plaintext.
+func (r *DecryptReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.src.(io.Seeker)
+	if !ok {
+		return 0, errors.New("the encrypted stream can't seek")
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		offset += end - int64(len(r.iv))
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if _, err := seeker.Seek(int64(len(r.iv))+offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	// The counter of the block holding the offset is the IV plus the
+	// number of blocks before it, then the key stream of the bytes of the
+	// block before the offset is skipped.
+	blockSize := int64(r.block.BlockSize())
+	counter := make([]byte, len(r.iv))
+	copy(counter, r.iv)
+	addCounter(counter, uint64(offset/blockSize))
+
+	r.stream = cipher.NewCTR(r.block, counter)
+	skip := make([]byte, offset%blockSize)
+	r.stream.XORKeyStream(skip, skip)
+	r.offset = offset
+
+	return offset, nil
+}
+
+// Close closes the encrypted stream if it can be closed.
+func (r *DecryptReader) Close() error {
+	if c, ok := r.src.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// addCounter adds n to the big endian counter.
+func addCounter(counter []byte, n uint64) {
+	for i := len(counter) - 1; i >= 0 && n > 0; i-- {
+		sum := uint64(counter[i]) + n&0xff
+		counter[i] = byte(sum)
+		n = n>>8 + sum>>8
+	}
+}
+
+// LoadKey reads the key stored at path, generating and storing a new one
+// when the file doesn't exist yet.
+func LoadKey(path string) ([]byte, error) {
+	key, err := ReadKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = NewEncryptionKey()
+		if err := os.WriteFile(path, key, 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	return key, err
+}
+
+// ReadKey reads the key stored at path.
+func ReadKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("key %s: %w", path, err)
+	}
+	return key, nil
+}
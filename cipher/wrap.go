@@ -0,0 +1,66 @@
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var ErrUnwrap = errors.New("the key can't be unwrapped with this key")
+
+// NewDataKey generates the key of a single file and returns it together
+// with its copy wrapped by kek.
+func NewDataKey(kek []byte) (key, wrapped []byte, err error) {
+	key = NewEncryptionKey()
+	wrapped, err = WrapKey(kek, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, wrapped, nil
+}
+
+// WrapKey encrypts key with kek using AES-GCM, the nonce comes first. Only
+// the holder of kek can unwrap it, and a wrapped key that was tampered with
+// fails to unwrap.
+func WrapKey(kek, key []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, key, nil), nil
+}
+
+// UnwrapKey returns the key wrapped by WrapKey.
+func UnwrapKey(kek, wrapped []byte) ([]byte, error) {
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrUnwrap
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+
+	key, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, ErrUnwrap
+	}
+	return key, nil
+}
+
+func newGCM(kek []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
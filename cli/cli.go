@@ -5,35 +5,89 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"strings"
 
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/mount"
 	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/vfs"
 )
 
-func Start() (int, []string, error) {
-	listenAddress := flag.Int("port", 0, "Listen address of the server")
-	peers := flag.String("peers", "", "Comma-separated list of bootstrapped nodes url to connect to")
+// mounted is the file system mounted with the mount command, if any.
+var mounted struct {
+	dir        string
+	cacheDir   string
+	mountpoint *mount.Mountpoint
+}
+
+// Start parses the command line. The subcommands talking to a running node
+// are run right away and exit the process, otherwise the options of the node
+// to serve are returned.
+func Start() (Options, error) {
+	args := os.Args[1:]
+	if len(args) > 0 && IsCommand(args[0]) {
+		os.Exit(Run(args, os.Stdin, os.Stdout, os.Stderr))
+	}
+	if len(args) > 0 && args[0] == "store" {
+		os.Exit(RunStore(args[1:], os.Stdout, os.Stderr))
+	}
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(RunConfig(args[1:], os.Stdout, os.Stderr))
+	}
+
+	interactive := true
+	if len(args) > 0 && args[0] == "serve" {
+		interactive = false
+		args = args[1:]
+	}
 
-	flag.Parse()
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	load := serveFlags(flags)
 
-	if *listenAddress <= 0 || *listenAddress > 65535 {
-		return 0, []string{}, fmt.Errorf("invalid port")
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return Options{}, fmt.Errorf("unknown command %q", args[0])
 	}
+	flags.Parse(args)
 
-	nodes := []string{}
-	if len(*peers) > 0 {
-		nodes = strings.Split(*peers, ",")
+	c, file, err := load(os.LookupEnv)
+	if err != nil {
+		return Options{}, err
+	}
+	opts, err := NewOptions(c)
+	if err != nil {
+		return Options{}, err
+	}
+	opts.ConfigFile = file
+	opts.Load = func() (config.Config, error) {
+		c, _, err := load(os.LookupEnv)
+		return c, err
 	}
+	opts.Interactive = interactive
 
-	return *listenAddress, nodes, nil
+	return opts, nil
+}
+
+// NewLogger returns the logger of a node writing to w, as the options say.
+func NewLogger(w io.Writer, opts Options) *slog.Logger {
+	handlerOpts := &slog.HandlerOptions{Level: opts.LogLevel}
+	if opts.Log.Format == config.LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, handlerOpts))
+	}
+	return slog.New(slog.NewTextHandler(w, handlerOpts))
 }
 
+// InteractiveCli runs the commands read from stdin until exit or the end of
+// the input.
 func InteractiveCli(s *server.FileServer) {
 	for {
 		fmt.Print("> ")
 		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
+		if !scanner.Scan() {
+			handleUnmountCommand()
+			return
+		}
 
 		line := scanner.Text()
 		parts := strings.Split(line, " ")
@@ -50,6 +104,10 @@ func InteractiveCli(s *server.FileServer) {
 			handleGetCommand(s, args)
 		case "delete":
 			handleDeleteCommand(s, args)
+		case "mount":
+			handleMountCommand(s, args)
+		case "unmount":
+			handleUnmountCommand()
 		case "clear":
 			fmt.Print("\033[H\033[2J")
 			fmt.Println(s.Transporter.RemoteAddr())
@@ -58,13 +116,16 @@ func InteractiveCli(s *server.FileServer) {
 			fmt.Println("  connect <url1> <url2>          - Add a peer to the network")
 			fmt.Println("  peers                          - List all connected peers")
 			fmt.Println("  put <local_file> <remote_file> - Store a file on the network")
-			fmt.Println("  get <remote_file>              - Retrieve a file from the network")
+			fmt.Println("  get [-f] <remote_file> [path]  - Retrieve a file to path, '-' for the console")
 			fmt.Println("  delete <remote_file>           - Delete a file from the network")
+			fmt.Println("  mount <dir>                    - Mount the network as a directory")
+			fmt.Println("  unmount                        - Unmount the mounted directory")
 			fmt.Println("  clear                          - Clear the console")
 			fmt.Println("  help                           - Show this help message")
 			fmt.Println("  exit                           - Exit the CLI")
 		case "exit":
-			os.Exit(0)
+			handleUnmountCommand()
+			return
 		default:
 			fmt.Println("Unknown command:", cmd)
 		}
@@ -85,7 +146,8 @@ func handleAddNodeCommand(s *server.FileServer, args []string) {
 }
 
 func handleListPeersCommand(s *server.FileServer) {
-	if len(s.BootstrapNodes) == 0 {
+	peers := s.Peers()
+	if len(peers) == 0 {
 		fmt.Println("No peers connected.")
 		return
 	}
@@ -94,7 +156,7 @@ func handleListPeersCommand(s *server.FileServer) {
 	fmt.Println("-------------------------------------------------")
 	fmt.Printf("%-20s %-20s\n", "Peer URL", "Status")
 	fmt.Println("-------------------------------------------------")
-	for _, node := range s.BootstrapNodes {
+	for _, node := range peers {
 		status := "Connected"
 		fmt.Printf("%-20s %-20s\n", node, status)
 	}
@@ -126,25 +188,50 @@ func handlePutCommand(s *server.FileServer, args []string) {
 }
 
 func handleGetCommand(s *server.FileServer, args []string) {
-	if len(args) != 1 {
-		fmt.Println("Usage: get <remote_filename>")
+	overwrite := len(args) > 0 && args[0] == "-f"
+	if overwrite {
+		args = args[1:]
+	}
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Println("Usage: get [-f] <remote_filename> [local_file_path|-]")
 		return
 	}
 	remoteFileName := args[0]
 
-	_, file, err := s.Get(remoteFileName)
+	dst := ""
+	if len(args) == 2 {
+		dst = args[1]
+	}
+	dst = destination(remoteFileName, dst)
+
+	size, file, err := s.Get(remoteFileName)
 	if err != nil {
 		fmt.Printf("Error retrieving data from the network: %+v\n", err)
 		return
 	}
+	if rc, ok := file.(io.Closer); ok {
+		defer rc.Close()
+	}
 
-	data, err := io.ReadAll(file)
+	opts := downloadOpts{Overwrite: overwrite, Stdout: os.Stdout}
+	if meta, err := s.Stat(remoteFileName); err == nil {
+		opts.Checksum = meta.Checksum
+	}
+	if dst != "-" {
+		opts.Progress = os.Stdout
+	}
+
+	n, err := download(dst, file, size, opts)
 	if err != nil {
-		fmt.Printf("Error reading data from the network: %+v\n", err)
+		fmt.Printf("Error retrieving '%s': %+v\n", remoteFileName, err)
 		return
 	}
 
-	println(string(data))
+	if dst == "-" {
+		fmt.Println()
+		return
+	}
+	fmt.Printf("File '%s' successfully retrieved to '%s' (%d bytes).\n", remoteFileName, dst, n)
 }
 
 func handleDeleteCommand(s *server.FileServer, args []string) {
@@ -161,3 +248,53 @@ func handleDeleteCommand(s *server.FileServer, args []string) {
 
 	fmt.Printf("Data deleted Successfully from you local server.\n")
 }
+
+func handleMountCommand(s *server.FileServer, args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: mount <dir>")
+		return
+	}
+
+	if mounted.mountpoint != nil {
+		fmt.Printf("Already mounted at '%s'.\n", mounted.dir)
+		return
+	}
+
+	cacheDir, err := os.MkdirTemp("", "dfs-mount-")
+	if err != nil {
+		fmt.Printf("Error creating the cache directory: %+v\n", err)
+		return
+	}
+
+	fsys, err := vfs.New(s, vfs.Opts{CacheDir: cacheDir})
+	if err != nil {
+		os.RemoveAll(cacheDir)
+		fmt.Printf("Error creating the file system: %+v\n", err)
+		return
+	}
+
+	mountpoint, err := mount.Mount(args[0], fsys)
+	if err != nil {
+		os.RemoveAll(cacheDir)
+		fmt.Printf("Error mounting '%s': %+v\n", args[0], err)
+		return
+	}
+
+	mounted.dir, mounted.cacheDir, mounted.mountpoint = args[0], cacheDir, mountpoint
+	fmt.Printf("Network mounted at '%s'.\n", args[0])
+}
+
+func handleUnmountCommand() {
+	if mounted.mountpoint == nil {
+		return
+	}
+
+	if err := mounted.mountpoint.Unmount(); err != nil {
+		fmt.Printf("Error unmounting '%s': %+v\n", mounted.dir, err)
+		return
+	}
+	os.RemoveAll(mounted.cacheDir)
+
+	fmt.Printf("Unmounted '%s'.\n", mounted.dir)
+	mounted.mountpoint = nil
+}
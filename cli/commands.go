@@ -0,0 +1,700 @@
+package cli
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/client"
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/store"
+)
+
+// Exit codes of the subcommands.
+const (
+	ExitOK       = 0
+	ExitError    = 1
+	ExitUsage    = 2
+	ExitNotFound = 3
+)
+
+// scrubPollInterval is how often scrub -wait asks for the progress.
+const scrubPollInterval = 500 * time.Millisecond
+
+// errUsage marks errors caused by a wrong invocation.
+var errUsage = errors.New("usage")
+
+type command struct {
+	usage string
+	help  string
+	run   func(ctx context.Context, env *env, args []string) error
+	// flags registers the flags specific to the command.
+	flags func(*flag.FlagSet)
+}
+
+var commands = map[string]command{
+	"put": {
+		usage: "put [flags] <local_file|-> <key>",
+		help:  "Store a local file, or stdin, on the network",
+		run:   runPut,
+		flags: func(fs *flag.FlagSet) {
+			fs.Duration("ttl", 0, "Delete the file this long after it's stored, as its policy says when 0")
+		},
+	},
+	"get": {
+		usage: "get [flags] <key> [local_path|-]",
+		help:  "Retrieve a file from the network, to stdout unless a local path is given",
+		run:   runGet,
+		flags: func(fs *flag.FlagSet) {
+			fs.String("o", "-", "File to write to, '-' for stdout")
+			fs.Bool("f", false, "Overwrite the local file if it exists")
+			fs.Bool("progress", false, "Report the progress on stderr even if it isn't a terminal")
+		},
+	},
+	"rm": {
+		usage: "rm [flags] <key>...",
+		help:  "Delete files from the node",
+		run:   runRm,
+	},
+	"ls": {
+		usage: "ls [flags] [prefix]",
+		help:  "List the files of the node",
+		run:   runLs,
+	},
+	"stat": {
+		usage: "stat [flags] <key>",
+		help:  "Show the metadata of a file",
+		run:   runStat,
+	},
+	"peers": {
+		usage: "peers [flags]",
+		help:  "List the peers connected to the node",
+		run:   runPeers,
+	},
+	"status": {
+		usage: "status [flags]",
+		help:  "Show the state of the node, its peers and its background jobs",
+		run:   runStatus,
+	},
+	"scrub": {
+		usage: "scrub [flags] [start|status]",
+		help:  "Check the files of the node against their checksum, or show how the last check went",
+		run:   runScrub,
+		flags: func(fs *flag.FlagSet) {
+			fs.Bool("wait", false, "Wait for the scrub to finish, reporting its progress on stderr")
+		},
+	},
+	"policy": {
+		usage: "policy [flags] <set|rm|ls> [prefix]",
+		help:  "Manage the storage policies of the keys starting with a prefix",
+		run:   runPolicy,
+		flags: func(fs *flag.FlagSet) {
+			fs.Int("replicas", 0, "Number of peers a copy of the file goes to, all of them when 0")
+			fs.String("erasure", "", "Erasure code the files into <data>+<parity> shards instead of copying them")
+			fs.Bool("plaintext", false, "Keep the files unencrypted at rest")
+			fs.String("compression", "", "Compress the files at rest with "+strings.Join(store.Compressions(), ", "))
+			fs.Duration("ttl", 0, "Delete the files this long after they are stored, never when 0")
+		},
+	},
+}
+
+// IsCommand tells whether name is one of the subcommands talking to a
+// running node.
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// AdminSocket is the default path of the admin socket of the node listening
+// on port.
+func AdminSocket(port int) string {
+	return filepath.Join(os.TempDir(), fmt.Sprintf("dfs-%d.sock", port))
+}
+
+// env is what a command runs with.
+type env struct {
+	client *client.Client
+	flags  *flag.FlagSet
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// Run runs the subcommand named by args[0] against a running node and
+// returns the exit code of the process.
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || !IsCommand(args[0]) {
+		fmt.Fprintln(stderr, "Usage: fs <command> [flags] [args]")
+		return ExitUsage
+	}
+	cmd := commands[args[0]]
+
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: fs %s\n%s\n\nFlags:\n", cmd.usage, cmd.help)
+		fs.PrintDefaults()
+	}
+	node := fs.String("node", os.Getenv("DFS_NODE"), "Admin socket or gRPC address of the node (default $DFS_NODE)")
+	port := fs.Int("port", 0, "Port of a local node, used to find its admin socket")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+	timeout := fs.Duration("timeout", 0, "Give up after this long, no limit when 0")
+	keyFile := fs.String("key", os.Getenv("DFS_KEY_FILE"), "File holding the key files are encrypted end to end with (default $DFS_KEY_FILE)")
+	token := fs.String("token", os.Getenv("DFS_TOKEN"), "Token of the gRPC file service of the node (default $DFS_TOKEN)")
+	caFile := fs.String("ca", os.Getenv("DFS_CA_FILE"), "PEM certificates the node's TLS certificate is checked against, TLS is off without it (default $DFS_CA_FILE)")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+
+	positional, err := parseInterspersed(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	if err != nil {
+		return ExitUsage
+	}
+
+	target, err := nodeTarget(*node, *port)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitUsage
+	}
+
+	clientOpts := client.ClientOpts{Nodes: []string{target}, Token: *token}
+	if len(*keyFile) > 0 {
+		if clientOpts.Key, err = cipher.ReadKey(*keyFile); err != nil {
+			fmt.Fprintf(stderr, "Error: %s\n", err)
+			return ExitError
+		}
+	}
+	if len(*caFile) > 0 {
+		if clientOpts.TLS, err = clientTLS(*caFile); err != nil {
+			fmt.Fprintf(stderr, "Error: %s\n", err)
+			return ExitError
+		}
+	}
+
+	c, err := client.New(clientOpts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitError
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	e := &env{client: c, flags: fs, json: *asJSON, stdin: stdin, stdout: stdout, stderr: stderr}
+	err = cmd.run(ctx, e, positional)
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.Is(err, errUsage):
+		fs.Usage()
+		return ExitUsage
+	case errors.Is(err, client.ErrNotFound), errors.Is(err, client.ErrNoPolicy):
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitNotFound
+	default:
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitError
+	}
+}
+
+// parseInterspersed parses the flags wherever they appear among the
+// positional arguments, which it returns.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// clientTLS returns the TLS configuration trusting the certificates of the
+// PEM file at path.
+func clientTLS(path string) (*tls.Config, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates", path)
+	}
+	return &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}, nil
+}
+
+// nodeTarget turns the -node and -port flags into a gRPC target.
+func nodeTarget(node string, port int) (string, error) {
+	switch {
+	case len(node) == 0 && port == 0:
+		return "", fmt.Errorf("no node given, use -node, -port or $DFS_NODE")
+	case len(node) == 0:
+		node = AdminSocket(port)
+	}
+
+	if strings.Contains(node, "://") || !strings.ContainsAny(node, `/\`) {
+		return node, nil
+	}
+
+	path, err := filepath.Abs(node)
+	if err != nil {
+		return "", err
+	}
+	return "unix://" + path, nil
+}
+
+func runPut(ctx context.Context, e *env, args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	localPath, key := args[0], args[1]
+
+	r := e.stdin
+	if localPath != "-" {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ttl, err := time.ParseDuration(e.flags.Lookup("ttl").Value.String())
+	if err != nil {
+		return err
+	}
+
+	n, err := e.client.PutWith(ctx, key, r, client.PutOpts{TTL: ttl})
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.printJSON(map[string]any{"key": key, "size": n})
+	}
+	fmt.Fprintf(e.stdout, "Stored %s (%d bytes)\n", key, n)
+	return nil
+}
+
+func runGet(ctx context.Context, e *env, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUsage
+	}
+	key, dst := args[0], e.flags.Lookup("o").Value.String()
+	if len(args) == 2 {
+		dst = args[1]
+	}
+	if dst != "-" {
+		dst = destination(key, dst)
+	}
+
+	// The checksum is only known once the node has the file, which may
+	// take the download itself.
+	size, r, err := e.client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	info, err := e.client.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	opts := downloadOpts{
+		Overwrite: e.flag("f"),
+		Checksum:  info.Checksum,
+		Stdout:    e.stdout,
+	}
+	// The checksum of a file encrypted end to end is the one of the
+	// ciphertext, the decryption can't be checked against it.
+	if len(info.WrappedKey) > 0 {
+		opts.Checksum = ""
+	}
+	if e.flag("progress") || (!e.json && isTerminal(e.stderr)) {
+		opts.Progress = e.stderr
+	}
+
+	n, err := download(dst, r, size, opts)
+	if err != nil {
+		return err
+	}
+	if dst == "-" {
+		return nil
+	}
+
+	if e.json {
+		return e.printJSON(map[string]any{"key": key, "size": n, "path": dst, "checksum": info.Checksum})
+	}
+	fmt.Fprintf(e.stdout, "Retrieved %s to %s (%d bytes)\n", key, dst, n)
+	return nil
+}
+
+func runRm(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	// Delete every key even if some fail, the exit code reports the last
+	// failure.
+	var failed error
+	deleted := []string{}
+	for _, key := range args {
+		if err := e.client.Delete(ctx, key); err != nil {
+			fmt.Fprintf(e.stderr, "Error: %s\n", err)
+			failed = err
+			continue
+		}
+		deleted = append(deleted, key)
+		if !e.json {
+			fmt.Fprintf(e.stdout, "Deleted %s\n", key)
+		}
+	}
+
+	if e.json {
+		if err := e.printJSON(map[string]any{"deleted": deleted}); err != nil {
+			return err
+		}
+	}
+	if failed != nil {
+		return fmt.Errorf("failed to delete %d of %d files: %w", len(args)-len(deleted), len(args), failed)
+	}
+	return nil
+}
+
+func runLs(ctx context.Context, e *env, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	files, err := e.client.List(ctx, prefix)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		out := make([]fileJSON, 0, len(files))
+		for _, f := range files {
+			out = append(out, toFileJSON(f))
+		}
+		return e.printJSON(out)
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	for _, f := range files {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", f.Size, f.ModTime.Local().Format(time.DateTime), f.Key)
+	}
+	return w.Flush()
+}
+
+func runStat(ctx context.Context, e *env, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	f, err := e.client.Stat(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		return e.printJSON(toFileJSON(f))
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Key:\t%s\n", f.Key)
+	fmt.Fprintf(w, "Size:\t%d\n", f.Size)
+	fmt.Fprintf(w, "Modified:\t%s\n", f.ModTime.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Checksum:\t%s\n", f.Checksum)
+	if len(f.WrappedKey) > 0 {
+		fmt.Fprintf(w, "Encryption:\tend to end\n")
+	}
+	if !f.ExpiresAt.IsZero() {
+		fmt.Fprintf(w, "Expires:\t%s\n", f.ExpiresAt.Local().Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func runPeers(ctx context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	peers, err := e.client.Peers(ctx)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		// gob turns empty lists into nil ones, print them as [].
+		return e.printJSON(append([]string{}, peers...))
+	}
+	for _, peer := range peers {
+		fmt.Fprintln(e.stdout, peer)
+	}
+	return nil
+}
+
+func runStatus(ctx context.Context, e *env, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	status, err := e.client.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	if e.json {
+		// gob turns empty lists into nil ones, print them as [].
+		status.Peers = append([]client.PeerStatus{}, status.Peers...)
+		status.Jobs = append([]client.JobStatus{}, status.Jobs...)
+		return e.printJSON(status)
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "Node:\t%s\n", status.ID)
+	fmt.Fprintf(w, "Version:\t%s\n", status.Version)
+	if !status.StartedAt.IsZero() {
+		fmt.Fprintf(w, "Uptime:\t%s, since %s\n", status.Uptime.Round(time.Second), status.StartedAt.Local().Format(time.DateTime))
+	}
+	fmt.Fprintf(w, "Objects:\t%d\n", status.Objects)
+	if len(status.StorageRoot) > 0 {
+		fmt.Fprintf(w, "Disk usage:\t%s under %s\n", formatBytes(status.DiskUsage), status.StorageRoot)
+	}
+	fmt.Fprintf(w, "Transfers:\t%d in flight\n", status.Transfers)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	w = tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "\nPEER\tSTATE\tRTT\tLAST SEEN")
+	for _, p := range status.Peers {
+		rtt := "-"
+		if p.RTT > 0 {
+			rtt = p.RTT.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\n", p.Address, p.State, rtt, time.Since(p.LastSeen).Round(time.Second))
+	}
+	fmt.Fprintln(w, "\nJOB\tEVERY\tLAST RUN\tDURATION\tERROR")
+	for _, j := range status.Jobs {
+		lastRun, duration := "never", "-"
+		switch {
+		case j.Running:
+			lastRun, duration = j.LastRun.Local().Format(time.DateTime), "running"
+		case !j.LastRun.IsZero():
+			lastRun, duration = j.LastRun.Local().Format(time.DateTime), j.LastDuration.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", j.Name, j.Interval, lastRun, duration, j.LastError)
+	}
+	return w.Flush()
+}
+
+func runPolicy(ctx context.Context, e *env, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch {
+	case args[0] == "set" && len(args) == 2:
+		p, err := e.policy(args[1])
+		if err != nil {
+			return err
+		}
+		if err := e.client.SetPolicy(ctx, p); err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(p)
+		}
+		fmt.Fprintf(e.stdout, "Set the policy of %q\n", p.Prefix)
+		return nil
+
+	case args[0] == "rm" && len(args) == 2:
+		if err := e.client.DeletePolicy(ctx, args[1]); err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(map[string]any{"deleted": args[1]})
+		}
+		fmt.Fprintf(e.stdout, "Deleted the policy of %q\n", args[1])
+		return nil
+
+	case args[0] == "ls" && len(args) == 1:
+		policies, err := e.client.Policies(ctx)
+		if err != nil {
+			return err
+		}
+		if e.json {
+			return e.printJSON(append([]store.Policy{}, policies...))
+		}
+		w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PREFIX\tREPLICAS\tERASURE\tPLAINTEXT\tCOMPRESSION\tTTL")
+		for _, p := range policies {
+			replicas, erasure, ttl := "all", "-", "-"
+			if p.Replicas > 0 {
+				replicas = strconv.Itoa(p.Replicas)
+			}
+			if p.DataShards > 0 {
+				replicas, erasure = "-", fmt.Sprintf("%d+%d", p.DataShards, p.ParityShards)
+			}
+			if p.TTL > 0 {
+				ttl = p.TTL.String()
+			}
+			fmt.Fprintf(w, "%q\t%s\t%s\t%t\t%s\t%s\n", p.Prefix, replicas, erasure, p.Plaintext, cmp.Or(p.Compression, "-"), ttl)
+		}
+		return w.Flush()
+	}
+
+	return errUsage
+}
+
+func runScrub(ctx context.Context, e *env, args []string) error {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "start" && args[0] != "status") {
+		return errUsage
+	}
+
+	var (
+		status client.ScrubStatus
+		err    error
+	)
+	if len(args) == 1 && args[0] == "start" {
+		status, err = e.client.StartScrub(ctx)
+	} else {
+		status, err = e.client.ScrubStatus(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	for e.flag("wait") && status.Running {
+		if !e.json {
+			fmt.Fprintf(e.stderr, "\rChecked %d of %d files", status.Checked, status.Total)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(scrubPollInterval):
+		}
+		if status, err = e.client.ScrubStatus(ctx); err != nil {
+			return err
+		}
+	}
+	if e.flag("wait") && !e.json {
+		fmt.Fprintln(e.stderr)
+	}
+
+	if e.json {
+		status.Findings = append([]client.ScrubFinding{}, status.Findings...)
+		return e.printJSON(status)
+	}
+
+	switch {
+	case status.StartedAt.IsZero():
+		fmt.Fprintln(e.stdout, "No scrub ran yet")
+	case status.Running:
+		fmt.Fprintf(e.stdout, "Scrub running since %s, %d of %d files checked, %d corrupted\n",
+			status.StartedAt.Local().Format(time.DateTime), status.Checked, status.Total, len(status.Findings))
+	default:
+		fmt.Fprintf(e.stdout, "Scrub finished at %s, %d files checked, %d corrupted\n",
+			status.FinishedAt.Local().Format(time.DateTime), status.Checked, len(status.Findings))
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	for _, f := range status.Findings {
+		state := "corrupted"
+		switch {
+		case f.Repaired:
+			state = "repaired"
+		case len(f.Quarantine) > 0:
+			state = "quarantined"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Key, state, f.Error)
+	}
+	return w.Flush()
+}
+
+// policy builds the policy of prefix out of the flags of the command.
+func (e *env) policy(prefix string) (store.Policy, error) {
+	p := store.Policy{
+		Prefix:      prefix,
+		Plaintext:   e.flag("plaintext"),
+		Compression: e.flags.Lookup("compression").Value.String(),
+	}
+
+	var err error
+	if p.Replicas, err = strconv.Atoi(e.flags.Lookup("replicas").Value.String()); err != nil {
+		return p, err
+	}
+	if p.TTL, err = time.ParseDuration(e.flags.Lookup("ttl").Value.String()); err != nil {
+		return p, err
+	}
+	if erasure := e.flags.Lookup("erasure").Value.String(); len(erasure) > 0 {
+		opts, err := config.ParseErasure(erasure)
+		if err != nil {
+			return p, err
+		}
+		p.DataShards, p.ParityShards = opts.DataShards, opts.ParityShards
+	}
+
+	return p, p.Validate()
+}
+
+type fileJSON struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum"`
+	EndToEnd bool      `json:"end_to_end,omitempty"`
+	// ExpiresAt is a pointer so it's left out of the files which don't
+	// expire.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func toFileJSON(f client.FileInfo) fileJSON {
+	out := fileJSON{Key: f.Key, Size: f.Size, ModTime: f.ModTime, Checksum: f.Checksum, EndToEnd: len(f.WrappedKey) > 0}
+	if !f.ExpiresAt.IsZero() {
+		out.ExpiresAt = &f.ExpiresAt
+	}
+	return out
+}
+
+func (e *env) flag(name string) bool {
+	return e.flags.Lookup(name).Value.String() == "true"
+}
+
+func (e *env) printJSON(v any) error {
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,363 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/client"
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/rpc"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+func TestCommands(t *testing.T) {
+	socket := serveAdmin(t)
+
+	local := filepath.Join(t.TempDir(), "hello.txt")
+	assert.Nil(t, os.WriteFile(local, []byte("Hello World"), 0o644))
+
+	code, stdout, _ := run(t, "put", "-node", socket, local, "docs/hello.txt")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "Stored docs/hello.txt (11 bytes)\n", stdout)
+
+	// Flags may follow the arguments.
+	code, stdout, _ = run(t, "get", "docs/hello.txt", "-node", socket)
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "Hello World", stdout)
+
+	out := filepath.Join(t.TempDir(), "out.txt")
+	code, _, _ = run(t, "get", "-node", socket, "-o", out, "docs/hello.txt")
+	assert.Equal(t, ExitOK, code)
+	data, err := os.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World", string(data))
+
+	code, stdout, _ = run(t, "ls", "-node", socket, "--json", "docs/")
+	assert.Equal(t, ExitOK, code)
+	var files []fileJSON
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &files))
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, "docs/hello.txt", files[0].Key)
+	assert.Equal(t, int64(11), files[0].Size)
+
+	code, stdout, _ = run(t, "stat", "-node", socket, "docs/hello.txt")
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e")
+
+	code, _, _ = run(t, "put", "-node", socket, "-ttl", "24h", local, "tmp/hello.txt")
+	assert.Equal(t, ExitOK, code)
+	code, stdout, _ = run(t, "stat", "-node", socket, "-json", "tmp/hello.txt")
+	assert.Equal(t, ExitOK, code)
+	var file fileJSON
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &file))
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), *file.ExpiresAt, time.Minute)
+
+	code, stdout, _ = run(t, "scrub", "-node", socket, "-wait", "-json", "start")
+	assert.Equal(t, ExitOK, code)
+	var scrub client.ScrubStatus
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &scrub))
+	assert.False(t, scrub.Running)
+	assert.Equal(t, 2, scrub.Checked)
+	assert.Empty(t, scrub.Findings)
+
+	code, stdout, _ = run(t, "scrub", "-node", socket)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "2 files checked, 0 corrupted")
+
+	code, stdout, _ = run(t, "peers", "-node", socket, "-json")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "[]\n", stdout)
+
+	code, _, stderr := run(t, "rm", "-node", socket, "docs/hello.txt", "missing")
+	assert.Equal(t, ExitNotFound, code)
+	assert.Contains(t, stderr, "failed to delete 1 of 2 files")
+
+	code, _, _ = run(t, "stat", "-node", socket, "docs/hello.txt")
+	assert.Equal(t, ExitNotFound, code)
+}
+
+func TestPolicy(t *testing.T) {
+	socket := serveAdmin(t)
+
+	code, stdout, _ := run(t, "policy", "-node", socket, "-replicas", "2", "-ttl", "24h", "set", "logs/")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, "Set the policy of \"logs/\"\n", stdout)
+
+	code, _, stderr := run(t, "policy", "-node", socket, "-replicas", "2", "-erasure", "4+2", "set", "bad/")
+	assert.Equal(t, ExitError, code)
+	assert.Contains(t, stderr, "either erasure coded or replicated")
+
+	code, stdout, _ = run(t, "policy", "-node", socket, "-json", "ls")
+	assert.Equal(t, ExitOK, code)
+	var policies []store.Policy
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &policies))
+	assert.Equal(t, 1, len(policies))
+	assert.Equal(t, "logs/", policies[0].Prefix)
+	assert.Equal(t, 2, policies[0].Replicas)
+	assert.Equal(t, 24*time.Hour, policies[0].TTL)
+
+	code, _, _ = run(t, "policy", "-node", socket, "rm", "logs/")
+	assert.Equal(t, ExitOK, code)
+	code, _, _ = run(t, "policy", "-node", socket, "rm", "logs/")
+	assert.Equal(t, ExitNotFound, code)
+
+	code, _, _ = run(t, "policy", "-node", socket, "set")
+	assert.Equal(t, ExitUsage, code)
+}
+
+func TestStatus(t *testing.T) {
+	socket := serveAdmin(t)
+
+	code, stdout, _ := run(t, "status", "-node", socket)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stdout, "Version:")
+	assert.Contains(t, stdout, "PEER")
+	assert.Contains(t, stdout, "JOB")
+
+	code, stdout, _ = run(t, "status", "-node", socket, "-json")
+	assert.Equal(t, ExitOK, code)
+	var status client.NodeStatus
+	assert.Nil(t, json.Unmarshal([]byte(stdout), &status))
+	assert.Equal(t, server.Version, status.Version)
+	assert.Equal(t, 0, status.Objects)
+	assert.NotNil(t, status.Peers)
+
+	code, _, _ = run(t, "status", "-node", socket, "extra")
+	assert.Equal(t, ExitUsage, code)
+}
+
+func TestGet(t *testing.T) {
+	socket := serveAdmin(t)
+
+	// Every byte value, which printing as a string would mangle.
+	data := make([]byte, 3*rpc.ChunkSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	local := filepath.Join(t.TempDir(), "data.bin")
+	assert.Nil(t, os.WriteFile(local, data, 0o644))
+
+	code, _, _ := run(t, "put", "-node", socket, local, "bin/data.bin")
+	assert.Equal(t, ExitOK, code)
+
+	code, stdout, _ := run(t, "get", "-node", socket, "bin/data.bin", "-")
+	assert.Equal(t, ExitOK, code)
+	assert.Equal(t, data, []byte(stdout))
+
+	// Downloads into a directory are named after the key.
+	dir := t.TempDir()
+	code, _, stderr := run(t, "get", "-node", socket, "-progress", "bin/data.bin", dir)
+	assert.Equal(t, ExitOK, code)
+	assert.Contains(t, stderr, "192.0 KiB / 192.0 KiB (100%)")
+	received, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, data, received)
+
+	code, _, stderr = run(t, "get", "-node", socket, "bin/data.bin", dir)
+	assert.Equal(t, ExitError, code)
+	assert.Contains(t, stderr, "already exists")
+
+	code, _, _ = run(t, "get", "-node", socket, "-f", "bin/data.bin", dir)
+	assert.Equal(t, ExitOK, code)
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "hello.txt")
+
+	_, err := download(dst, strings.NewReader("Hello World"), 11, downloadOpts{Checksum: "0000"})
+	assert.ErrorIs(t, err, errChecksumMismatch)
+
+	// Nothing is left behind by a failed download.
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	_, err = download(dst, strings.NewReader("Hello"), 11, downloadOpts{})
+	assert.ErrorContains(t, err, "received 5 of 11 bytes")
+
+	n, err := download(dst, strings.NewReader("Hello World"), 11, downloadOpts{
+		Checksum: "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+}
+
+func TestUsage(t *testing.T) {
+	code, _, stderr := run(t, "put", "-node", "/nowhere.sock", "only-one-arg")
+	assert.Equal(t, ExitUsage, code)
+	assert.True(t, strings.HasPrefix(stderr, "Usage: fs put"))
+
+	t.Setenv("DFS_NODE", "")
+	code, _, stderr = run(t, "ls")
+	assert.Equal(t, ExitUsage, code)
+	assert.Contains(t, stderr, "no node given")
+
+	code, _, _ = run(t, "ls", "-no-such-flag")
+	assert.Equal(t, ExitUsage, code)
+}
+
+func TestConfigCheck(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dfs.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("listen: \":3000\"\nstorage:\n  backend: memory\n"), 0o600))
+
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := RunConfig([]string{"check", "-config", path}, stdout, stderr)
+	assert.Equal(t, ExitOK, code, stderr.String())
+	assert.Equal(t, strconv.Quote(path)+" is valid\n", stdout.String())
+
+	// The environment and the flags override the file.
+	t.Setenv("DFS_LOG_FORMAT", "json")
+	stdout.Reset()
+	code = RunConfig([]string{"check", "-config", path, "-port", "4000", "-grpc", ":7000", "-print"}, stdout, stderr)
+	assert.Equal(t, ExitOK, code, stderr.String())
+	assert.Contains(t, stdout.String(), "listen: :4000\n")
+	assert.Contains(t, stdout.String(), "storage_root: :4000_files\n")
+	// The gRPC service is neither encrypted nor authenticated, it only
+	// listens on loopback.
+	assert.Contains(t, stdout.String(), "address: 127.0.0.1:7000\n")
+	assert.Contains(t, stdout.String(), "backend: memory\n")
+	assert.Contains(t, stdout.String(), "format: json\n")
+
+	// Every problem is reported.
+	t.Setenv(ConfigEnv, path)
+	stdout.Reset()
+	code = RunConfig([]string{"check", "-backend", "tape", "-log-level", "loud"}, stdout, stderr)
+	assert.Equal(t, ExitError, code)
+	assert.Contains(t, stderr.String(), "storage.backend: unknown backend \"tape\"")
+	assert.Contains(t, stderr.String(), "log.level: invalid level \"loud\"")
+
+	code = RunConfig([]string{"lint"}, stdout, stderr)
+	assert.Equal(t, ExitUsage, code)
+}
+
+func TestReload(t *testing.T) {
+	fs, addr := startNode(t)
+	_, peer := startNode(t)
+
+	path := filepath.Join(t.TempDir(), "dfs.yaml")
+	write := func(content string) {
+		// The file keeps the listen address of the running node.
+		content = fmt.Sprintf("listen: %q\nstorage_root: %q\nkeys:\n  transport_file: %q\n", addr, fs.StorageRoot, fs.StorageRoot+".transport.key") + content
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	load := func() (config.Config, error) {
+		return config.Load(path, func(string) (string, bool) { return "", false }, nil)
+	}
+
+	write("")
+	c, err := load()
+	assert.Nil(t, err)
+	opts, err := NewOptions(c)
+	assert.Nil(t, err)
+	opts.Load = load
+	r := NewReloader(opts, fs, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// The peers, the log level and the bandwidth change live.
+	write(fmt.Sprintf("peers: [%q]\nlog:\n  level: debug\nlimits:\n  bandwidth:\n    background:\n      outbound: 1MiB\n", peer))
+	assert.Nil(t, r.Reload())
+	assert.Equal(t, slog.LevelDebug, opts.LogLevel.Level())
+	assert.Equal(t, config.ByteSize(1<<20), r.Options().Limits.Bandwidth.Background.Outbound)
+	assert.Eventually(t, func() bool { return len(fs.Peers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The changes requiring a restart are rejected, the others applied.
+	write("storage:\n  backend: memory\n")
+	err = r.Reload()
+	assert.ErrorIs(t, err, ErrRestartRequired)
+	assert.Contains(t, err.Error(), "storage.backend changed, restart the node to apply it")
+	assert.Eventually(t, func() bool { return len(fs.Peers()) == 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, slog.LevelInfo, opts.LogLevel.Level())
+	assert.Equal(t, config.BackendDisk, r.Options().Storage.Backend)
+	assert.Empty(t, r.Options().Peers)
+
+	// A configuration which isn't valid is rejected as a whole.
+	write("log:\n  level: loud\nlimits:\n  shutdown_timeout: 1m\n")
+	err = r.Reload()
+	assert.ErrorContains(t, err, "configuration rejected")
+	assert.Equal(t, config.DefaultShutdownTimeout, r.Options().Limits.ShutdownTimeout)
+}
+
+// startNode starts a file server and returns it along with its address.
+func startNode(t *testing.T) (*server.FileServer, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: addr,
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+		Logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            cipher.NewEncryptionKey(),
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	tr.OnPeer = fs.OnPeer
+	tr.OnPeerClose = fs.OnPeerClose
+	go fs.Start()
+	t.Cleanup(fs.Stop)
+
+	// The node has to listen before it's dialed.
+	time.Sleep(50 * time.Millisecond)
+	return fs, addr
+}
+
+func serveAdmin(t *testing.T) string {
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            cipher.NewEncryptionKey(),
+	})
+
+	// Socket paths are limited in length, t.TempDir may be too deep.
+	dir, err := os.MkdirTemp("", "dfs-cli-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socket := filepath.Join(dir, "admin.sock")
+	lis, err := ListenAdmin(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rpc.NewGRPCServer(fs)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return socket
+}
+
+func run(t *testing.T, args ...string) (int, string, string) {
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	code := Run(args, strings.NewReader(""), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
@@ -0,0 +1,248 @@
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/rpc"
+	"natneam.github.io/dfs-core/s3"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+// ConfigEnv is the environment variable of the configuration file, when
+// -config isn't given.
+const ConfigEnv = "DFS_CONFIG"
+
+// Options are the configuration of the node to serve, along with what's
+// derived from it.
+type Options struct {
+	config.Config
+	// ConfigFile is the file the configuration was read from, if any.
+	ConfigFile string
+	// Load reads the configuration again, from the same file, environment
+	// and flags.
+	Load func() (config.Config, error)
+
+	// Interactive is set when the node should run the interactive CLI,
+	// the serve subcommand runs the node without it.
+	Interactive bool
+	// KeyHash hashes the keys of the files.
+	KeyHash cipher.KeyHash
+	// Erasure erasure codes the files instead of replicating them.
+	Erasure server.ErasureOpts
+	// LogLevel is the level of log.level, which the logger of NewLogger
+	// follows when it's changed.
+	LogLevel      *slog.LevelVar
+	S3Credentials map[string]string
+	// GRPCTLS is the TLS configuration of the gRPC service, and GRPCTokens
+	// the tokens it accepts. The service is neither encrypted nor
+	// authenticated when they're empty.
+	GRPCTLS    *tls.Config
+	GRPCTokens []string
+}
+
+// settingFlags are the flags of the settings of a node, the other settings
+// are only set by the configuration file and the environment.
+var settingFlags = []struct {
+	name, setting, usage string
+}{
+	{"listen", "listen", "Address the node listens for its peers on (e.g. :3000)"},
+	{"advertise", "advertise", "Address the peers reach the node at, when it isn't the listen address"},
+	{"storage-root", "storage_root", "Directory the files are kept in (default <listen>_files)"},
+	{"peers", "peers", "Comma-separated list of bootstrapped nodes url to connect to"},
+	{"admin", "admin_socket", "Path of the admin socket used by the subcommands (default $TMPDIR/dfs-<port>.sock)"},
+	{"key-file", "keys.file", "File holding the key the files are encrypted with at rest, created if missing (default <storage root>.key)"},
+	{"transport-key-file", "keys.transport_file", "File holding the key the streams to the peers are encrypted with, the same on every node, created if missing (required with -peers, default a new key at every start)"},
+	{"hash", "keys.hash", "Key hash: md5, sha256, blake3 or hmac-sha256, the same on every node (default sha256)"},
+	{"hash-key-file", "keys.hash_key_file", "File holding the secret of the hmac-sha256 key hash, the same on every node"},
+	{"backend", "storage.backend", "Where the files are kept: disk, bolt (a single file database, <storage root>.db) or memory (default disk)"},
+	{"compression", "storage.compression", "Compress the files at rest with " + strings.Join(store.Compressions(), ", ") + ", unless their policy says otherwise"},
+	{"erasure", "replication.erasure", "Erasure code the files into <data>+<parity> shards kept by distinct peers instead of replicating them (e.g. 4+2)"},
+	{"s3", "s3.address", "Listen address of the S3 compatible gateway (e.g. :9000)"},
+	{"s3-credentials", "s3.credentials", "File with the '<access key id> <secret key>' pairs accepted by the S3 gateway"},
+	{"grpc", "grpc.address", "Listen address of the gRPC file service, on loopback unless -grpc-cert and -grpc-tokens are given (e.g. :7000)"},
+	{"grpc-cert", "grpc.cert_file", "PEM certificate the gRPC file service serves TLS with"},
+	{"grpc-key", "grpc.key_file", "PEM key of the -grpc-cert certificate"},
+	{"grpc-tokens", "grpc.tokens", "File with the tokens accepted by the gRPC file service, one per line"},
+	{"metrics", "metrics.address", "Listen address of the Prometheus /metrics endpoint (e.g. :9100)"},
+	{"otlp", "tracing.otlp_endpoint", "URL of the OpenTelemetry collector the traces are sent to over gRPC (e.g. http://localhost:4317)"},
+	{"log-level", "log.level", "Lowest level logged: debug, info, warn or error (default info)"},
+	{"log-format", "log.format", "Format of the logs: text or json (default text)"},
+	{"shutdown-timeout", "limits.shutdown_timeout", "How long the transfers in flight are given to finish on SIGINT or SIGTERM before they're aborted (default 30s)"},
+}
+
+// serveFlags registers the flags of the configuration of a node on flags.
+// Once they're parsed, the returned function loads the configuration they
+// give, over the environment and the configuration file.
+func serveFlags(flags *flag.FlagSet) func(lookupEnv func(string) (string, bool)) (config.Config, string, error) {
+	path := flags.String("config", "", "YAML configuration file, overridden by the DFS_* environment variables and the flags (default $"+ConfigEnv+")")
+	port := flags.Int("port", 0, "Port the node listens on, short for -listen :<port>")
+
+	values := map[string]string{}
+	for _, f := range settingFlags {
+		flags.Func(f.name, f.usage, func(value string) error {
+			values[f.setting] = value
+			return nil
+		})
+	}
+
+	return func(lookupEnv func(string) (string, bool)) (config.Config, string, error) {
+		if *port != 0 {
+			if _, ok := values["listen"]; ok {
+				return config.Config{}, "", fmt.Errorf("-port and -listen can't both be given")
+			}
+			values["listen"] = fmt.Sprintf(":%d", *port)
+		}
+
+		file := *path
+		if len(file) == 0 {
+			file, _ = lookupEnv(ConfigEnv)
+		}
+		c, err := config.Load(file, lookupEnv, values)
+		return c, file, err
+	}
+}
+
+// NewOptions checks the configuration, fills in the settings derived from
+// the others and loads what the files it names hold.
+func NewOptions(c config.Config) (Options, error) {
+	if err := c.Validate(); err != nil {
+		return Options{}, err
+	}
+
+	port, _ := config.Port(c.Listen)
+	if len(c.StorageRoot) == 0 {
+		c.StorageRoot = c.Listen + "_files"
+	}
+	if len(c.Keys.File) == 0 {
+		c.Keys.File = c.StorageRoot + ".key"
+	}
+	if len(c.AdminSocket) == 0 {
+		c.AdminSocket = AdminSocket(port)
+	}
+
+	opts := Options{Config: c}
+	var err error
+	if opts.KeyHash, err = keyHash(c.Keys.Hash, c.Keys.HashKeyFile); err != nil {
+		return Options{}, fmt.Errorf("keys.hash: %w", err)
+	}
+	if len(c.Replication.Erasure) > 0 {
+		// Validated already.
+		opts.Erasure, _ = config.ParseErasure(c.Replication.Erasure)
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Log.Level))
+	opts.LogLevel = new(slog.LevelVar)
+	opts.LogLevel.Set(level)
+
+	if len(c.S3.Address) > 0 {
+		if opts.S3Credentials, err = s3.LoadCredentials(c.S3.Credentials); err != nil {
+			return Options{}, fmt.Errorf("s3.credentials: %w", err)
+		}
+	}
+
+	if len(c.GRPC.CertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.GRPC.CertFile, c.GRPC.KeyFile)
+		if err != nil {
+			return Options{}, fmt.Errorf("grpc.cert_file: %w", err)
+		}
+		opts.GRPCTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if len(c.GRPC.Tokens) > 0 {
+		if opts.GRPCTokens, err = rpc.LoadTokens(c.GRPC.Tokens); err != nil {
+			return Options{}, fmt.Errorf("grpc.tokens: %w", err)
+		}
+	}
+	// An address without a host would listen on every interface.
+	if strings.HasPrefix(c.GRPC.Address, ":") && !c.GRPC.Secured() {
+		opts.GRPC.Address = "127.0.0.1" + c.GRPC.Address
+	}
+
+	return opts, nil
+}
+
+// configCommands work on the configuration of a node, without the node.
+var configCommands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"check": runConfigCheck,
+}
+
+// RunConfig runs the config subcommand named by args[0] and returns the exit
+// code of the process.
+func RunConfig(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "Usage: fs config <check> [flags]")
+		return ExitUsage
+	}
+
+	run, ok := configCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown config command: %s\n", args[0])
+		return ExitUsage
+	}
+	return run(args[1:], stdout, stderr)
+}
+
+func runConfigCheck(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: fs config check [flags]")
+		fmt.Fprintln(stderr, "Check the configuration a node would run with, given the same file, environment and flags")
+		fmt.Fprintln(stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	printConfig := fs.Bool("print", false, "Print the resulting configuration as YAML")
+	load := serveFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	c, file, err := load(os.LookupEnv)
+	if err == nil {
+		var opts Options
+		opts, err = NewOptions(c)
+		c = opts.Config
+	}
+	if err != nil {
+		// Every problem on a line of its own.
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(stderr, line)
+		}
+		return ExitError
+	}
+
+	if *printConfig {
+		out, err := c.Marshal()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return ExitError
+		}
+		stdout.Write(out)
+		return ExitOK
+	}
+
+	source := "The configuration"
+	if len(file) > 0 {
+		source = strconv.Quote(file)
+	}
+	fmt.Fprintf(stdout, "%s is valid\n", source)
+	return ExitOK
+}
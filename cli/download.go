@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// progressInterval is how often the download progress is printed.
+const progressInterval = 100 * time.Millisecond
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+type downloadOpts struct {
+	// Overwrite allows replacing an existing file.
+	Overwrite bool
+	// Checksum is the hex SHA-256 the content must have, it isn't verified
+	// when empty.
+	Checksum string
+	// Stdout receives the content when the destination is "-".
+	Stdout io.Writer
+	// Progress receives the progress of the download, nothing is reported
+	// when nil.
+	Progress io.Writer
+}
+
+// download streams size bytes of r into the file at dst, or to stdout when
+// dst is "-". Files are written next to dst and only renamed once verified,
+// so a failed download never leaves a partial or corrupted file behind.
+// Content written to stdout can't be taken back, a checksum mismatch is
+// still reported.
+func download(dst string, r io.Reader, size int64, opts downloadOpts) (int64, error) {
+	hash := sha256.New()
+	var progress *progressWriter
+	if opts.Progress != nil {
+		progress = &progressWriter{out: opts.Progress, name: dst, size: size}
+		r = io.TeeReader(r, progress)
+	}
+	r = io.TeeReader(r, hash)
+
+	verify := func(n int64) error {
+		if progress != nil {
+			progress.done()
+		}
+		if n != size {
+			return fmt.Errorf("received %d of %d bytes", n, size)
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); len(opts.Checksum) > 0 && sum != opts.Checksum {
+			return fmt.Errorf("%w: expected %s, got %s", errChecksumMismatch, opts.Checksum, sum)
+		}
+		return nil
+	}
+
+	if dst == "-" {
+		n, err := io.Copy(opts.Stdout, r)
+		if err != nil {
+			return n, err
+		}
+		return n, verify(n)
+	}
+
+	if !opts.Overwrite {
+		if _, err := os.Stat(dst); err == nil {
+			return 0, fmt.Errorf("%s already exists, use -f to overwrite it", dst)
+		}
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(dst), fmt.Sprintf(".%s.%d.part", filepath.Base(dst), os.Getpid()))
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verify(n)
+	}
+	if err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(tmp.Name(), dst)
+}
+
+// destination returns where the file of key is downloaded to. Files are
+// named after the last element of their key when dst is empty or an
+// existing directory.
+func destination(key, dst string) string {
+	if len(dst) == 0 {
+		return path.Base(key)
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.IsDir() {
+		return filepath.Join(dst, path.Base(key))
+	}
+	return dst
+}
+
+// progressWriter prints how much of a download was received.
+type progressWriter struct {
+	out     io.Writer
+	name    string
+	size    int64
+	written int64
+	last    time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.last) >= progressInterval {
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) print() {
+	p.last = time.Now()
+
+	percent := 100
+	if p.size > 0 {
+		percent = int(p.written * 100 / p.size)
+	}
+	fmt.Fprintf(p.out, "\r%s: %s / %s (%d%%)", p.name, formatBytes(p.written), formatBytes(p.size), percent)
+}
+
+func (p *progressWriter) done() {
+	p.print()
+	fmt.Fprintln(p.out)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// isTerminal tells whether w is a terminal, progress is only reported to
+// terminals unless asked for.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,199 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/server"
+)
+
+// DefaultReloadInterval is how often the configuration file is checked for
+// changes.
+const DefaultReloadInterval = 2 * time.Second
+
+// ErrRestartRequired is returned for the changes of the settings which only
+// apply once the node restarts.
+var ErrRestartRequired = errors.New("restart the node to apply it")
+
+// liveSettings are the settings applied to a running node, the others
+// require a restart. Each updates the options of the Reloader once it's
+// applied.
+var liveSettings = map[string]func(r *Reloader, next Options) error{
+	"peers":                   (*Reloader).setPeers,
+	"log.level":               (*Reloader).setLogLevel,
+	"limits.shutdown_timeout": (*Reloader).setShutdownTimeout,
+
+	"limits.bandwidth.foreground.outbound":      (*Reloader).setBandwidth,
+	"limits.bandwidth.foreground.inbound":       (*Reloader).setBandwidth,
+	"limits.bandwidth.foreground.peer_outbound": (*Reloader).setBandwidth,
+	"limits.bandwidth.foreground.peer_inbound":  (*Reloader).setBandwidth,
+	"limits.bandwidth.background.outbound":      (*Reloader).setBandwidth,
+	"limits.bandwidth.background.inbound":       (*Reloader).setBandwidth,
+	"limits.bandwidth.background.peer_outbound": (*Reloader).setBandwidth,
+	"limits.bandwidth.background.peer_inbound":  (*Reloader).setBandwidth,
+}
+
+// Reloader applies the changes of the configuration to a running node.
+type Reloader struct {
+	fs  *server.FileServer
+	log *slog.Logger
+
+	lock sync.Mutex
+	// opts are the options the node runs with, the changes which weren't
+	// applied aside.
+	opts Options
+}
+
+func NewReloader(opts Options, fs *server.FileServer, logger *slog.Logger) *Reloader {
+	return &Reloader{
+		fs:   fs,
+		log:  logger,
+		opts: opts,
+	}
+}
+
+// Options returns the options the node runs with.
+func (r *Reloader) Options() Options {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.opts
+}
+
+// Reload reads the configuration again and applies what changed. A
+// configuration which isn't valid is rejected as a whole, otherwise the
+// changes requiring a restart are rejected and the others applied.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c, err := r.opts.Load()
+	if err != nil {
+		return fmt.Errorf("configuration rejected: %w", err)
+	}
+	next, err := NewOptions(c)
+	if err != nil {
+		return fmt.Errorf("configuration rejected: %w", err)
+	}
+
+	var errs []error
+	for _, setting := range config.Changed(r.opts.Config, next.Config) {
+		apply, ok := liveSettings[setting]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s changed, %w", setting, ErrRestartRequired))
+			continue
+		}
+		if err := apply(r, next); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", setting, err))
+			continue
+		}
+		r.log.Info("Applied a configuration change", "setting", setting)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Watch reloads the configuration on SIGHUP and when its file changes,
+// which is checked every interval, until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := fileState(r.opts.ConfigFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.log.Info("Reloading the configuration on SIGHUP")
+		case <-ticker.C:
+			state := fileState(r.opts.ConfigFile)
+			if state == last {
+				continue
+			}
+			last = state
+			r.log.Info("Reloading the configuration, its file changed", "file", r.opts.ConfigFile)
+		}
+
+		if err := r.Reload(); err != nil {
+			for _, reason := range strings.Split(err.Error(), "\n") {
+				r.log.Warn("Configuration change rejected", "reason", reason)
+			}
+		}
+	}
+}
+
+// fileState tells when the file at path changes, it's empty when there's
+// no file.
+func fileState(path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d %d", info.ModTime().UnixNano(), info.Size())
+}
+
+// setPeers connects to the peers added and disconnects from the ones
+// removed. The peers which couldn't be reached are tried again at the next
+// reload.
+func (r *Reloader) setPeers(next Options) error {
+	old := map[string]bool{}
+	for _, peer := range r.opts.Peers {
+		old[peer] = true
+	}
+
+	var errs []error
+	peers := []string{}
+	for _, peer := range next.Peers {
+		if !old[peer] {
+			if err := r.fs.BootstrapNode(peer); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		delete(old, peer)
+		peers = append(peers, peer)
+	}
+	for peer := range old {
+		// It may be gone already.
+		if err := r.fs.Disconnect(peer); err != nil {
+			r.log.Debug("Failed to disconnect from a removed peer", "peer", peer, "err", err)
+		}
+	}
+
+	r.opts.Peers = peers
+	return errors.Join(errs...)
+}
+
+func (r *Reloader) setLogLevel(next Options) error {
+	r.opts.LogLevel.Set(next.LogLevel.Level())
+	r.opts.Log.Level = next.Log.Level
+	return nil
+}
+
+func (r *Reloader) setShutdownTimeout(next Options) error {
+	r.opts.Limits.ShutdownTimeout = next.Limits.ShutdownTimeout
+	return nil
+}
+
+// setBandwidth applies every bandwidth limit at once, whichever changed.
+func (r *Reloader) setBandwidth(next Options) error {
+	r.fs.SetBandwidth(next.Limits.Bandwidth.Limits())
+	r.opts.Limits.Bandwidth = next.Limits.Bandwidth
+	return nil
+}
@@ -0,0 +1,138 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/store"
+)
+
+// storeCommands maintain the store of a stopped node, they work on its
+// storage root directly.
+var storeCommands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"migrate": runMigrate,
+}
+
+// RunStore runs the store subcommand named by args[0] and returns the exit
+// code of the process.
+func RunStore(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprintln(stderr, "Usage: fs store <migrate> [flags]")
+		return ExitUsage
+	}
+
+	run, ok := storeCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown store command: %s\n", args[0])
+		return ExitUsage
+	}
+	return run(args[1:], stdout, stderr)
+}
+
+func runMigrate(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: fs store migrate -root <dir> -from <layout> -to <layout> [flags]")
+		fmt.Fprintln(stderr, "Move the store of a stopped node to another layout")
+		fmt.Fprintln(stderr, "\nLayouts: plain (the key is the path) or a key hash, md5, sha256, blake3 or hmac-sha256")
+		fmt.Fprintln(stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	root := fs.String("root", "", "Storage root of the node")
+	from := fs.String("from", cipher.HashMD5, "Layout the store is in")
+	to := fs.String("to", cipher.HashSHA256, "Layout to move the store to")
+	hashKeyFile := fs.String("hash-key-file", "", "File holding the secret of the hmac-sha256 key hash")
+	asJSON := fs.Bool("json", false, "Print the result as JSON")
+
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+	if len(*root) == 0 || fs.NArg() > 0 {
+		fs.Usage()
+		return ExitUsage
+	}
+
+	fromOpts, err := layout(*root, *from, *hashKeyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitUsage
+	}
+	toOpts, err := layout(*root, *to, *hashKeyFile)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return ExitUsage
+	}
+
+	result, err := store.Migrate(fromOpts, toOpts)
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		if result.Moved > 0 {
+			fmt.Fprintf(stderr, "%d files were moved, run the command again to finish\n", result.Moved)
+		}
+		return ExitError
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]any{"moved": result.Moved, "skipped": result.Skipped, "unknown": append([]string{}, result.Unknown...), "replicas": append([]string{}, result.Replicas...)})
+		return ExitOK
+	}
+
+	fmt.Fprintf(stdout, "Moved %d files to %s, %d already were.\n", result.Moved, *to, result.Skipped)
+	if len(result.Unknown) > 0 {
+		fmt.Fprintf(stdout, "%d blobs have no metadata and were left in place:\n", len(result.Unknown))
+		for _, path := range result.Unknown {
+			fmt.Fprintf(stdout, "  %s\n", path)
+		}
+	}
+	if len(result.Replicas) > 0 {
+		fmt.Fprintf(stdout, "%d copies kept for the peers were left in place, store their files again from the migrated nodes:\n", len(result.Replicas))
+		for _, path := range result.Replicas {
+			fmt.Fprintf(stdout, "  %s\n", path)
+		}
+	}
+	return ExitOK
+}
+
+// layoutPlain names the layout of DefaultPathTransformFunc.
+const layoutPlain = "plain"
+
+// layout returns the options of the store at root laid out as named.
+func layout(root, name, secretFile string) (store.StoreOpts, error) {
+	if name == layoutPlain {
+		return store.StoreOpts{Root: root, PathTransformFunc: store.DefaultPathTransformFunc}, nil
+	}
+
+	h, err := keyHash(name, secretFile)
+	if err != nil {
+		return store.StoreOpts{}, err
+	}
+	return store.StoreOpts{Root: root, KeyHash: h}, nil
+}
+
+// keyHash returns the named key hash, the secret of HMAC is read from
+// secretFile.
+func keyHash(name, secretFile string) (cipher.KeyHash, error) {
+	var secret []byte
+	if name == cipher.HashHMAC {
+		if len(secretFile) == 0 {
+			return nil, fmt.Errorf("%s requires -hash-key-file", name)
+		}
+
+		var err error
+		if secret, err = cipher.ReadKey(secretFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return cipher.KeyHashByName(name, secret)
+}
@@ -0,0 +1,580 @@
+// Package client is a Go client for the gRPC file service exposed by the
+// nodes. It talks to any of the configured nodes and moves on to the next
+// one when a node fails.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/rpc"
+	"natneam.github.io/dfs-core/store"
+)
+
+// watchRetryInterval is how long Watch waits before subscribing again after
+// losing its node.
+const watchRetryInterval = time.Second
+
+var (
+	ErrNotFound = errors.New("file not found")
+	// ErrNoPolicy is returned when deleting a policy which doesn't exist.
+	ErrNoPolicy = errors.New("no such policy")
+	// ErrEncrypted is returned when reading a file encrypted end to end
+	// without a key.
+	ErrEncrypted = errors.New("the file is encrypted end to end and the client has no key")
+)
+
+type (
+	FileInfo     = rpc.FileInfo
+	ScrubStatus  = rpc.ScrubStatus
+	ScrubFinding = rpc.ScrubFinding
+	NodeStatus   = rpc.NodeStatus
+	PeerStatus   = rpc.PeerStatus
+	JobStatus    = rpc.JobStatus
+	Event        = rpc.WatchEvent
+	EventType    = rpc.EventType
+)
+
+const (
+	EventStore  = rpc.EventStore
+	EventDelete = rpc.EventDelete
+)
+
+type ClientOpts struct {
+	// Nodes are the gRPC addresses of the nodes the client may use.
+	Nodes []string
+	// DialOptions are added to the options used to connect to the nodes.
+	DialOptions []grpc.DialOption
+	// TLS encrypts the connections to the nodes, they aren't when it's
+	// nil, which is only fit for a node on the same host.
+	TLS *tls.Config
+	// Token is sent along every call, for the nodes started with
+	// grpc.tokens.
+	Token string
+	// Key enables end to end encryption. Every file put is encrypted with
+	// a data key of its own before it leaves the client, the nodes only
+	// get the ciphertext and the data key wrapped by Key. Files encrypted
+	// this way can only be read by clients holding Key.
+	Key []byte
+}
+
+type Client struct {
+	ClientOpts
+
+	lock    sync.Mutex
+	conns   []*grpc.ClientConn
+	current int
+}
+
+func New(opts ClientOpts) (*Client, error) {
+	if len(opts.Nodes) == 0 {
+		return nil, fmt.Errorf("no nodes to connect to")
+	}
+
+	creds := insecure.NewCredentials()
+	if opts.TLS != nil {
+		creds = credentials.NewTLS(opts.TLS)
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rpc.CodecName)),
+	}
+	if len(opts.Token) > 0 {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(tokenCredentials(opts.Token)))
+	}
+	dialOpts = append(dialOpts, opts.DialOptions...)
+
+	c := &Client{ClientOpts: opts}
+	for _, node := range opts.Nodes {
+		conn, err := grpc.NewClient(node, dialOpts...)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("node %s: %w", node, err)
+		}
+		c.conns = append(c.conns, conn)
+	}
+
+	return c, nil
+}
+
+// tokenCredentials sends the token of the client along every call.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{rpc.AuthorizationHeader: "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity lets the token go over the unencrypted
+// connections to a node on the same host.
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func (c *Client) Close() error {
+	var errs []error
+	for _, conn := range c.conns {
+		errs = append(errs, conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// PutOpts are the options of a Put.
+type PutOpts struct {
+	// TTL is how long the file is kept, as the policy of its key says
+	// when it's zero.
+	TTL time.Duration
+}
+
+// Put stores the content of r under key and returns the number of bytes
+// stored. A Put can only be retried on another node when nothing was read
+// from r yet or r is an io.Seeker.
+func (c *Client) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	return c.PutWith(ctx, key, r, PutOpts{})
+}
+
+// PutWith is Put with options.
+func (c *Client) PutWith(ctx context.Context, key string, r io.Reader, opts PutOpts) (int64, error) {
+	_, rewindable := r.(io.Seeker)
+
+	body := r
+	var wrappedKey []byte
+	if c.Key != nil {
+		dataKey, wrapped, err := cipher.NewDataKey(c.Key)
+		if err != nil {
+			return 0, err
+		}
+		if body, err = cipher.NewEncryptReader(dataKey, r); err != nil {
+			return 0, err
+		}
+		wrappedKey = wrapped
+	}
+
+	var (
+		size     int64
+		consumed bool
+		lastErr  error
+	)
+
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		if consumed {
+			if !rewindable {
+				return fmt.Errorf("%w: %w", errNoRetry, lastErr)
+			}
+			if _, err := body.(io.Seeker).Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		n, sent, err := put(ctx, conn, rpc.PutRequest{Key: key, WrappedKey: wrappedKey, TTL: opts.TTL}, body)
+		consumed = consumed || sent
+		size, lastErr = n, err
+		return err
+	})
+
+	if wrappedKey != nil {
+		size -= cipher.IVSize
+	}
+	return size, err
+}
+
+// put sends the content of r after the header, the first message.
+func put(ctx context.Context, conn *grpc.ClientConn, header rpc.PutRequest, r io.Reader) (int64, bool, error) {
+	stream, err := conn.NewStream(ctx, rpc.PutStreamDesc, rpc.MethodPut)
+	if err != nil {
+		return 0, false, err
+	}
+	s := &grpc.GenericClientStream[rpc.PutRequest, rpc.PutResponse]{ClientStream: stream}
+
+	buf := make([]byte, rpc.ChunkSize)
+	sent := false
+	for first := true; ; first = false {
+		n, readErr := io.ReadFull(r, buf)
+		sent = sent || n > 0
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			s.CloseSend()
+			return 0, sent, readErr
+		}
+
+		if n > 0 || first {
+			req := &rpc.PutRequest{Data: buf[:n]}
+			if first {
+				header.Data = buf[:n]
+				req = &header
+			}
+
+			// io.EOF means the server gave up, its reason comes with
+			// CloseAndRecv.
+			if err := s.Send(req); err == io.EOF {
+				break
+			} else if err != nil {
+				return 0, sent, err
+			}
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	resp, err := s.CloseAndRecv()
+	if err != nil {
+		return 0, sent, err
+	}
+
+	return resp.Size, sent, nil
+}
+
+// Get returns the size and the content of key. Reading the content moves
+// on to another node where it left off if the node serving it fails.
+func (c *Client) Get(ctx context.Context, key string) (int64, io.ReadCloser, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r := &reader{c: c, ctx: ctx, cancel: cancel, key: key, size: -1}
+	if err := r.open(); err != nil {
+		cancel()
+		return 0, nil, err
+	}
+
+	if r.wrappedKey == nil {
+		return r.size, r, nil
+	}
+
+	dec, err := c.decrypt(r.wrappedKey, r)
+	if err != nil {
+		cancel()
+		return 0, nil, err
+	}
+	return r.size - cipher.IVSize, dec, nil
+}
+
+// decrypt unwraps the data key of a file encrypted end to end and returns
+// the reader of its plaintext.
+func (c *Client) decrypt(wrappedKey []byte, r io.Reader) (io.ReadCloser, error) {
+	if c.Key == nil {
+		return nil, ErrEncrypted
+	}
+
+	dataKey, err := cipher.UnwrapKey(c.Key, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewDecryptReader(dataKey, r)
+}
+
+// plainInfo describes the plaintext of files encrypted end to end, their
+// checksum remains the one of the ciphertext.
+func plainInfo(f FileInfo) FileInfo {
+	if len(f.WrappedKey) > 0 {
+		f.Size -= cipher.IVSize
+	}
+	return f
+}
+
+// Delete deletes the file from the node and every peer of the node.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodDelete, &rpc.DeleteRequest{Key: key}, &rpc.DeleteResponse{})
+	})
+}
+
+func (c *Client) Stat(ctx context.Context, key string) (FileInfo, error) {
+	resp := &rpc.StatResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodStat, &rpc.StatRequest{Key: key}, resp)
+	})
+
+	return plainInfo(resp.File), err
+}
+
+func (c *Client) List(ctx context.Context, prefix string) ([]FileInfo, error) {
+	resp := &rpc.ListResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodList, &rpc.ListRequest{Prefix: prefix}, resp)
+	})
+
+	for i := range resp.Files {
+		resp.Files[i] = plainInfo(resp.Files[i])
+	}
+	return resp.Files, err
+}
+
+// Peers returns the addresses of the peers connected to the current node.
+func (c *Client) Peers(ctx context.Context) ([]string, error) {
+	resp := &rpc.PeersResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodPeers, &rpc.PeersRequest{}, resp)
+	})
+
+	return resp.Peers, err
+}
+
+// Status returns the state of the current node: its peers, its files and
+// its background jobs.
+func (c *Client) Status(ctx context.Context) (NodeStatus, error) {
+	resp := &rpc.StatusResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodStatus, &rpc.StatusRequest{}, resp)
+	})
+
+	return resp.Status, err
+}
+
+// SetPolicy sets the policy of the keys starting with p.Prefix in the
+// cluster.
+func (c *Client) SetPolicy(ctx context.Context, p store.Policy) error {
+	return c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodSetPolicy, &rpc.SetPolicyRequest{Policy: p}, &rpc.SetPolicyResponse{})
+	})
+}
+
+// DeletePolicy removes the policy of prefix from the cluster.
+func (c *Client) DeletePolicy(ctx context.Context, prefix string) error {
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodDeletePolicy, &rpc.DeletePolicyRequest{Prefix: prefix}, &rpc.DeletePolicyResponse{})
+	})
+	if errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("%q: %w", prefix, ErrNoPolicy)
+	}
+	return err
+}
+
+// Policies returns the policies of the cluster, sorted by prefix.
+func (c *Client) Policies(ctx context.Context) ([]store.Policy, error) {
+	resp := &rpc.PoliciesResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodPolicies, &rpc.PoliciesRequest{}, resp)
+	})
+
+	return resp.Policies, err
+}
+
+// StartScrub starts a scrub of the files of the node, unless one is running,
+// and returns its status.
+func (c *Client) StartScrub(ctx context.Context) (ScrubStatus, error) {
+	return c.scrub(ctx, true)
+}
+
+// ScrubStatus returns the status of the running or the last scrub of the
+// node.
+func (c *Client) ScrubStatus(ctx context.Context) (ScrubStatus, error) {
+	return c.scrub(ctx, false)
+}
+
+func (c *Client) scrub(ctx context.Context, start bool) (ScrubStatus, error) {
+	resp := &rpc.ScrubResponse{}
+	err := c.do(ctx, func(conn *grpc.ClientConn) error {
+		return conn.Invoke(ctx, rpc.MethodScrub, &rpc.ScrubRequest{Start: start}, resp)
+	})
+
+	return resp.Status, err
+}
+
+// Watch streams the changes of the keys starting with prefix until ctx is
+// done, at which point the channel is closed. When the watched node fails
+// the subscription moves to the next node, events in between are lost.
+func (c *Client) Watch(ctx context.Context, prefix string) <-chan Event {
+	events := make(chan Event)
+
+	go func() {
+		defer close(events)
+
+		for ctx.Err() == nil {
+			node := c.node()
+			err := watch(ctx, c.conns[node], prefix, events)
+			if ctx.Err() != nil {
+				return
+			}
+			if retryable(err) {
+				c.next(node)
+			}
+
+			select {
+			case <-time.After(watchRetryInterval):
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	return events
+}
+
+func watch(ctx context.Context, conn *grpc.ClientConn, prefix string, events chan<- Event) error {
+	stream, err := conn.NewStream(ctx, rpc.WatchStreamDesc, rpc.MethodWatch)
+	if err != nil {
+		return err
+	}
+
+	s := &grpc.GenericClientStream[rpc.WatchRequest, rpc.WatchEvent]{ClientStream: stream}
+	if err := s.SendMsg(&rpc.WatchRequest{Prefix: prefix}); err != nil {
+		return err
+	}
+	if err := s.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		ev, err := s.Recv()
+		if err != nil {
+			return err
+		}
+
+		select {
+		case events <- *ev:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// errNoRetry stops do from trying the next node.
+var errNoRetry = errors.New("the request can't be retried")
+
+// do runs fn against the current node, moving on to the following nodes
+// as long as fn fails because of the node rather than the request.
+func (c *Client) do(ctx context.Context, fn func(*grpc.ClientConn) error) error {
+	var err error
+	for range c.conns {
+		node := c.node()
+
+		err = fn(c.conns[node])
+		if err == nil || !retryable(err) || ctx.Err() != nil {
+			break
+		}
+		c.next(node)
+	}
+
+	return convertError(err)
+}
+
+func (c *Client) node() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.current
+}
+
+// next moves on from the failed node, unless somebody already did.
+func (c *Client) next(failed int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.current == failed {
+		c.current = (c.current + 1) % len(c.conns)
+	}
+}
+
+func retryable(err error) bool {
+	if errors.Is(err, errNoRetry) {
+		return false
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+func convertError(err error) error {
+	if status.Code(err) == codes.NotFound {
+		// The nodes report "<key>: file not found".
+		msg := strings.TrimSuffix(status.Convert(err).Message(), ": "+ErrNotFound.Error())
+		return fmt.Errorf("%s: %w", msg, ErrNotFound)
+	}
+	return err
+}
+
+// reader streams the content of a file, resuming at the current offset on
+// another node when the stream fails.
+type reader struct {
+	c      *Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	key    string
+
+	stream grpc.ServerStreamingClient[rpc.GetResponse]
+	buf    []byte
+	offset int64
+	size   int64
+	// wrappedKey is the data key of a file encrypted end to end.
+	wrappedKey []byte
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.offset == r.size {
+			return 0, io.EOF
+		}
+
+		resp, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if !retryable(err) {
+				return 0, convertError(err)
+			}
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		r.buf = resp.Data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// open starts streaming the file from the current offset and reads the
+// first message which carries the file size.
+func (r *reader) open() error {
+	return r.c.do(r.ctx, func(conn *grpc.ClientConn) error {
+		stream, err := conn.NewStream(r.ctx, rpc.GetStreamDesc, rpc.MethodGet)
+		if err != nil {
+			return err
+		}
+
+		s := &grpc.GenericClientStream[rpc.GetRequest, rpc.GetResponse]{ClientStream: stream}
+		if err := s.SendMsg(&rpc.GetRequest{Key: r.key, Offset: r.offset}); err != nil {
+			return err
+		}
+		if err := s.CloseSend(); err != nil {
+			return err
+		}
+
+		resp, err := s.Recv()
+		if err != nil {
+			return err
+		}
+
+		if r.size >= 0 && resp.Size != r.size {
+			return fmt.Errorf("%s changed while being read", r.key)
+		}
+
+		r.size = resp.Size
+		r.wrappedKey = resp.WrappedKey
+		r.stream = s
+		r.buf = resp.Data
+		return nil
+	})
+}
@@ -0,0 +1,353 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/rpc"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+func TestClient(t *testing.T) {
+	// The first node is down, every call has to fail over to the second.
+	c, err := New(ClientOpts{Nodes: []string{deadNode(t), startNode(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("Hello World "), 20000)
+	n, err := c.Put(ctx, "docs/hello.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	size, r, err := c.Get(ctx, "docs/hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	r.Close()
+
+	info, err := c.Stat(ctx, "docs/hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	list, err := c.List(ctx, "docs/")
+	assert.Nil(t, err)
+	assert.Len(t, list, 1)
+
+	assert.Nil(t, c.Delete(ctx, "docs/hello.txt"))
+	_, err = c.Stat(ctx, "docs/hello.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, c.Delete(ctx, "docs/hello.txt"), ErrNotFound)
+}
+
+func TestDeleteFromNetwork(t *testing.T) {
+	addr, fs, peer := newCluster(t)
+	c, err := New(ClientOpts{Nodes: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = c.Put(ctx, "hello.txt", bytes.NewReader([]byte("Hello World")))
+	assert.Nil(t, err)
+	copyKey := fs.KeyHash.HashKey("hello.txt")
+	assert.Eventually(t, func() bool { return peer.Has(copyKey) }, 5*time.Second, 10*time.Millisecond)
+
+	// The copy of the peer goes as well, a get doesn't bring the file back.
+	assert.Nil(t, c.Delete(ctx, "hello.txt"))
+	assert.Eventually(t, func() bool { return !peer.Has(copyKey) }, 5*time.Second, 10*time.Millisecond)
+	_, _, err = c.Get(ctx, "hello.txt")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.False(t, fs.Has("hello.txt"))
+}
+
+func TestGetFromAnotherNode(t *testing.T) {
+	closedAddr, closed := newNode(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.Nil(t, closed.Shutdown(ctx))
+	addr, fs := newNode(t)
+	assert.Nil(t, fs.Store("hello.txt", bytes.NewReader([]byte("Hello World"))))
+
+	// A node failing to serve the file is skipped, unlike a node which
+	// doesn't have it.
+	c, err := New(ClientOpts{Nodes: []string{closedAddr, addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, r, err := c.Get(ctx, "hello.txt")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello World", string(got))
+	r.Close()
+
+	only, err := New(ClientOpts{Nodes: []string{closedAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer only.Close()
+	_, _, err = only.Get(ctx, "hello.txt")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestWatch(t *testing.T) {
+	c, err := New(ClientOpts{Nodes: []string{startNode(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	events := c.Watch(ctx, "docs/")
+
+	// Keep storing until the subscription is in place and the event shows up.
+	var ev Event
+	for received := false; !received; {
+		_, err := c.Put(ctx, "docs/a.txt", bytes.NewReader([]byte("Hello World")))
+		assert.Nil(t, err)
+
+		select {
+		case ev = <-events:
+			received = true
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+	}
+
+	assert.Equal(t, EventStore, ev.Type)
+	assert.Equal(t, "docs/a.txt", ev.Key)
+}
+
+func TestEndToEndEncryption(t *testing.T) {
+	addr, fs := newNode(t)
+	key := cipher.NewEncryptionKey()
+	c, err := New(ClientOpts{Nodes: []string{addr}, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("Hello World "), 20000)
+	n, err := c.Put(ctx, "secret.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	// The node only has the ciphertext and the wrapped data key.
+	_, stored, err := fs.Get("secret.txt")
+	assert.Nil(t, err)
+	ciphertext, err := io.ReadAll(stored)
+	assert.Nil(t, err)
+	stored.(io.Closer).Close()
+	assert.Len(t, ciphertext, len(data)+cipher.IVSize)
+	assert.False(t, bytes.Contains(ciphertext, []byte("Hello World")))
+
+	meta, err := fs.Stat("secret.txt")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, meta.WrappedKey)
+	assert.NotContains(t, string(meta.WrappedKey), string(key))
+
+	info, err := c.Stat(ctx, "secret.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	size, r, err := c.Get(ctx, "secret.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	r.Close()
+
+	noKey, err := New(ClientOpts{Nodes: []string{addr}})
+	assert.Nil(t, err)
+	defer noKey.Close()
+	_, _, err = noKey.Get(ctx, "secret.txt")
+	assert.ErrorIs(t, err, ErrEncrypted)
+
+	otherKey, err := New(ClientOpts{Nodes: []string{addr}, Key: cipher.NewEncryptionKey()})
+	assert.Nil(t, err)
+	defer otherKey.Close()
+	_, _, err = otherKey.Get(ctx, "secret.txt")
+	assert.ErrorIs(t, err, cipher.ErrUnwrap)
+}
+
+func TestSecuredNode(t *testing.T) {
+	serverTLS, clientTLS := newTLS(t)
+	addr, _ := newNode(t, append(rpc.TokenAuth([]string{"s3cr3t"}), grpc.Creds(credentials.NewTLS(serverTLS)))...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := New(ClientOpts{Nodes: []string{addr}, TLS: clientTLS, Token: "s3cr3t"})
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Put(ctx, "hello.txt", bytes.NewReader([]byte("Hello World")))
+	assert.Nil(t, err)
+	info, err := c.Stat(ctx, "hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size)
+
+	for _, token := range []string{"", "guess"} {
+		c, err := New(ClientOpts{Nodes: []string{addr}, TLS: clientTLS, Token: token})
+		assert.Nil(t, err)
+		defer c.Close()
+		_, err = c.Stat(ctx, "hello.txt")
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), token)
+		_, _, err = c.Get(ctx, "hello.txt")
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), token)
+	}
+}
+
+// newTLS returns the TLS configurations of a node with a self-signed
+// certificate for 127.0.0.1 and of the clients trusting it.
+func newTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dfs"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return serverTLS, &tls.Config{RootCAs: roots}
+}
+
+func startNode(t *testing.T) string {
+	addr, _ := newNode(t)
+	return addr
+}
+
+func newNode(t *testing.T, opts ...grpc.ServerOption) (string, *server.FileServer) {
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            cipher.NewEncryptionKey(),
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := rpc.NewGRPCServer(fs, opts...)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return lis.Addr().String(), fs
+}
+
+// newCluster starts a node serving the file service and a peer it's
+// connected to, which keeps a copy of the files stored on the node.
+func newCluster(t *testing.T) (string, *server.FileServer, *server.FileServer) {
+	key := cipher.NewEncryptionKey()
+	peerAddr := deadNode(t)
+	peer := newFileServer(t, peerAddr, key)
+	go peer.Start()
+
+	// The peer has to listen before the node dials it.
+	time.Sleep(50 * time.Millisecond)
+	fs := newFileServer(t, deadNode(t), key)
+	fs.BootstrapNodes = []string{peerAddr}
+	go fs.Start()
+	assert.Eventually(t, func() bool { return len(fs.Peers()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := rpc.NewGRPCServer(fs)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	return lis.Addr().String(), fs, peer
+}
+
+func newFileServer(t *testing.T, addr string, encKey []byte) *server.FileServer {
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: addr,
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            encKey,
+	})
+	tr.OnPeer = fs.OnPeer
+	tr.OnPeerClose = fs.OnPeerClose
+	t.Cleanup(fs.Stop)
+
+	return fs
+}
+
+func deadNode(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.Close()
+	return lis.Addr().String()
+}
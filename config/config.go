@@ -0,0 +1,520 @@
+// Package config holds the configuration of a node, read from a YAML file
+// and overridden by environment variables, then by the command line flags.
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+// EnvPrefix prefixes the environment variables of the settings, e.g.
+// DFS_LOG_LEVEL sets log.level.
+const EnvPrefix = "DFS_"
+
+// Names of the backends the files can be kept in.
+const (
+	BackendDisk   = "disk"
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+)
+
+// Formats of the logs of the node.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// DefaultShutdownTimeout is how long the transfers in flight are given to
+// finish by default once the node is asked to stop.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Config is the configuration of a node. The settings are named after
+// their YAML keys, sections and keys joined by a dot, e.g. log.level.
+type Config struct {
+	// Listen is the address the node listens for its peers on, e.g.
+	// ":3000".
+	Listen string `yaml:"listen"`
+	// Advertise is the address the peers reach the node at, when it
+	// isn't Listen, e.g. behind a NAT.
+	Advertise string `yaml:"advertise"`
+	// StorageRoot is where the files are kept. Defaults to
+	// <listen>_files.
+	StorageRoot string   `yaml:"storage_root"`
+	Peers       []string `yaml:"peers"`
+	// AdminSocket is the unix socket the subcommands reach the node on.
+	// Defaults to $TMPDIR/dfs-<port>.sock.
+	AdminSocket string `yaml:"admin_socket"`
+
+	Keys        Keys        `yaml:"keys"`
+	Storage     Storage     `yaml:"storage"`
+	Replication Replication `yaml:"replication"`
+	Limits      Limits      `yaml:"limits"`
+	Log         Log         `yaml:"log"`
+	S3          S3          `yaml:"s3"`
+	GRPC        GRPC        `yaml:"grpc"`
+	Metrics     Listener    `yaml:"metrics"`
+	Tracing     Tracing     `yaml:"tracing"`
+}
+
+// Keys are the files of the keys of the node and how the keys of the files
+// are hashed.
+type Keys struct {
+	// File holds the key encrypting the files at rest, it's created when
+	// missing. Defaults to <storage_root>.key.
+	File string `yaml:"file"`
+	// TransportFile holds the key encrypting the streams sent to the
+	// peers, the same on every node since the peers decrypt them. A key
+	// of its own is drawn at every start when it's empty, which only fits
+	// a node on its own, so it's required along with Peers.
+	TransportFile string `yaml:"transport_file"`
+	// Hash hashes the keys of the files, the same on every node.
+	Hash string `yaml:"hash"`
+	// HashKeyFile holds the secret of the hmac-sha256 hash.
+	HashKeyFile string `yaml:"hash_key_file"`
+}
+
+// Storage is how the files are kept.
+type Storage struct {
+	Backend     string `yaml:"backend"`
+	Compression string `yaml:"compression"`
+	// ScrubInterval is how often the files are checked against their
+	// checksum, and ReapInterval how often the expired ones are deleted.
+	ScrubInterval time.Duration `yaml:"scrub_interval"`
+	ReapInterval  time.Duration `yaml:"reap_interval"`
+}
+
+// Replication is how the files are spread over the peers.
+type Replication struct {
+	// Erasure erasure codes the files into <data>+<parity> shards instead
+	// of copying them to every peer, e.g. "4+2".
+	Erasure string `yaml:"erasure"`
+	// RepairInterval is how often the missing shards are rebuilt.
+	RepairInterval time.Duration `yaml:"repair_interval"`
+}
+
+// Limits bound what the node spends.
+type Limits struct {
+	// TransferMemory is the memory a transfer to the peers may use.
+	TransferMemory ByteSize `yaml:"transfer_memory"`
+	// ShutdownTimeout is how long the transfers in flight are given to
+	// finish once the node is asked to stop.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HeartbeatInterval is how often the peers are pinged.
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+	Bandwidth         Bandwidth     `yaml:"bandwidth"`
+}
+
+// Bandwidth is what the transfers with the peers may use per second, for
+// the calls of the clients and for the background jobs, the repairs and
+// the scrubs.
+type Bandwidth struct {
+	Foreground BandwidthBudget `yaml:"foreground"`
+	Background BandwidthBudget `yaml:"background"`
+}
+
+// BandwidthBudget bounds the bytes per second sent to and received from all
+// the peers together, and each of them. Zero doesn't bound them.
+type BandwidthBudget struct {
+	Outbound     ByteSize `yaml:"outbound"`
+	Inbound      ByteSize `yaml:"inbound"`
+	PeerOutbound ByteSize `yaml:"peer_outbound"`
+	PeerInbound  ByteSize `yaml:"peer_inbound"`
+}
+
+// Limits returns the bandwidth limits of the file server.
+func (b Bandwidth) Limits() server.BandwidthLimits {
+	return server.BandwidthLimits{
+		Foreground: b.Foreground.bandwidth(),
+		Background: b.Background.bandwidth(),
+	}
+}
+
+func (b BandwidthBudget) bandwidth() server.Bandwidth {
+	return server.Bandwidth{
+		Outbound:     int64(b.Outbound),
+		Inbound:      int64(b.Inbound),
+		PeerOutbound: int64(b.PeerOutbound),
+		PeerInbound:  int64(b.PeerInbound),
+	}
+}
+
+// Log is what's logged and how.
+type Log struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+}
+
+// S3 is the S3 compatible gateway, disabled when Address is empty.
+type S3 struct {
+	Address string `yaml:"address"`
+	// Credentials is a file of the '<access key id> <secret key>' pairs
+	// the gateway accepts.
+	Credentials string `yaml:"credentials"`
+}
+
+// GRPC is the gRPC file service, disabled when Address is empty. It's only
+// served on loopback, unless the calls are encrypted and authenticated.
+type GRPC struct {
+	// Address is where the service listens, on loopback when it has no
+	// host and the service is neither encrypted nor authenticated.
+	Address string `yaml:"address"`
+	// CertFile and KeyFile are the PEM certificate and key the service
+	// serves TLS with.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Tokens is a file of the tokens the clients may call with, one per
+	// line.
+	Tokens string `yaml:"tokens"`
+}
+
+// Secured tells whether the calls are encrypted and authenticated.
+func (g GRPC) Secured() bool {
+	return len(g.CertFile) > 0 && len(g.Tokens) > 0
+}
+
+// Listener is a service listening on Address, disabled when it's empty.
+type Listener struct {
+	Address string `yaml:"address"`
+}
+
+// Tracing is where the traces are exported, they aren't when OTLPEndpoint
+// is empty.
+type Tracing struct {
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+// Default returns the configuration of a node before any is given.
+func Default() Config {
+	return Config{
+		Peers: []string{},
+		Keys: Keys{
+			Hash: cipher.HashSHA256,
+		},
+		Storage: Storage{
+			Backend:       BackendDisk,
+			ScrubInterval: server.DefaultScrubInterval,
+			ReapInterval:  server.DefaultReapInterval,
+		},
+		Replication: Replication{
+			RepairInterval: server.DefaultRepairInterval,
+		},
+		Limits: Limits{
+			TransferMemory:    server.DefaultTransferMemory,
+			ShutdownTimeout:   DefaultShutdownTimeout,
+			HeartbeatInterval: server.DefaultHeartbeatInterval,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: LogFormatText,
+		},
+	}
+}
+
+// Load returns the default configuration overridden by the file at path,
+// when it's set, then by the environment variables lookupEnv finds, then by
+// flags, which map settings to their values.
+func Load(path string, lookupEnv func(string) (string, bool), flags map[string]string) (Config, error) {
+	c := Default()
+	if len(path) > 0 {
+		if err := c.readFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+
+	for _, key := range Settings() {
+		value, ok := lookupEnv(EnvName(key))
+		if !ok {
+			continue
+		}
+		if err := c.Set(key, value); err != nil {
+			return Config{}, fmt.Errorf("%s: %w", EnvName(key), err)
+		}
+	}
+
+	for key, value := range flags {
+		if err := c.Set(key, value); err != nil {
+			return Config{}, err
+		}
+	}
+
+	return c, nil
+}
+
+// readFile overrides c with the settings of the YAML file at path, whose
+// unknown keys are errors.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// Settings returns the names of the settings.
+func Settings() []string {
+	var keys []string
+	walk(reflect.ValueOf(&Config{}).Elem(), "", func(key string, _ reflect.Value) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// EnvName returns the environment variable of a setting.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// Set sets a setting from its text form: lists are comma separated, sizes
+// may have a unit such as MiB and durations are like 1m30s.
+func (c *Config) Set(key, value string) error {
+	var field reflect.Value
+	walk(reflect.ValueOf(c).Elem(), "", func(k string, f reflect.Value) {
+		if k == key {
+			field = f
+		}
+	})
+	if !field.IsValid() {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+
+	if err := setField(field, value); err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
+
+// walk calls visit with the name and the value of every setting of v.
+func walk(v reflect.Value, prefix string, visit func(string, reflect.Value)) {
+	for i := range v.NumField() {
+		name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			walk(field, prefix+name+".", visit)
+			continue
+		}
+		visit(prefix+name, field)
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Validate returns every problem of the configuration, nil when there's
+// none.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	if len(c.Listen) == 0 {
+		check("listen", errors.New("missing, e.g. \":3000\""))
+	} else {
+		_, err := Port(c.Listen)
+		check("listen", err)
+	}
+	if len(c.Advertise) > 0 {
+		_, err := Port(c.Advertise)
+		check("advertise", err)
+	}
+	for _, peer := range c.Peers {
+		_, err := Port(peer)
+		check("peers", err)
+	}
+	if len(c.Peers) > 0 && len(c.Keys.TransportFile) == 0 {
+		check("keys.transport_file", errors.New("missing, the peers can't decrypt the streams of a node drawing a key of its own at every start"))
+	}
+
+	if c.Keys.Hash == cipher.HashHMAC && len(c.Keys.HashKeyFile) == 0 {
+		check("keys.hash_key_file", fmt.Errorf("missing, %s requires it", cipher.HashHMAC))
+	}
+	if c.Keys.Hash != cipher.HashHMAC {
+		// The secret is checked when it's read.
+		_, err := cipher.KeyHashByName(c.Keys.Hash, nil)
+		check("keys.hash", err)
+	}
+
+	switch c.Storage.Backend {
+	case BackendDisk, BackendBolt, BackendMemory:
+	default:
+		check("storage.backend", fmt.Errorf("unknown backend %q, expected disk, bolt or memory", c.Storage.Backend))
+	}
+	check("storage.compression", store.Policy{Compression: c.Storage.Compression}.Validate())
+	check("storage.scrub_interval", positive(c.Storage.ScrubInterval))
+	check("storage.reap_interval", positive(c.Storage.ReapInterval))
+
+	if len(c.Replication.Erasure) > 0 {
+		_, err := ParseErasure(c.Replication.Erasure)
+		check("replication.erasure", err)
+	}
+	check("replication.repair_interval", positive(c.Replication.RepairInterval))
+
+	if c.Limits.TransferMemory <= 0 {
+		check("limits.transfer_memory", errors.New("must be positive"))
+	}
+	check("limits.shutdown_timeout", positive(c.Limits.ShutdownTimeout))
+	check("limits.heartbeat_interval", positive(c.Limits.HeartbeatInterval))
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		check("log.level", fmt.Errorf("invalid level %q, expected debug, info, warn or error", c.Log.Level))
+	}
+	switch c.Log.Format {
+	case LogFormatText, LogFormatJSON:
+	default:
+		check("log.format", fmt.Errorf("unknown format %q, expected text or json", c.Log.Format))
+	}
+
+	if len(c.S3.Address) > 0 && len(c.S3.Credentials) == 0 {
+		check("s3.credentials", errors.New("missing, the S3 gateway requires it"))
+	}
+
+	if (len(c.GRPC.CertFile) > 0) != (len(c.GRPC.KeyFile) > 0) {
+		check("grpc.key_file", errors.New("grpc.cert_file and grpc.key_file go together"))
+	}
+	if len(c.GRPC.Address) > 0 && !c.GRPC.Secured() {
+		if host, _, err := net.SplitHostPort(c.GRPC.Address); err != nil {
+			check("grpc.address", err)
+		} else if len(host) > 0 && !loopback(host) {
+			check("grpc.address", fmt.Errorf("%s isn't loopback, which requires grpc.cert_file and grpc.tokens", host))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// loopback tells whether host only reaches the local host.
+func loopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func positive(d time.Duration) error {
+	if d <= 0 {
+		return errors.New("must be positive")
+	}
+	return nil
+}
+
+// Port returns the port of a host:port address.
+func Port(addr string) (int, error) {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("invalid port in %q", addr)
+	}
+	return port, nil
+}
+
+// ParseErasure parses erasure coding options given as <data>+<parity>.
+func ParseErasure(s string) (server.ErasureOpts, error) {
+	var opts server.ErasureOpts
+	data, parity, ok := strings.Cut(s, "+")
+	if !ok {
+		return opts, fmt.Errorf("invalid erasure coding %q, expected <data>+<parity>", s)
+	}
+
+	var err error
+	if opts.DataShards, err = strconv.Atoi(data); err != nil || opts.DataShards <= 0 {
+		return opts, fmt.Errorf("invalid number of data shards %q", data)
+	}
+	if opts.ParityShards, err = strconv.Atoi(parity); err != nil || opts.ParityShards < 0 {
+		return opts, fmt.Errorf("invalid number of parity shards %q", parity)
+	}
+	if opts.DataShards+opts.ParityShards > 256 {
+		return opts, fmt.Errorf("at most 256 shards are supported")
+	}
+
+	return opts, nil
+}
+
+// Marshal returns the configuration as YAML.
+func (c Config) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	err := enc.Close()
+	return buf.Bytes(), err
+}
+
+// Changed returns the settings whose values differ between a and b.
+func Changed(a, b Config) []string {
+	values := map[string]reflect.Value{}
+	walk(reflect.ValueOf(&a).Elem(), "", func(key string, f reflect.Value) {
+		values[key] = f
+	})
+
+	var changed []string
+	walk(reflect.ValueOf(&b).Elem(), "", func(key string, f reflect.Value) {
+		old := values[key]
+		// No list and an empty one are the same.
+		if f.Kind() == reflect.Slice && f.Len() == 0 && old.Len() == 0 {
+			return
+		}
+		if !reflect.DeepEqual(old.Interface(), f.Interface()) {
+			changed = append(changed, key)
+		}
+	})
+	return changed
+}
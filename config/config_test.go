@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `
+listen: ":3000"
+peers: [":4000", ":5000"]
+keys:
+  transport_file: transport.key
+storage:
+  backend: bolt
+limits:
+  transfer_memory: 4MiB
+  bandwidth:
+    foreground:
+      outbound: 10MiB
+log:
+  level: debug
+  format: json
+`)
+	env := map[string]string{
+		"DFS_LOG_LEVEL":               "warn",
+		"DFS_LIMITS_SHUTDOWN_TIMEOUT": "5s",
+		"DFS_PEERS":                   ":6000, :7000",
+
+		"DFS_LIMITS_BANDWIDTH_BACKGROUND_PEER_INBOUND": "1MB",
+	}
+	lookupEnv := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	c, err := Load(path, lookupEnv, map[string]string{"log.level": "error"})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Validate())
+
+	// The file over the defaults.
+	assert.Equal(t, ":3000", c.Listen)
+	assert.Equal(t, BackendBolt, c.Storage.Backend)
+	assert.Equal(t, ByteSize(4<<20), c.Limits.TransferMemory)
+	assert.Equal(t, LogFormatJSON, c.Log.Format)
+	assert.Equal(t, Default().Storage.ScrubInterval, c.Storage.ScrubInterval)
+	assert.Equal(t, ByteSize(10<<20), c.Limits.Bandwidth.Foreground.Outbound)
+	// The environment over the file.
+	assert.Equal(t, []string{":6000", ":7000"}, c.Peers)
+	assert.Equal(t, 5*time.Second, c.Limits.ShutdownTimeout)
+	assert.Equal(t, int64(1e6), c.Limits.Bandwidth.Limits().Background.PeerInbound)
+	// The flags over the environment.
+	assert.Equal(t, "error", c.Log.Level)
+}
+
+func TestLoadErrors(t *testing.T) {
+	noEnv := func(string) (string, bool) { return "", false }
+
+	_, err := Load(writeFile(t, "listen: \":3000\"\nlisten_address: \":4000\"\n"), noEnv, nil)
+	assert.ErrorContains(t, err, "field listen_address not found")
+
+	_, err = Load("", func(key string) (string, bool) { return "soon", key == "DFS_LIMITS_SHUTDOWN_TIMEOUT" }, nil)
+	assert.ErrorContains(t, err, "DFS_LIMITS_SHUTDOWN_TIMEOUT")
+
+	_, err = Load("", noEnv, map[string]string{"no.such": "setting"})
+	assert.ErrorContains(t, err, "unknown setting")
+}
+
+func TestValidate(t *testing.T) {
+	c := Default()
+	c.Listen = ":3000"
+	assert.Nil(t, c.Validate())
+
+	c.Listen = "3000"
+	c.Peers = []string{":4000", ":99999"}
+	c.Storage.Backend = "tape"
+	c.Replication.Erasure = "4"
+	c.Log.Level = "loud"
+	c.S3.Address = ":9000"
+	c.GRPC.Address = "0.0.0.0:7000"
+	err := c.Validate()
+	assert.NotNil(t, err)
+
+	// Every problem is reported, not only the first.
+	lines := strings.Split(err.Error(), "\n")
+	assert.Len(t, lines, 8)
+	for i, key := range []string{"listen", "peers", "keys.transport_file", "storage.backend", "replication.erasure", "log.level", "s3.credentials", "grpc.address"} {
+		assert.True(t, strings.HasPrefix(lines[i], key+": "), lines[i])
+	}
+}
+
+func TestValidateGRPC(t *testing.T) {
+	c := Default()
+	c.Listen = ":3000"
+	for _, addr := range []string{":7000", "localhost:7000", "127.0.0.1:7000", "[::1]:7000"} {
+		c.GRPC.Address = addr
+		assert.Nil(t, c.Validate(), addr)
+	}
+
+	// Beyond loopback the calls have to be encrypted and authenticated.
+	c.GRPC.Address = "10.0.0.1:7000"
+	assert.NotNil(t, c.Validate())
+	c.GRPC.Tokens = "tokens"
+	assert.NotNil(t, c.Validate())
+	c.GRPC.CertFile = "node.crt"
+	assert.NotNil(t, c.Validate())
+	c.GRPC.KeyFile = "node.key"
+	assert.Nil(t, c.Validate())
+}
+
+func TestByteSize(t *testing.T) {
+	for text, size := range map[string]ByteSize{
+		"512":     512,
+		"64KiB":   64 << 10,
+		"1.5 MiB": 3 << 19,
+		"10MB":    10e6,
+		"2GiB":    2 << 30,
+	} {
+		var b ByteSize
+		assert.Nil(t, b.UnmarshalText([]byte(text)), text)
+		assert.Equal(t, size, b, text)
+	}
+
+	var b ByteSize
+	assert.NotNil(t, b.UnmarshalText([]byte("ten")))
+	assert.NotNil(t, b.UnmarshalText([]byte("-1KiB")))
+
+	text, err := ByteSize(3 << 19).MarshalText()
+	assert.Nil(t, err)
+	assert.Equal(t, "1536KiB", string(text))
+	text, err = ByteSize(1000).MarshalText()
+	assert.Nil(t, err)
+	assert.Equal(t, "1000", string(text))
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "dfs.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes, written with an optional unit: B, KB, MB,
+// GB and TB are powers of 1000, KiB, MiB, GiB and TiB powers of 1024.
+type ByteSize int64
+
+var units = []struct {
+	suffix string
+	size   int64
+}{
+	// The longest suffixes first, so MiB isn't read as an unknown "Mi"
+	// followed by B.
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	size := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, size = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q, expected e.g. 512KiB or 10MB", text)
+	}
+	*b = ByteSize(n * float64(size))
+	return nil
+}
+
+// MarshalText writes the size in the largest binary unit dividing it.
+func (b ByteSize) MarshalText() ([]byte, error) {
+	for i := 3; i >= 0; i-- {
+		unit := units[i]
+		if b != 0 && int64(b)%unit.size == 0 {
+			return []byte(fmt.Sprintf("%d%s", int64(b)/unit.size, unit.suffix)), nil
+		}
+	}
+	return []byte(strconv.FormatInt(int64(b), 10)), nil
+}
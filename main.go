@@ -1,54 +1,240 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"natneam.github.io/dfs-core/cipher"
 	"natneam.github.io/dfs-core/cli"
+	"natneam.github.io/dfs-core/config"
+	"natneam.github.io/dfs-core/metrics"
 	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/rpc"
+	"natneam.github.io/dfs-core/s3"
 	"natneam.github.io/dfs-core/server"
 	"natneam.github.io/dfs-core/store"
+	"natneam.github.io/dfs-core/tracing"
 )
 
-func makeFileServer(addr string, nodes ...string) *server.FileServer {
+func makeFileServer(opts cli.Options, storageKey, transportKey []byte, backend store.Backend, logger *slog.Logger, m *metrics.Metrics, tp trace.TracerProvider) *server.FileServer {
 	tcpTransporterOpts := network.TCPTransporterOpts{
-		ListenAddress: addr,
-		HandshakeFunc: network.NOPHandshakeFunc,
-		Decoder:       network.DefaultDecoder{},
+		ListenAddress:    opts.Listen,
+		AdvertiseAddress: opts.Advertise,
+		HandshakeFunc:    network.NOPHandshakeFunc,
+		Decoder:          network.DefaultDecoder{},
+		Logger:           logger,
+		Metrics:          m,
 	}
 
 	tcpTransporter := network.NewTCPTransporter(tcpTransporterOpts)
 
 	fileServerOpts := server.FileServerOpts{
-		StorageRoot:       addr + "_files",
-		PathTransformFunc: store.HashPathTransformFunc,
+		StorageRoot:       opts.StorageRoot,
+		KeyHash:           opts.KeyHash,
 		Transporter:       tcpTransporter,
-		BootstrapNodes:    nodes,
-		EncKey:            cipher.NewEncryptionKey(),
+		BootstrapNodes:    opts.Peers,
+		EncKey:            transportKey,
+		StorageKey:        storageKey,
+		TransferMemory:    int64(opts.Limits.TransferMemory),
+		Backend:           backend,
+		Erasure:           opts.Erasure,
+		RepairInterval:    opts.Replication.RepairInterval,
+		PolicyFile:        opts.StorageRoot + ".policies.json",
+		ReapInterval:      opts.Storage.ReapInterval,
+		Compression:       opts.Storage.Compression,
+		ScrubInterval:     opts.Storage.ScrubInterval,
+		Logger:            logger,
+		Metrics:           m,
+		TracerProvider:    tp,
+		HeartbeatInterval: opts.Limits.HeartbeatInterval,
+		Bandwidth:         opts.Limits.Bandwidth.Limits(),
 	}
 
 	s := server.NewFileServer(fileServerOpts)
 	tcpTransporter.OnPeer = s.OnPeer
+	tcpTransporter.OnPeerClose = s.OnPeerClose
 	return s
 
 }
 
 func main() {
-	port, nodes, err := cli.Start()
+	opts, err := cli.Start()
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fs := makeFileServer(fmt.Sprintf(":%d", port), nodes...)
+	// The packages still logging with the log package go through it too.
+	logger := cli.NewLogger(os.Stderr, opts)
+	slog.SetDefault(logger)
 
+	storageKey, err := cipher.LoadKey(opts.Keys.File)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Only a node without peers may draw a key of its own, the peers of the
+	// others have to share theirs.
+	transportKey := cipher.NewEncryptionKey()
+	if len(opts.Keys.TransportFile) > 0 {
+		if transportKey, err = cipher.LoadKey(opts.Keys.TransportFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var backend store.Backend
+	switch opts.Storage.Backend {
+	case config.BackendBolt:
+		bolt, err := store.OpenBoltStore(store.BoltStoreOpts{Path: opts.StorageRoot + ".db", EncKey: storageKey})
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer bolt.Close()
+		backend = bolt
+	case config.BackendMemory:
+		backend = store.NewMemoryStore(store.MemoryStoreOpts{EncKey: storageKey})
+	}
+
+	var tp trace.TracerProvider
+	if len(opts.Tracing.OTLPEndpoint) > 0 {
+		node := opts.Listen
+		if len(opts.Advertise) > 0 {
+			node = opts.Advertise
+		}
+		provider, err := tracing.NewProvider(context.Background(), opts.Tracing.OTLPEndpoint, node)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer provider.Shutdown(context.Background())
+		tp = provider
+	}
+
+	m := metrics.New()
+	fs := makeFileServer(opts, storageKey, transportKey, backend, logger, m, tp)
+
+	go func() {
+		if err := fs.Start(); err != nil && !errors.Is(err, server.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// The gRPC servers stop taking calls along with the node.
+	var grpcServers []*grpc.Server
+
+	if len(opts.S3.Address) > 0 {
+		gateway := s3.NewGateway(fs, s3.GatewayOpts{Credentials: opts.S3Credentials})
+		go func() {
+			logger.Info("S3 gateway listening", "address", opts.S3.Address)
+			log.Fatal(http.ListenAndServe(opts.S3.Address, gateway))
+		}()
+	}
+
+	if len(opts.Metrics.Address) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m.Handler())
+		go func() {
+			logger.Info("Metrics endpoint listening", "address", opts.Metrics.Address)
+			log.Fatal(http.ListenAndServe(opts.Metrics.Address, mux))
+		}()
+	}
+
+	if len(opts.GRPC.Address) > 0 {
+		lis, err := net.Listen("tcp", opts.GRPC.Address)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var grpcOpts []grpc.ServerOption
+		if opts.GRPCTLS != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(opts.GRPCTLS)))
+		}
+		if len(opts.GRPCTokens) > 0 {
+			grpcOpts = append(grpcOpts, rpc.TokenAuth(opts.GRPCTokens)...)
+		}
+		s := rpc.NewGRPCServer(fs, grpcOpts...)
+		grpcServers = append(grpcServers, s)
+		go func() {
+			logger.Info("gRPC file service listening", "address", opts.GRPC.Address)
+			if err := s.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	admin, err := cli.ListenAdmin(opts.AdminSocket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer admin.Close()
+	adminServer := rpc.NewGRPCServer(fs)
+	grpcServers = append(grpcServers, adminServer)
+	go func() {
+		adminServer.Serve(admin)
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// The changes of the configuration are applied live when they can be.
+	reloader := cli.NewReloader(opts, fs, logger)
+	go reloader.Watch(ctx, cli.DefaultReloadInterval)
+
+	if !opts.Interactive {
+		logger.Info("Admin socket listening", "address", opts.AdminSocket)
+		<-ctx.Done()
+	} else {
+		time.Sleep(time.Second) // Wait for the server to start.
+
+		exited := make(chan struct{})
+		go func() {
+			cli.InteractiveCli(fs)
+			close(exited)
+		}()
+		select {
+		case <-ctx.Done():
+		case <-exited:
+		}
+	}
+	// A second signal kills the node without waiting.
+	stop()
+
+	shutdown(fs, grpcServers, reloader.Options().Limits.ShutdownTimeout, logger)
+}
+
+// shutdown stops the node gracefully, giving the transfers and the calls in
+// flight timeout to finish.
+func shutdown(fs *server.FileServer, grpcServers []*grpc.Server, timeout time.Duration, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	stopped := make(chan struct{})
 	go func() {
-		fs.Start()
+		for _, s := range grpcServers {
+			s.GracefulStop()
+		}
+		close(stopped)
 	}()
 
-	time.Sleep(time.Second) // Wait for the server to start.
+	if err := fs.Shutdown(ctx); err != nil {
+		logger.Warn("The node didn't stop gracefully", "err", err)
+	}
 
-	cli.InteractiveCli(fs)
+	// The calls still running are cut short.
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		for _, s := range grpcServers {
+			s.Stop()
+		}
+	}
+	logger.Info("Node stopped")
 }
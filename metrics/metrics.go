@@ -0,0 +1,126 @@
+// Package metrics holds the Prometheus metrics of a node.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Sources of the files Get returns.
+const (
+	SourceLocal   = "local"
+	SourceNetwork = "network"
+	SourceErasure = "erasure"
+	SourceMiss    = "miss"
+)
+
+// Metrics are the counters and histograms of a node, the FileServer and
+// the TCPTransporter of the node share them.
+type Metrics struct {
+	// Registry is where the metrics are registered, along with the ones
+	// of the Go runtime and the process.
+	Registry *prometheus.Registry
+
+	// BytesStored are the bytes written to the local store, by where they
+	// came from: a client or a peer.
+	BytesStored *prometheus.CounterVec
+	// BytesServed are the bytes of the files read, by who they're for: a
+	// client or a peer.
+	BytesServed *prometheus.CounterVec
+	// Gets counts the reads by where the file was found, locally, on the
+	// network, rebuilt from its shards or nowhere.
+	Gets *prometheus.CounterVec
+	// GetDuration and StoreDuration are the latencies of the reads and
+	// the writes of the clients, replication included.
+	GetDuration   *prometheus.HistogramVec
+	StoreDuration prometheus.Histogram
+	// ReplicationLag is the time between the local write of a file and
+	// the end of the transfer of each of its copies.
+	ReplicationLag prometheus.Histogram
+
+	// PeersConnected is the number of open peer connections.
+	PeersConnected prometheus.Gauge
+	// PeerBytesIn and PeerBytesOut are the bytes read from and written to
+	// each peer connection.
+	PeerBytesIn  *prometheus.CounterVec
+	PeerBytesOut *prometheus.CounterVec
+	// DecodeErrors counts the messages which couldn't be decoded, by the
+	// layer which failed: the transport or the message.
+	DecodeErrors *prometheus.CounterVec
+}
+
+// New returns the metrics of a node, registered on a new registry.
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		BytesStored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_bytes_stored_total",
+			Help: "Bytes written to the local store, by origin (client or peer).",
+		}, []string{"from"}),
+		BytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_bytes_served_total",
+			Help: "Bytes of the files read, by reader (client or peer).",
+		}, []string{"to"}),
+		Gets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_get_total",
+			Help: "Reads of the clients, by where the file was found (local, network, erasure or miss).",
+		}, []string{"source"}),
+		GetDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dfs_get_duration_seconds",
+			Help:    "Latency of the reads of the clients, by where the file was found.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"source"}),
+		StoreDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dfs_store_duration_seconds",
+			Help:    "Latency of the writes of the clients, replication included.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		ReplicationLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dfs_replication_lag_seconds",
+			Help:    "Time between the local write of a file and the end of the transfer of a copy.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		PeersConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dfs_peers_connected",
+			Help: "Open peer connections.",
+		}),
+		PeerBytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_peer_bytes_in_total",
+			Help: "Bytes read from each peer connection.",
+		}, []string{"peer"}),
+		PeerBytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_peer_bytes_out_total",
+			Help: "Bytes written to each peer connection.",
+		}, []string{"peer"}),
+		DecodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dfs_decode_errors_total",
+			Help: "Messages which couldn't be decoded, by layer (transport or message).",
+		}, []string{"layer"}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.BytesStored,
+		m.BytesServed,
+		m.Gets,
+		m.GetDuration,
+		m.StoreDuration,
+		m.ReplicationLag,
+		m.PeersConnected,
+		m.PeerBytesIn,
+		m.PeerBytesOut,
+		m.DecodeErrors,
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format, as on a
+// /metrics endpoint.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	m := New()
+	m.BytesStored.WithLabelValues("client").Add(11)
+	m.Gets.WithLabelValues(SourceNetwork).Inc()
+	m.PeersConnected.Set(2)
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	assert.Equal(t, 200, rec.Code)
+	assert.Contains(t, string(body), `dfs_bytes_stored_total{from="client"} 11`)
+	assert.Contains(t, string(body), `dfs_get_total{source="network"} 1`)
+	assert.Contains(t, string(body), "dfs_peers_connected 2")
+	assert.Contains(t, string(body), "go_goroutines")
+}
@@ -0,0 +1,279 @@
+//go:build linux || darwin
+
+// Package mount serves a vfs.FS over FUSE so the distributed store can be
+// browsed like a local directory.
+package mount
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"natneam.github.io/dfs-core/vfs"
+)
+
+// attrTimeout is how long the kernel may cache attributes and lookups.
+// Files change behind the kernel's back when peers replicate, keep it short.
+const attrTimeout = time.Second
+
+// Mountpoint is a mounted file system.
+type Mountpoint struct {
+	server *fuse.Server
+}
+
+// Mount exposes fsys at dir until the mountpoint is unmounted.
+func Mount(dir string, fsys *vfs.FS) (*Mountpoint, error) {
+	timeout := attrTimeout
+	root := &node{fsys: fsys}
+
+	server, err := fs.Mount(dir, root, &fs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName: "dfs",
+			Name:   "dfs",
+			// Mount directly when running as root, e.g. in containers
+			// without fusermount, falling back to fusermount otherwise.
+			DirectMount: true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mountpoint{server: server}, nil
+}
+
+func (m *Mountpoint) Unmount() error {
+	return m.server.Unmount()
+}
+
+// Wait blocks until the file system is unmounted.
+func (m *Mountpoint) Wait() {
+	m.server.Wait()
+}
+
+type node struct {
+	fs.Inode
+
+	fsys *vfs.FS
+}
+
+var (
+	_ fs.NodeLookuper  = (*node)(nil)
+	_ fs.NodeGetattrer = (*node)(nil)
+	_ fs.NodeSetattrer = (*node)(nil)
+	_ fs.NodeReaddirer = (*node)(nil)
+	_ fs.NodeOpener    = (*node)(nil)
+	_ fs.NodeCreater   = (*node)(nil)
+	_ fs.NodeMkdirer   = (*node)(nil)
+	_ fs.NodeUnlinker  = (*node)(nil)
+	_ fs.NodeRmdirer   = (*node)(nil)
+	_ fs.NodeRenamer   = (*node)(nil)
+)
+
+func (n *node) path() string {
+	return n.Path(nil)
+}
+
+func (n *node) child(name string) string {
+	return n.path() + "/" + name
+}
+
+func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	info, err := n.fsys.Stat(n.child(name))
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	setAttr(&out.Attr, info)
+	return n.newChild(ctx, info), 0
+}
+
+func (n *node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	info, err := n.fsys.Stat(n.path())
+	if err != nil {
+		return errno(err)
+	}
+
+	setAttr(&out.Attr, info)
+	return 0
+}
+
+func (n *node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		var err error
+		if h, isHandle := f.(*handle); isHandle {
+			err = h.h.Truncate(int64(size))
+		} else {
+			err = n.fsys.Truncate(n.path(), int64(size))
+		}
+		if err != nil {
+			return errno(err)
+		}
+	}
+
+	return n.Getattr(ctx, f, out)
+}
+
+func (n *node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	infos, err := n.fsys.ReadDir(n.path())
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fuse.DirEntry{Name: info.Name, Mode: mode(info)})
+	}
+
+	return fs.NewListDirStream(entries), 0
+}
+
+func (n *node) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	h, err := n.fsys.OpenFile(n.path(), int(flags))
+	if err != nil {
+		return nil, 0, errno(err)
+	}
+
+	return &handle{h: h}, 0, 0
+}
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	h, err := n.fsys.OpenFile(n.child(name), int(flags)|os.O_CREATE)
+	if err != nil {
+		return nil, nil, 0, errno(err)
+	}
+
+	info, err := n.fsys.Stat(n.child(name))
+	if err != nil {
+		h.Close()
+		return nil, nil, 0, errno(err)
+	}
+
+	setAttr(&out.Attr, info)
+	return n.newChild(ctx, info), &handle{h: h}, 0, 0
+}
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if err := n.fsys.Mkdir(n.child(name)); err != nil {
+		return nil, errno(err)
+	}
+
+	info, err := n.fsys.Stat(n.child(name))
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	setAttr(&out.Attr, info)
+	return n.newChild(ctx, info), 0
+}
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return errno(n.fsys.Remove(n.child(name)))
+}
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return errno(n.fsys.Rmdir(n.child(name)))
+}
+
+func (n *node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags != 0 {
+		return syscall.ENOTSUP
+	}
+
+	target := newParent.EmbeddedInode().Path(nil) + "/" + newName
+	return errno(n.fsys.Rename(n.child(name), target))
+}
+
+func (n *node) newChild(ctx context.Context, info vfs.FileInfo) *fs.Inode {
+	return n.NewInode(ctx, &node{fsys: n.fsys}, fs.StableAttr{Mode: mode(info)})
+}
+
+// handle adapts a vfs.Handle to a FUSE file handle. The file is stored on
+// every flush, i.e. each time a file descriptor of it is closed.
+type handle struct {
+	h *vfs.Handle
+}
+
+var (
+	_ fs.FileReader   = (*handle)(nil)
+	_ fs.FileWriter   = (*handle)(nil)
+	_ fs.FileFlusher  = (*handle)(nil)
+	_ fs.FileFsyncer  = (*handle)(nil)
+	_ fs.FileReleaser = (*handle)(nil)
+)
+
+func (h *handle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.h.ReadAt(dest, off)
+	if err != nil && n == 0 && off < h.h.Size() {
+		return nil, errno(err)
+	}
+
+	return fuse.ReadResultData(dest[:n]), 0
+}
+
+func (h *handle) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	n, err := h.h.WriteAt(data, off)
+	if err != nil {
+		return uint32(n), errno(err)
+	}
+
+	return uint32(n), 0
+}
+
+func (h *handle) Flush(ctx context.Context) syscall.Errno {
+	return errno(h.h.Flush())
+}
+
+func (h *handle) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return errno(h.h.Flush())
+}
+
+func (h *handle) Release(ctx context.Context) syscall.Errno {
+	return errno(h.h.Close())
+}
+
+func setAttr(attr *fuse.Attr, info vfs.FileInfo) {
+	attr.Mode = mode(info)
+	attr.Size = uint64(info.Size)
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Nlink = 1
+	attr.Uid = uint32(os.Getuid())
+	attr.Gid = uint32(os.Getgid())
+	attr.SetTimes(nil, &info.ModTime, &info.ModTime)
+}
+
+func mode(info vfs.FileInfo) uint32 {
+	if info.IsDir {
+		return syscall.S_IFDIR | 0o755
+	}
+	return syscall.S_IFREG | 0o644
+}
+
+func errno(err error) syscall.Errno {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, os.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return syscall.EEXIST
+	case errors.Is(err, os.ErrPermission):
+		return syscall.EACCES
+	case errors.Is(err, vfs.ErrIsDir):
+		return syscall.EISDIR
+	case errors.Is(err, vfs.ErrNotDir):
+		return syscall.ENOTDIR
+	case errors.Is(err, vfs.ErrNotEmpty):
+		return syscall.ENOTEMPTY
+	}
+
+	slog.Error("FUSE operation failed", "err", err)
+	return syscall.EIO
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin
+
+package mount
+
+import (
+	"fmt"
+	"runtime"
+
+	"natneam.github.io/dfs-core/vfs"
+)
+
+// Mountpoint is a mounted file system.
+type Mountpoint struct{}
+
+// Mount isn't supported on this platform, FUSE is only available on Linux
+// and macOS.
+func Mount(dir string, fsys *vfs.FS) (*Mountpoint, error) {
+	return nil, fmt.Errorf("mounting is not supported on %s", runtime.GOOS)
+}
+
+func (m *Mountpoint) Unmount() error {
+	return nil
+}
+
+// Wait blocks until the file system is unmounted.
+func (m *Mountpoint) Wait() {}
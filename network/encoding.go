@@ -1,9 +1,15 @@
 package network
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io"
 )
 
+// maxMessageSize bounds the size of a message, what's larger isn't a
+// message of a peer.
+const maxMessageSize = 1 << 20
+
 type Decoder interface {
 	Decode(io.Reader, *Message) error
 }
@@ -17,18 +23,46 @@ func (dec DefaultDecoder) Decode(reader io.Reader, msg *Message) error {
 		return err
 	}
 
-	if peekBuff[0] == IncomingStream {
+	switch peekBuff[0] {
+	case IncomingMessage:
+	case IncomingStream:
+		// The stream follows the message, it's left to the reader of the
+		// message.
 		msg.Stream = true
-		return nil
+	default:
+		return fmt.Errorf("unknown message kind %#x", peekBuff[0])
 	}
 
-	buffer := make([]byte, 1028)
-	n, err := reader.Read(buffer)
-
-	if err != nil {
+	// The message is read up to its end and no further: the messages sent
+	// back to back, or the stream which follows, are left to the next read.
+	var size uint32
+	if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
 		return err
 	}
+	if size > maxMessageSize {
+		return fmt.Errorf("message of %d bytes is over the %d bytes limit", size, maxMessageSize)
+	}
+
+	msg.Payload = make([]byte, size)
+	_, err := io.ReadFull(reader, msg.Payload)
+	return err
+}
+
+// EncodeMessage returns the payload of a message as it's sent to a peer
+// reading it with DefaultDecoder.
+func EncodeMessage(payload []byte) []byte {
+	return encodeFrame(IncomingMessage, payload)
+}
+
+// EncodeStream returns the payload of a message heading a stream, the bytes
+// of the stream are sent right after it.
+func EncodeStream(payload []byte) []byte {
+	return encodeFrame(IncomingStream, payload)
+}
 
-	msg.Payload = buffer[:n]
-	return nil
+func encodeFrame(kind byte, payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = kind
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
 }
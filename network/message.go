@@ -1,6 +1,9 @@
 package network
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 const (
 	IncomingMessage = 0x1
@@ -10,18 +13,104 @@ const (
 type Message struct {
 	From    net.Addr
 	Payload []byte
-	Stream  bool
+	// Stream is set when a stream follows the message. Its consumer reads
+	// it from the peer, the messages of the peer are only read again once
+	// it calls CloseStream.
+	Stream bool
 }
 
 type DataMessage struct {
 	Payload any
+	// Trace is the trace context of the request the message is part of,
+	// the spans of the peer handling it join the trace of the sender.
+	Trace map[string]string
 }
 
 type StoreMessagePayload struct {
 	Key  string
 	Size int64
+	// WrappedKey is the wrapped data key of a file encrypted end to end.
+	WrappedKey []byte
+	// Policy is the policy of the file, which the peer can't match to
+	// the hashed key.
+	Policy Policy
+	// ExpiresAt is when the copy expires, it doesn't when it's zero.
+	ExpiresAt time.Time
+	// Checksum is the SHA-256 of the file the stream carries encrypted,
+	// the peer only keeps what it decrypts when it matches it.
+	Checksum string
+	// Background is set when the stream is sent by a background job, the
+	// peer receives it within the background bandwidth.
+	Background bool
+	// Erasure is the JSON encoded shard map of an erasure coded file,
+	// sent with an empty stream to the peers so any of them can tell
+	// where the shards are.
+	Erasure []byte
 }
 
+// GetMessagePayload asks a peer for its copy of a file, it answers with a
+// FileMessagePayload.
 type GetMessagePayload struct {
+	// ID identifies the get, the answer carries it.
+	ID  uint64
 	Key string
+	// Background is set when a background job asks for the file, the peer
+	// sends it within the background bandwidth.
+	Background bool
+}
+
+// FileMessagePayload answers a get, the file follows in a stream of Size
+// bytes, encrypted.
+type FileMessagePayload struct {
+	// ID is the one of the get answered.
+	ID uint64
+	// Missing is set when the peer doesn't have the file, no stream
+	// follows.
+	Missing    bool
+	Size       int64
+	WrappedKey []byte
+	// Checksum is the SHA-256 of the file, before it's encrypted for the
+	// way.
+	Checksum string
+	// Erasure is the JSON encoded shard map of an erasure coded file,
+	// whose stream is then empty.
+	Erasure []byte
 }
+
+type DeleteMessagePayload struct {
+	Key string
+	// ExpiresAt is set when the file expired, the message is then a
+	// tombstone which only deletes the copies expiring by then, and not
+	// the ones of a file stored again under the key since.
+	ExpiresAt time.Time
+}
+
+// PolicyMessagePayload spreads a change of the policies of the cluster.
+type PolicyMessagePayload struct {
+	Policy Policy
+}
+
+// Policy is a storage policy as it's sent to the peers, see store.Policy.
+type Policy struct {
+	Prefix       string
+	Replicas     int
+	DataShards   int
+	ParityShards int
+	Plaintext    bool
+	Compression  string
+	TTL          time.Duration
+	UpdatedAt    time.Time
+	Deleted      bool
+}
+
+// PingMessagePayload measures the round trip time to a peer, which sends it
+// back as a pong.
+type PingMessagePayload struct {
+	// Sent is when the ping was sent, by the clock of the sender.
+	Sent time.Time
+	Pong bool
+}
+
+// LeaveMessagePayload tells the peers a node is shutting down, they stop
+// sending to it.
+type LeaveMessagePayload struct{}
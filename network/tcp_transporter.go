@@ -4,9 +4,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"natneam.github.io/dfs-core/metrics"
 )
 
 type TCPPeer struct {
@@ -17,14 +21,20 @@ type TCPPeer struct {
 	// outbound = true, if we're dialing a connection request
 	outbound bool
 
-	wg *sync.WaitGroup
+	// streamDone is signaled once the stream the read loop waits on was
+	// read.
+	streamDone chan struct{}
+
+	// listenAddr is the address the peer listens on, as it announced it
+	// when it connected.
+	listenAddr string
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		Conn:       conn,
+		outbound:   outbound,
+		streamDone: make(chan struct{}, 1),
 	}
 }
 
@@ -33,28 +43,77 @@ func (t *TCPPeer) Send(data []byte) error {
 	return err
 }
 
+// ListenAddr returns the address the peer listens on, which identifies it
+// whichever side dialed the connection. Its host is the one the connection
+// comes from when the peer didn't announce one.
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
 func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+	select {
+	case p.streamDone <- struct{}{}:
+	default:
+	}
 }
 
+// handshakeTimeout is how long a new connection has to send the address
+// of the peer.
+const handshakeTimeout = 10 * time.Second
+
 type TCPTransporterOpts struct {
 	ListenAddress string
-	HandshakeFunc HandshakeFunc
-	Decoder       Decoder
-	OnPeer        func(Peer) error
+	// AdvertiseAddress is the address the peers reach the node at, when
+	// it isn't ListenAddress, e.g. behind a NAT. It identifies the node.
+	AdvertiseAddress string
+	HandshakeFunc    HandshakeFunc
+	Decoder          Decoder
+	OnPeer           func(Peer) error
+	// OnPeerClose is called once the connection of a peer OnPeer accepted
+	// is closed.
+	OnPeerClose func(Peer)
+	// Logger logs the connections of the transport. Defaults to
+	// slog.Default().
+	Logger *slog.Logger
+	// Metrics count the connections and their traffic, share them with
+	// the FileServer to expose them. Defaults to metrics of their own.
+	Metrics *metrics.Metrics
 }
 
 type TCPTransporter struct {
 	TCPTransporterOpts
 	listener net.Listener
 	msgChan  chan Message
+	log      *slog.Logger
+
+	// connLock guards the listener, the open connections Close closes and
+	// closed. wg waits for the goroutines of the accept loop and of the
+	// connections.
+	connLock sync.Mutex
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	quit     chan struct{}
 }
 
 func NewTCPTransporter(opts TCPTransporterOpts) *TCPTransporter {
-	return &TCPTransporter{
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.New()
+	}
+
+	t := &TCPTransporter{
 		TCPTransporterOpts: opts,
 		msgChan:            make(chan Message, 1024),
+		conns:              make(map[net.Conn]struct{}),
+		quit:               make(chan struct{}),
 	}
+	t.log = logger.With("node", t.RemoteAddr())
+
+	return t
 
 }
 
@@ -63,13 +122,21 @@ func (t *TCPTransporter) Dial(addr string) error {
 	if err != nil {
 		return err
 	}
+	if !t.track(conn) {
+		conn.Close()
+		return net.ErrClosed
+	}
 
 	go t.handleConn(conn, true)
 
 	return nil
 }
 
+// RemoteAddr returns the address the peers reach the node at.
 func (t *TCPTransporter) RemoteAddr() string {
+	if len(t.AdvertiseAddress) > 0 {
+		return t.AdvertiseAddress
+	}
 	return t.ListenAddress
 }
 
@@ -80,22 +147,73 @@ func (t *TCPTransporter) Consume() <-chan Message {
 }
 
 func (t *TCPTransporter) ListenAndAccept() error {
-	var err error
-
-	t.listener, err = net.Listen("tcp", t.ListenAddress)
+	lis, err := net.Listen("tcp", t.ListenAddress)
 	if err != nil {
 		return err
 	}
 
-	go t.ListenAndAcceptLoop()
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+	if t.closed {
+		lis.Close()
+		return net.ErrClosed
+	}
+	t.listener = lis
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.ListenAndAcceptLoop()
+	}()
 
-	log.Printf("TCP Transport listening on port %s", t.ListenAddress)
+	t.log.Info("TCP transport listening", "address", t.ListenAddress)
 
 	return nil
 }
 
+// Close stops accepting connections, closes the open ones and waits for
+// their goroutines to return. It can be called more than once.
 func (t *TCPTransporter) Close() error {
-	return t.listener.Close()
+	t.connLock.Lock()
+	if t.closed {
+		t.connLock.Unlock()
+		return nil
+	}
+	t.closed = true
+	close(t.quit)
+
+	var err error
+	if t.listener != nil {
+		err = t.listener.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.connLock.Unlock()
+
+	t.wg.Wait()
+	return err
+}
+
+// track records an open connection for Close, it's false once the
+// transport is closed.
+func (t *TCPTransporter) track(conn net.Conn) bool {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[conn] = struct{}{}
+	t.wg.Add(1)
+	return true
+}
+
+func (t *TCPTransporter) untrack(conn net.Conn) {
+	t.connLock.Lock()
+	delete(t.conns, conn)
+	t.connLock.Unlock()
+	t.wg.Done()
 }
 
 func (t *TCPTransporter) ListenAndAcceptLoop() {
@@ -108,7 +226,12 @@ func (t *TCPTransporter) ListenAndAcceptLoop() {
 		}
 
 		if err != nil {
-			fmt.Printf("TCP Accept Error : %s", err)
+			t.log.Error("TCP accept failed", "err", err)
+			continue
+		}
+		if !t.track(conn) {
+			conn.Close()
+			return
 		}
 
 		go t.handleConn(conn, false)
@@ -116,16 +239,39 @@ func (t *TCPTransporter) ListenAndAcceptLoop() {
 
 }
 
+// handleConn reads the messages of a connection tracked by track until it's
+// closed.
 func (t *TCPTransporter) handleConn(conn net.Conn, outbound bool) {
-	var err error
+	defer t.untrack(conn)
 
+	addr := conn.RemoteAddr().String()
+	log := t.log.With("peer", addr)
+
+	// The traffic of the peers which are gone isn't kept around.
+	conn = &countingConn{
+		Conn: conn,
+		in:   t.Metrics.PeerBytesIn.WithLabelValues(addr),
+		out:  t.Metrics.PeerBytesOut.WithLabelValues(addr),
+	}
+	defer t.Metrics.PeerBytesIn.DeleteLabelValues(addr)
+	defer t.Metrics.PeerBytesOut.DeleteLabelValues(addr)
+
+	var err error
 	defer func() {
-		fmt.Printf("Error Occurred. Dropping Peer Connection. %s\n", err)
+		// A connection closed by either side isn't an error.
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+			log.Warn("Dropping the peer connection", "err", err)
+		} else {
+			log.Info("Peer connection closed")
+		}
 		conn.Close()
 	}()
 
 	peer := NewTCPPeer(conn, outbound)
 
+	if peer.listenAddr, err = t.exchangeAddrs(conn); err != nil {
+		return
+	}
 	if err = t.HandshakeFunc(peer); err != nil {
 		return
 	}
@@ -133,32 +279,89 @@ func (t *TCPTransporter) handleConn(conn net.Conn, outbound bool) {
 	if err = t.OnPeer(peer); err != nil {
 		return
 	}
+	t.Metrics.PeersConnected.Inc()
+	defer t.Metrics.PeersConnected.Dec()
+	if t.OnPeerClose != nil {
+		defer t.OnPeerClose(peer)
+	}
 
 	// Read loop
 	for {
 		msg := Message{}
 		if err = t.Decoder.Decode(conn, &msg); err != nil {
-			if err == io.EOF {
-				fmt.Printf("Connection closed by peer %s\n", conn.RemoteAddr())
-				conn.Close()
-				return
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				t.Metrics.DecodeErrors.WithLabelValues("transport").Inc()
 			}
-
-			fmt.Printf("TCP Decoding Error : %s\n", err)
-			continue
+			return
 		}
 
 		msg.From = conn.RemoteAddr()
 
-		// If the message is a stream wait until it's received on the by the other pear
+		select {
+		case t.msgChan <- msg:
+		case <-t.quit:
+			return
+		}
+
+		// The stream following the message is read by the consumer of the
+		// message, wait until it's done.
 		if msg.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
-			continue
+			log.Debug("Incoming stream, waiting")
+			select {
+			case <-peer.streamDone:
+			case <-t.quit:
+				return
+			}
+			log.Debug("Stream closed, resuming the read loop")
 		}
+	}
+}
+
+// exchangeAddrs sends the address the node is reached at to the peer, and
+// returns the one the peer sends back.
+func (t *TCPTransporter) exchangeAddrs(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
 
-		t.msgChan <- msg
+	if _, err := conn.Write(EncodeMessage([]byte(t.RemoteAddr()))); err != nil {
+		return "", err
+	}
+	var msg Message
+	if err := t.Decoder.Decode(conn, &msg); err != nil {
+		return "", err
+	}
+	if msg.Stream {
+		return "", fmt.Errorf("expected the address of the peer, got a stream")
 	}
+
+	host, port, err := net.SplitHostPort(string(msg.Payload))
+	if err != nil {
+		return "", fmt.Errorf("bad address of the peer: %w", err)
+	}
+	// A peer listening on every interface is reached at the host its
+	// connection comes from.
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		if remote, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			host = remote.IP.String()
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// countingConn counts the bytes read from and written to its connection.
+type countingConn struct {
+	net.Conn
+	in, out prometheus.Counter
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(float64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(float64(n))
+	return n, err
 }
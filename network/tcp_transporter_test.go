@@ -1,7 +1,16 @@
 package network
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,3 +26,158 @@ func TestTCPtransporter(t *testing.T) {
 
 	assert.Equal(t, opts.ListenAddress, tr.ListenAddress)
 }
+
+func TestTCPtransporterLogsCleanClose(t *testing.T) {
+	logs := &syncBuffer{}
+	tr := NewTCPTransporter(TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(Peer) error { return nil },
+		Logger:        slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	defer tr.Close()
+
+	conn, err := net.Dial("tcp", tr.listener.Addr().String())
+	assert.Nil(t, err)
+	conn.Read(make([]byte, 64))
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		return strings.Contains(logs.String(), "Peer connection closed")
+	}, time.Second, 10*time.Millisecond)
+
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		assert.Nil(t, json.Unmarshal([]byte(line), &entry))
+		assert.Equal(t, ":0", entry["node"])
+		assert.NotEqual(t, "WARN", entry["level"], line)
+		assert.NotEqual(t, "ERROR", entry["level"], line)
+	}
+}
+
+func TestTCPtransporterClose(t *testing.T) {
+	closed := make(chan struct{})
+	tr := NewTCPTransporter(TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeer:        func(Peer) error { return nil },
+		OnPeerClose:   func(Peer) { close(closed) },
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	addr := tr.listener.Addr().String()
+
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write(EncodeMessage([]byte(":4000")))
+	assert.Nil(t, err)
+	assert.Nil(t, DefaultDecoder{}.Decode(conn, &Message{}))
+	assert.Eventually(t, func() bool {
+		tr.connLock.Lock()
+		defer tr.connLock.Unlock()
+		return len(tr.conns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// The connections are closed and their goroutines done once Close
+	// returns.
+	assert.Nil(t, tr.Close())
+	select {
+	case <-closed:
+	default:
+		t.Fatal("the peer connection is still open")
+	}
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer other.Close()
+	assert.ErrorIs(t, tr.Dial(other.Addr().String()), net.ErrClosed)
+	assert.Nil(t, tr.Close())
+}
+
+func TestExchangeAddrs(t *testing.T) {
+	newTransporter := func(addr string) (*TCPTransporter, chan Peer) {
+		peers := make(chan Peer, 1)
+		tr := NewTCPTransporter(TCPTransporterOpts{
+			ListenAddress: addr,
+			HandshakeFunc: NOPHandshakeFunc,
+			Decoder:       DefaultDecoder{},
+			OnPeer: func(p Peer) error {
+				peers <- p
+				return nil
+			},
+		})
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+		return tr, peers
+	}
+
+	// The peers are known by the address they listen on, the host of the
+	// connection filling in the one they don't announce.
+	first, firstPeers := newTransporter(":0")
+	port := first.listener.Addr().(*net.TCPAddr).Port
+	first.ListenAddress = fmt.Sprintf(":%d", port)
+	second, secondPeers := newTransporter("127.0.0.1:0")
+	second.ListenAddress = second.listener.Addr().String()
+
+	assert.Nil(t, second.Dial(first.ListenAddress))
+	assert.Equal(t, second.ListenAddress, (<-firstPeers).ListenAddr())
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), (<-secondPeers).ListenAddr())
+}
+
+// syncBuffer is a bytes.Buffer the connections can log to concurrently.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestDecodeMessagesBackToBack(t *testing.T) {
+	type payload struct {
+		Key  string
+		Size int64
+	}
+	gob.Register(payload{})
+
+	// Two messages and a stream arrive in a single read.
+	var wire bytes.Buffer
+	for _, p := range []payload{{"first", 1}, {"second", 2}} {
+		var buf bytes.Buffer
+		assert.Nil(t, gob.NewEncoder(&buf).Encode(DataMessage{Payload: p}))
+		wire.Write(EncodeMessage(buf.Bytes()))
+	}
+	wire.Write(EncodeStream([]byte("header")))
+	wire.WriteString("data")
+
+	dec := DefaultDecoder{}
+	for _, expected := range []payload{{"first", 1}, {"second", 2}} {
+		var msg Message
+		assert.Nil(t, dec.Decode(&wire, &msg))
+		assert.False(t, msg.Stream)
+
+		var m DataMessage
+		assert.Nil(t, gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(&m))
+		assert.Equal(t, expected, m.Payload)
+	}
+
+	var msg Message
+	assert.Nil(t, dec.Decode(&wire, &msg))
+	assert.True(t, msg.Stream)
+	assert.Equal(t, "header", string(msg.Payload))
+	assert.Equal(t, "data", wire.String())
+}
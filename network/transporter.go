@@ -10,6 +10,8 @@ type Peer interface {
 	RemoteAddr() net.Addr
 	Send([]byte) error
 	CloseStream()
+	// ListenAddr is the address the peer listens on.
+	ListenAddr() string
 }
 
 // Transporter handles the communication between nodes in the network.
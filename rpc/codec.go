@@ -0,0 +1,52 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+
+	"google.golang.org/grpc/encoding"
+)
+
+// CodecName is the gRPC content subtype of the file service. The messages
+// are plain Go structs encoded with gob, the same encoding the nodes use
+// among themselves, so no protobuf code generation is involved.
+const CodecName = "gob"
+
+func init() {
+	encoding.RegisterCodec(gobCodec{})
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	// gob refuses structs without fields, they're sent as empty messages.
+	if isEmpty(v) {
+		return nil, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	if len(data) == 0 && isEmpty(v) {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (gobCodec) Name() string {
+	return CodecName
+}
+
+func isEmpty(v any) bool {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t != nil && t.Kind() == reflect.Struct && t.NumField() == 0
+}
@@ -0,0 +1,158 @@
+package rpc
+
+import (
+	"time"
+
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+// ChunkSize is the maximum amount of file data carried by a single stream
+// message.
+const ChunkSize = 64 * 1024
+
+// FileInfo describes a file held by a node.
+type FileInfo struct {
+	Key      string
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+	// WrappedKey is set for files encrypted end to end by the client.
+	WrappedKey []byte
+	// ExpiresAt is when the file expires, the zero time when it doesn't.
+	ExpiresAt time.Time
+}
+
+// PutRequest is sent on the Put client stream. The first message names the
+// key, and the wrapped data key when the client encrypted the file, the
+// following ones only carry data.
+type PutRequest struct {
+	Key        string
+	Data       []byte
+	WrappedKey []byte
+	// TTL is how long the file is kept, as its policy says when it's 0.
+	TTL time.Duration
+}
+
+type PutResponse struct {
+	Size int64
+}
+
+// GetRequest asks for the content of key starting at Offset.
+type GetRequest struct {
+	Key    string
+	Offset int64
+}
+
+// GetResponse is sent on the Get server stream. The first message carries
+// the total size of the file and its wrapped data key if any, all of them
+// carry data.
+type GetResponse struct {
+	Size       int64
+	Data       []byte
+	WrappedKey []byte
+}
+
+type DeleteRequest struct {
+	Key string
+}
+
+// DeleteResponse echoes the deleted key, gob can't encode empty structs.
+type DeleteResponse struct {
+	Key string
+}
+
+type StatRequest struct {
+	Key string
+}
+
+type StatResponse struct {
+	File FileInfo
+}
+
+type ListRequest struct {
+	Prefix string
+}
+
+type ListResponse struct {
+	Files []FileInfo
+}
+
+// WatchRequest subscribes to the changes of the keys starting with Prefix.
+type WatchRequest struct {
+	Prefix string
+}
+
+type EventType int
+
+const (
+	EventStore EventType = iota + 1
+	EventDelete
+)
+
+// WatchEvent is sent on the Watch server stream for every change.
+type WatchEvent struct {
+	Type EventType
+	Key  string
+	Size int64
+	Time time.Time
+}
+
+type PeersRequest struct{}
+
+type PeersResponse struct {
+	Peers []string
+}
+
+type SetPolicyRequest struct {
+	Policy store.Policy
+}
+
+// SetPolicyResponse echoes the prefix of the policy, gob can't encode empty
+// structs.
+type SetPolicyResponse struct {
+	Prefix string
+}
+
+type DeletePolicyRequest struct {
+	Prefix string
+}
+
+// DeletePolicyResponse echoes the prefix of the deleted policy.
+type DeletePolicyResponse struct {
+	Prefix string
+}
+
+type PoliciesRequest struct{}
+
+type PoliciesResponse struct {
+	Policies []store.Policy
+}
+
+// ScrubRequest asks for the status of the scrub of the node, after starting
+// one when Start is set.
+type ScrubRequest struct {
+	Start bool
+}
+
+type ScrubResponse struct {
+	Status ScrubStatus
+}
+
+type (
+	ScrubStatus  = server.ScrubStatus
+	ScrubFinding = server.ScrubFinding
+)
+
+// StatusRequest asks for the state of the node.
+type StatusRequest struct{}
+
+type StatusResponse struct {
+	Status NodeStatus
+}
+
+type (
+	NodeStatus = server.NodeStatus
+	PeerStatus = server.PeerStatus
+	JobStatus  = server.JobStatus
+)
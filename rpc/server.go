@@ -0,0 +1,265 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+// Server implements the file service on top of a FileServer.
+type Server struct {
+	fs *server.FileServer
+}
+
+func NewServer(fs *server.FileServer) *Server {
+	return &Server{fs: fs}
+}
+
+// NewGRPCServer returns a gRPC server exposing the file service of fs. The
+// calls are logged with the logger of fs, along with their request ID.
+func NewGRPCServer(fs *server.FileServer, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append(loggingInterceptors(fs.Logger), opts...)...)
+	RegisterFileServiceServer(s, NewServer(fs))
+	return s
+}
+
+func (s *Server) Put(stream grpc.ClientStreamingServer[PutRequest, PutResponse]) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return status.Error(codes.InvalidArgument, "missing key")
+	}
+	if err != nil {
+		return err
+	}
+	if len(req.Key) == 0 {
+		return status.Error(codes.InvalidArgument, "missing key")
+	}
+
+	// The file server reads from the pipe while chunks keep coming in.
+	pr, pw := io.Pipe()
+	counter := &countingReader{r: pr}
+	done := make(chan error, 1)
+	go func() {
+		err := s.fs.StoreWith(req.Key, counter, server.StoreOpts{WrappedKey: req.WrappedKey, TTL: req.TTL})
+		// Unblock the writer if Store gave up before reading everything.
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	data := req.Data
+	for {
+		if len(data) > 0 {
+			if _, err := pw.Write(data); err != nil {
+				break
+			}
+		}
+
+		req, err := stream.Recv()
+		if err == io.EOF {
+			pw.Close()
+			break
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			<-done
+			return err
+		}
+		data = req.Data
+	}
+
+	if err := <-done; err != nil {
+		return status.Errorf(codes.Internal, "store %s: %s", req.Key, err)
+	}
+
+	return stream.SendAndClose(&PutResponse{Size: counter.n})
+}
+
+func (s *Server) Get(req *GetRequest, stream grpc.ServerStreamingServer[GetResponse]) error {
+	meta, r, err := s.fs.Open(req.Key)
+	switch {
+	case errors.Is(err, server.ErrNotFound):
+		return status.Errorf(codes.NotFound, "%s: file not found", req.Key)
+	case errors.Is(err, server.ErrUnavailable), errors.Is(err, server.ErrServerClosed):
+		return status.Errorf(codes.Unavailable, "get %s: %s", req.Key, err)
+	case err != nil:
+		return status.Errorf(codes.Internal, "get %s: %s", req.Key, err)
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	size := meta.Size
+	if req.Offset < 0 || req.Offset > size {
+		return status.Errorf(codes.OutOfRange, "offset %d is out of the file size %d", req.Offset, size)
+	}
+
+	if req.Offset > 0 {
+		if seeker, ok := r.(io.Seeker); ok {
+			_, err = seeker.Seek(req.Offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, r, req.Offset)
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "seek %s: %s", req.Key, err)
+		}
+	}
+
+	buf := make([]byte, ChunkSize)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || first {
+			resp := &GetResponse{Size: size, Data: buf[:n]}
+			if first {
+				resp.WrappedKey = meta.WrappedKey
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "read %s: %s", req.Key, err)
+		}
+	}
+}
+
+func (s *Server) Delete(ctx context.Context, req *DeleteRequest) (*DeleteResponse, error) {
+	if !s.fs.Has(req.Key) {
+		return nil, status.Errorf(codes.NotFound, "%s: file not found", req.Key)
+	}
+
+	if err := s.fs.DeleteNetwork(req.Key); err != nil {
+		return nil, status.Errorf(codes.Internal, "delete %s: %s", req.Key, err)
+	}
+
+	return &DeleteResponse{Key: req.Key}, nil
+}
+
+func (s *Server) Stat(ctx context.Context, req *StatRequest) (*StatResponse, error) {
+	meta, err := s.fs.Stat(req.Key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "%s: file not found", req.Key)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "stat %s: %s", req.Key, err)
+	}
+
+	return &StatResponse{File: fileInfo(meta)}, nil
+}
+
+func (s *Server) List(ctx context.Context, req *ListRequest) (*ListResponse, error) {
+	list, err := s.fs.List(req.Prefix)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "list %s: %s", req.Prefix, err)
+	}
+
+	resp := &ListResponse{Files: make([]FileInfo, 0, len(list))}
+	for _, meta := range list {
+		resp.Files = append(resp.Files, fileInfo(meta))
+	}
+
+	return resp, nil
+}
+
+func (s *Server) Watch(req *WatchRequest, stream grpc.ServerStreamingServer[WatchEvent]) error {
+	events, cancel := s.fs.Subscribe()
+	defer cancel()
+
+	for {
+		select {
+		case ev := <-events:
+			if !strings.HasPrefix(ev.Key, req.Prefix) {
+				continue
+			}
+
+			err := stream.Send(&WatchEvent{
+				Type: EventType(ev.Type),
+				Key:  ev.Key,
+				Size: ev.Size,
+				Time: ev.Time,
+			})
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *Server) Peers(ctx context.Context, req *PeersRequest) (*PeersResponse, error) {
+	return &PeersResponse{Peers: s.fs.Peers()}, nil
+}
+
+func (s *Server) SetPolicy(ctx context.Context, req *SetPolicyRequest) (*SetPolicyResponse, error) {
+	if err := s.fs.SetPolicy(req.Policy); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "policy of %q: %s", req.Policy.Prefix, err)
+	}
+
+	return &SetPolicyResponse{Prefix: req.Policy.Prefix}, nil
+}
+
+func (s *Server) DeletePolicy(ctx context.Context, req *DeletePolicyRequest) (*DeletePolicyResponse, error) {
+	if err := s.fs.DeletePolicy(req.Prefix); err != nil {
+		return nil, status.Errorf(codes.NotFound, "%s", err)
+	}
+
+	return &DeletePolicyResponse{Prefix: req.Prefix}, nil
+}
+
+func (s *Server) Policies(ctx context.Context, req *PoliciesRequest) (*PoliciesResponse, error) {
+	return &PoliciesResponse{Policies: s.fs.Policies()}, nil
+}
+
+func (s *Server) Scrub(ctx context.Context, req *ScrubRequest) (*ScrubResponse, error) {
+	if req.Start {
+		// Starting a scrub while one runs only reports its progress.
+		if err := s.fs.StartScrub(); err != nil && !errors.Is(err, server.ErrScrubRunning) {
+			return nil, status.Errorf(codes.Internal, "scrub: %s", err)
+		}
+	}
+
+	return &ScrubResponse{Status: s.fs.ScrubProgress()}, nil
+}
+
+func (s *Server) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	node, err := s.fs.Status()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "status: %s", err)
+	}
+
+	return &StatusResponse{Status: node}, nil
+}
+
+func fileInfo(meta store.Metadata) FileInfo {
+	return FileInfo{
+		Key:        meta.Key,
+		Size:       meta.Size,
+		ModTime:    meta.ModTime,
+		Checksum:   meta.Checksum,
+		WrappedKey: meta.WrappedKey,
+		ExpiresAt:  meta.ExpiresAt,
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
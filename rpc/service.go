@@ -0,0 +1,224 @@
+package rpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+const ServiceName = "dfs.FileService"
+
+// Full method names of the file service, as used by clients.
+const (
+	MethodPut    = "/" + ServiceName + "/Put"
+	MethodGet    = "/" + ServiceName + "/Get"
+	MethodDelete = "/" + ServiceName + "/Delete"
+	MethodStat   = "/" + ServiceName + "/Stat"
+	MethodList   = "/" + ServiceName + "/List"
+	MethodWatch  = "/" + ServiceName + "/Watch"
+	MethodPeers  = "/" + ServiceName + "/Peers"
+
+	MethodSetPolicy    = "/" + ServiceName + "/SetPolicy"
+	MethodDeletePolicy = "/" + ServiceName + "/DeletePolicy"
+	MethodPolicies     = "/" + ServiceName + "/Policies"
+
+	MethodScrub  = "/" + ServiceName + "/Scrub"
+	MethodStatus = "/" + ServiceName + "/Status"
+)
+
+// FileServiceServer is the server side of the file service.
+type FileServiceServer interface {
+	Put(grpc.ClientStreamingServer[PutRequest, PutResponse]) error
+	Get(*GetRequest, grpc.ServerStreamingServer[GetResponse]) error
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error
+	Peers(context.Context, *PeersRequest) (*PeersResponse, error)
+	SetPolicy(context.Context, *SetPolicyRequest) (*SetPolicyResponse, error)
+	DeletePolicy(context.Context, *DeletePolicyRequest) (*DeletePolicyResponse, error)
+	Policies(context.Context, *PoliciesRequest) (*PoliciesResponse, error)
+	Scrub(context.Context, *ScrubRequest) (*ScrubResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+}
+
+// ServiceDesc describes the file service to gRPC. It's what protoc would
+// generate for the service, written out since the messages aren't
+// protobufs.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*FileServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Delete", Handler: deleteHandler},
+		{MethodName: "Stat", Handler: statHandler},
+		{MethodName: "List", Handler: listHandler},
+		{MethodName: "Peers", Handler: peersHandler},
+		{MethodName: "SetPolicy", Handler: setPolicyHandler},
+		{MethodName: "DeletePolicy", Handler: deletePolicyHandler},
+		{MethodName: "Policies", Handler: policiesHandler},
+		{MethodName: "Scrub", Handler: scrubHandler},
+		{MethodName: "Status", Handler: statusHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Put", Handler: putHandler, ClientStreams: true},
+		{StreamName: "Get", Handler: getHandler, ServerStreams: true},
+		{StreamName: "Watch", Handler: watchHandler, ServerStreams: true},
+	},
+}
+
+// Stream descriptors for clients opening the streaming methods.
+var (
+	PutStreamDesc   = &ServiceDesc.Streams[0]
+	GetStreamDesc   = &ServiceDesc.Streams[1]
+	WatchStreamDesc = &ServiceDesc.Streams[2]
+)
+
+func RegisterFileServiceServer(s grpc.ServiceRegistrar, srv FileServiceServer) {
+	s.RegisterService(&ServiceDesc, srv)
+}
+
+func putHandler(srv any, stream grpc.ServerStream) error {
+	return srv.(FileServiceServer).Put(&grpc.GenericServerStream[PutRequest, PutResponse]{ServerStream: stream})
+}
+
+func getHandler(srv any, stream grpc.ServerStream) error {
+	req := new(GetRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(FileServiceServer).Get(req, &grpc.GenericServerStream[GetRequest, GetResponse]{ServerStream: stream})
+}
+
+func watchHandler(srv any, stream grpc.ServerStream) error {
+	req := new(WatchRequest)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(FileServiceServer).Watch(req, &grpc.GenericServerStream[WatchRequest, WatchEvent]{ServerStream: stream})
+}
+
+func deleteHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(DeleteRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Delete(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodDelete}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Delete(ctx, req.(*DeleteRequest))
+	})
+}
+
+func statHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(StatRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Stat(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodStat}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Stat(ctx, req.(*StatRequest))
+	})
+}
+
+func listHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(ListRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).List(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodList}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).List(ctx, req.(*ListRequest))
+	})
+}
+
+func peersHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(PeersRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Peers(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodPeers}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Peers(ctx, req.(*PeersRequest))
+	})
+}
+
+func setPolicyHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(SetPolicyRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).SetPolicy(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodSetPolicy}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).SetPolicy(ctx, req.(*SetPolicyRequest))
+	})
+}
+
+func deletePolicyHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(DeletePolicyRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).DeletePolicy(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodDeletePolicy}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).DeletePolicy(ctx, req.(*DeletePolicyRequest))
+	})
+}
+
+func policiesHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(PoliciesRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Policies(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodPolicies}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Policies(ctx, req.(*PoliciesRequest))
+	})
+}
+
+func scrubHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(ScrubRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Scrub(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodScrub}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Scrub(ctx, req.(*ScrubRequest))
+	})
+}
+
+func statusHandler(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	req := new(StatusRequest)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServiceServer).Status(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: MethodStatus}
+	return interceptor(ctx, req, info, func(ctx context.Context, req any) (any, error) {
+		return srv.(FileServiceServer).Status(ctx, req.(*StatusRequest))
+	})
+}
@@ -0,0 +1,261 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	// maxClockSkew is how far the request date may drift from the local
+	// clock before a signed request is rejected.
+	maxClockSkew = 15 * time.Minute
+)
+
+// signature holds everything a verified SigV4 request carries which is
+// needed later on, e.g. to verify the chunk signatures of a streaming body.
+type signature struct {
+	accessKey     string
+	date          time.Time
+	scope         string
+	signedHeaders []string
+	signature     string
+	payloadHash   string
+	signingKey    []byte
+}
+
+// authenticate verifies the SigV4 signature of the request, either from
+// the Authorization header or from the query string of a presigned URL.
+func (g *Gateway) authenticate(r *http.Request) (*signature, *apiError) {
+	var (
+		sig *signature
+		err *apiError
+	)
+
+	if r.URL.Query().Has("X-Amz-Algorithm") {
+		sig, err = parsePresigned(r)
+	} else {
+		sig, err = parseAuthorization(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secret, ok := g.Credentials[sig.accessKey]
+	if !ok {
+		return nil, errInvalidAccessKeyID
+	}
+
+	scope := strings.Split(sig.scope, "/")
+	if scope[0] != sig.date.Format("20060102") || scope[2] != "s3" || scope[3] != "aws4_request" {
+		return nil, errAuthorizationHeaderMalformed
+	}
+	if len(g.Region) > 0 && scope[1] != g.Region {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	sig.signingKey = signingKey(secret, scope[0], scope[1])
+
+	canonical := canonicalRequest(r, sig)
+	expected := hex.EncodeToString(hmacSHA256(sig.signingKey, []byte(stringToSign(sig.date, sig.scope, canonical))))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return nil, errSignatureDoesNotMatch
+	}
+
+	return sig, nil
+}
+
+func parseAuthorization(r *http.Request) (*signature, *apiError) {
+	header := r.Header.Get("Authorization")
+	if len(header) == 0 {
+		return nil, errAccessDenied
+	}
+
+	algorithm, fields, ok := strings.Cut(header, " ")
+	if !ok || algorithm != signAlgorithm {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	sig := &signature{}
+	for _, field := range strings.Split(fields, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, errAuthorizationHeaderMalformed
+		}
+
+		switch name {
+		case "Credential":
+			accessKey, scope, ok := strings.Cut(value, "/")
+			if !ok || strings.Count(scope, "/") != 3 {
+				return nil, errAuthorizationHeaderMalformed
+			}
+			sig.accessKey, sig.scope = accessKey, scope
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			sig.signature = value
+		}
+	}
+
+	if len(sig.accessKey) == 0 || len(sig.signedHeaders) == 0 || len(sig.signature) == 0 {
+		return nil, errAuthorizationHeaderMalformed
+	}
+
+	date, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAccessDenied
+	}
+	if d := time.Since(date); d > maxClockSkew || d < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	sig.date = date
+
+	sig.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if len(sig.payloadHash) == 0 {
+		return nil, errMissingContentSHA256
+	}
+
+	return sig, nil
+}
+
+func parsePresigned(r *http.Request) (*signature, *apiError) {
+	query := r.URL.Query()
+	if query.Get("X-Amz-Algorithm") != signAlgorithm {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	accessKey, scope, ok := strings.Cut(query.Get("X-Amz-Credential"), "/")
+	if !ok || strings.Count(scope, "/") != 3 {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	date, err := time.Parse(amzDateFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationQueryParametersError
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || expires > 7*24*60*60 {
+		return nil, errAuthorizationQueryParametersError
+	}
+	if time.Now().After(date.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpiredPresignedRequest
+	}
+
+	sig := &signature{
+		accessKey:     accessKey,
+		date:          date,
+		scope:         scope,
+		signedHeaders: strings.Split(query.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     query.Get("X-Amz-Signature"),
+		payloadHash:   unsignedPayload,
+	}
+	if hash := query.Get("X-Amz-Content-Sha256"); len(hash) > 0 {
+		sig.payloadHash = hash
+	}
+
+	return sig, nil
+}
+
+func canonicalRequest(r *http.Request, sig *signature) string {
+	headers := make([]string, 0, len(sig.signedHeaders))
+	for _, name := range sig.signedHeaders {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			values = r.Header.Values(name)
+		}
+
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers = append(headers, name+":"+strings.Join(trimmed, ","))
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		encodePath(r.URL.Path),
+		canonicalQuery(r.URL.Query()),
+		strings.Join(headers, "\n") + "\n",
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+}
+
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, values := range query {
+		if name == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			params = append(params, encode(name)+"="+encode(value))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+func stringToSign(date time.Time, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{
+		signAlgorithm,
+		date.Format(amzDateFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+func signingKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte("s3"))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// encode escapes everything but the unreserved characters of RFC 3986,
+// which is the encoding SigV4 expects in canonical requests.
+func encode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func encodePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = encode(segment)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,197 @@
+package s3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// emptySHA256 is the hex encoded SHA-256 of an empty string.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// payloadReader wraps the request body so it's checked against the payload
+// hash the client signed. Streaming (aws-chunked) bodies are decoded and
+// their chunk signatures verified on the fly.
+func payloadReader(r *http.Request, sig *signature) (io.Reader, *apiError) {
+	switch sig.payloadHash {
+	case unsignedPayload:
+		return r.Body, nil
+	case streamingPayload, streamingPayload + "-TRAILER":
+		return newChunkedReader(r.Body, sig), nil
+	case streamingUnsignedTrailer:
+		return newChunkedReader(r.Body, nil), nil
+	}
+
+	expected, err := hex.DecodeString(sig.payloadHash)
+	if err != nil || len(expected) != sha256.Size {
+		return nil, errContentSHA256Mismatch
+	}
+
+	return &hashReader{r: r.Body, hash: sha256.New(), expected: expected}, nil
+}
+
+// hashReader fails the final read if the data read doesn't match the
+// expected SHA-256.
+type hashReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected []byte
+}
+
+func (h *hashReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.expected) {
+		return n, errContentSHA256Mismatch
+	}
+
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body. When sig is nil the chunks
+// are unsigned and only the framing is decoded.
+type chunkedReader struct {
+	r   *bufio.Reader
+	sig *signature
+
+	prevSignature  string
+	chunkSignature string
+	chunkHash      hash.Hash
+	remaining      int64
+	started        bool
+	err            error
+}
+
+func newChunkedReader(r io.Reader, sig *signature) *chunkedReader {
+	c := &chunkedReader{
+		r:         bufio.NewReader(r),
+		sig:       sig,
+		chunkHash: sha256.New(),
+	}
+	if sig != nil {
+		c.prevSignature = sig.signature
+	}
+	return c
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		c.err = c.nextChunk()
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.r.Read(p)
+	c.chunkHash.Write(p[:n])
+	c.remaining -= int64(n)
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+// nextChunk finishes the current chunk and reads the header of the next
+// one. It returns io.EOF once the final, empty chunk and the trailers have
+// been consumed.
+func (c *chunkedReader) nextChunk() error {
+	if c.started {
+		if err := c.expectCRLF(); err != nil {
+			return err
+		}
+		if err := c.verifyChunk(); err != nil {
+			return err
+		}
+	}
+	c.started = true
+
+	line, err := c.readLine()
+	if err != nil {
+		return errIncompleteBody
+	}
+
+	sizeField, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return errIncompleteBody
+	}
+
+	c.chunkSignature = strings.TrimPrefix(ext, "chunk-signature=")
+	c.chunkHash.Reset()
+	c.remaining = size
+
+	if size > 0 {
+		return nil
+	}
+
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+
+	// Trailing headers (e.g. checksums) are terminated by an empty line.
+	for {
+		line, err := c.readLine()
+		if err == io.EOF || (err == nil && len(line) == 0) {
+			return io.EOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *chunkedReader) verifyChunk() error {
+	if c.sig == nil {
+		return nil
+	}
+
+	toSign := strings.Join([]string{
+		signAlgorithm + "-PAYLOAD",
+		c.sig.date.Format(amzDateFormat),
+		c.sig.scope,
+		c.prevSignature,
+		emptySHA256,
+		hex.EncodeToString(c.chunkHash.Sum(nil)),
+	}, "\n")
+
+	expected := hex.EncodeToString(hmacSHA256(c.sig.signingKey, []byte(toSign)))
+	if !hmac.Equal([]byte(expected), []byte(c.chunkSignature)) {
+		return errSignatureDoesNotMatch
+	}
+
+	c.prevSignature = c.chunkSignature
+	return nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *chunkedReader) expectCRLF() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(c.r, crlf[:]); err != nil || string(crlf[:]) != "\r\n" {
+		return errIncompleteBody
+	}
+	return nil
+}
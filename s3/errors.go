@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"encoding/xml"
+	"net/http"
+)
+
+// apiError is an error as S3 reports it, a code clients can match on plus
+// the HTTP status it's sent with.
+type apiError struct {
+	Code       string
+	Message    string
+	StatusCode int
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied = &apiError{"AccessDenied", "Access Denied.", http.StatusForbidden}
+
+	errAuthorizationHeaderMalformed = &apiError{"AuthorizationHeaderMalformed",
+		"The authorization header is malformed.", http.StatusBadRequest}
+
+	errAuthorizationQueryParametersError = &apiError{"AuthorizationQueryParametersError",
+		"The presigned URL query parameters are malformed.", http.StatusBadRequest}
+
+	errBadDigest = &apiError{"BadDigest",
+		"The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+
+	errBucketAlreadyOwnedByYou = &apiError{"BucketAlreadyOwnedByYou",
+		"The bucket you tried to create already exists, and you own it.", http.StatusConflict}
+
+	errBucketNotEmpty = &apiError{"BucketNotEmpty",
+		"The bucket you tried to delete is not empty.", http.StatusConflict}
+
+	errContentSHA256Mismatch = &apiError{"XAmzContentSHA256Mismatch",
+		"The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+
+	errExpiredPresignedRequest = &apiError{"AccessDenied", "Request has expired.", http.StatusForbidden}
+
+	errIncompleteBody = &apiError{"IncompleteBody",
+		"You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+
+	errInternalError = &apiError{"InternalError",
+		"We encountered an internal error. Please try again.", http.StatusInternalServerError}
+
+	errInvalidAccessKeyID = &apiError{"InvalidAccessKeyId",
+		"The access key ID you provided does not exist in our records.", http.StatusForbidden}
+
+	errInvalidArgument = &apiError{"InvalidArgument", "Invalid argument.", http.StatusBadRequest}
+
+	errInvalidBucketName = &apiError{"InvalidBucketName",
+		"The specified bucket is not valid.", http.StatusBadRequest}
+
+	errInvalidPart = &apiError{"InvalidPart",
+		"One or more of the specified parts could not be found.", http.StatusBadRequest}
+
+	errInvalidPartOrder = &apiError{"InvalidPartOrder",
+		"The list of parts was not in ascending order.", http.StatusBadRequest}
+
+	errInvalidRange = &apiError{"InvalidRange",
+		"The requested range is not satisfiable.", http.StatusRequestedRangeNotSatisfiable}
+
+	errMalformedXML = &apiError{"MalformedXML",
+		"The XML you provided was not well-formed.", http.StatusBadRequest}
+
+	errMethodNotAllowed = &apiError{"MethodNotAllowed",
+		"The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+
+	errMissingContentSHA256 = &apiError{"InvalidRequest",
+		"Missing required header for this request: x-amz-content-sha256.", http.StatusBadRequest}
+
+	errNoSuchBucket = &apiError{"NoSuchBucket", "The specified bucket does not exist.", http.StatusNotFound}
+
+	errNoSuchKey = &apiError{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+
+	errNoSuchUpload = &apiError{"NoSuchUpload", "The specified upload does not exist.", http.StatusNotFound}
+
+	errNotImplemented = &apiError{"NotImplemented",
+		"A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+
+	errRequestTimeTooSkewed = &apiError{"RequestTimeTooSkewed",
+		"The difference between the request time and the server's time is too large.", http.StatusForbidden}
+
+	errServiceUnavailable = &apiError{"ServiceUnavailable",
+		"The object can't be reached at the moment. Please try again.", http.StatusServiceUnavailable}
+
+	errSignatureDoesNotMatch = &apiError{"SignatureDoesNotMatch",
+		"The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string
+	Message   string
+	Resource  string
+	RequestID string `xml:"RequestId"`
+}
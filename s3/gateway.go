@@ -0,0 +1,564 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+const (
+	// bucketMarker is the object which records the existence of a bucket,
+	// buckets being nothing but key prefixes on the file server.
+	bucketMarker = ".bucket"
+
+	defaultRegion  = "us-east-1"
+	defaultMaxKeys = 1000
+)
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+type GatewayOpts struct {
+	// Credentials maps the access key IDs clients sign with to their
+	// secret keys.
+	Credentials map[string]string
+	// Region requests must be signed for. Defaults to us-east-1.
+	Region string
+	// MultipartDir holds uploaded parts until their upload is completed.
+	MultipartDir string
+}
+
+// Gateway serves a subset of the S3 REST API on top of a FileServer. Only
+// path style requests (http://host/bucket/key) are supported.
+type Gateway struct {
+	GatewayOpts
+
+	fs *server.FileServer
+}
+
+func NewGateway(fs *server.FileServer, opts GatewayOpts) *Gateway {
+	if len(opts.Region) == 0 {
+		opts.Region = defaultRegion
+	}
+	if len(opts.MultipartDir) == 0 {
+		opts.MultipartDir = filepath.Join(os.TempDir(), "dfs-s3-multipart")
+	}
+
+	return &Gateway{
+		GatewayOpts: opts,
+		fs:          fs,
+	}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := newID(8)
+	w.Header().Set("x-amz-request-id", requestID)
+	w.Header().Set("Server", "dfs-core")
+
+	if err := g.serve(w, r); err != nil {
+		var apiErr *apiError
+		if !errors.As(err, &apiErr) {
+			g.fs.Logger.Error("S3 request failed", "request_id", requestID, "method", r.Method, "path", r.URL.Path, "err", err)
+			apiErr = errInternalError
+		}
+		writeError(w, r, requestID, apiErr)
+	}
+}
+
+func (g *Gateway) serve(w http.ResponseWriter, r *http.Request) error {
+	sig, err := g.authenticate(r)
+	if err != nil {
+		return err
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	if len(bucket) == 0 {
+		if r.Method != http.MethodGet {
+			return errMethodNotAllowed
+		}
+		return g.listBuckets(w)
+	}
+
+	if !bucketNameRegexp.MatchString(bucket) {
+		return errInvalidBucketName
+	}
+
+	if len(key) == 0 {
+		switch r.Method {
+		case http.MethodPut:
+			return g.createBucket(w, bucket)
+		case http.MethodHead:
+			return g.headBucket(w, bucket)
+		case http.MethodDelete:
+			return g.deleteBucket(w, bucket)
+		case http.MethodGet:
+			if query.Has("location") {
+				return g.getBucketLocation(w, bucket)
+			}
+			return g.listObjectsV2(w, r, bucket)
+		}
+		return errMethodNotAllowed
+	}
+
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		if query.Has("uploadId") {
+			return g.uploadPart(w, r, sig, bucket, key)
+		}
+		if len(r.Header.Get("X-Amz-Copy-Source")) > 0 {
+			return errNotImplemented
+		}
+		return g.putObject(w, r, sig, bucket, key)
+	case http.MethodPost:
+		if query.Has("uploads") {
+			return g.createMultipartUpload(w, bucket, key)
+		}
+		if query.Has("uploadId") {
+			return g.completeMultipartUpload(w, r, bucket, key)
+		}
+		return errNotImplemented
+	case http.MethodGet:
+		return g.getObject(w, r, bucket, key)
+	case http.MethodHead:
+		return g.headObject(w, bucket, key)
+	case http.MethodDelete:
+		if query.Has("uploadId") {
+			return g.abortMultipartUpload(w, r)
+		}
+		return g.deleteObject(w, bucket, key)
+	}
+
+	return errMethodNotAllowed
+}
+
+func (g *Gateway) listBuckets(w http.ResponseWriter) error {
+	list, err := g.fs.List("")
+	if err != nil {
+		return err
+	}
+
+	result := listAllMyBucketsResult{Owner: gatewayOwner}
+	for _, meta := range list {
+		bucket, name, ok := strings.Cut(meta.Key, "/")
+		if ok && name == bucketMarker && bucketNameRegexp.MatchString(bucket) {
+			result.Buckets = append(result.Buckets, bucketInfo{
+				Name:         bucket,
+				CreationDate: meta.ModTime.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (g *Gateway) createBucket(w http.ResponseWriter, bucket string) error {
+	if g.fs.Has(objectKey(bucket, bucketMarker)) {
+		return errBucketAlreadyOwnedByYou
+	}
+
+	if err := g.fs.Store(objectKey(bucket, bucketMarker), strings.NewReader("")); err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) headBucket(w http.ResponseWriter, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		// HEAD responses can't carry the error document.
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	w.Header().Set("x-amz-bucket-region", g.Region)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) deleteBucket(w http.ResponseWriter, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	list, err := g.fs.List(bucket + "/")
+	if err != nil {
+		return err
+	}
+	if len(list) > 1 {
+		return errBucketNotEmpty
+	}
+
+	if err := g.fs.DeleteNetwork(objectKey(bucket, bucketMarker)); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) getBucketLocation(w http.ResponseWriter, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, locationConstraint{Region: g.Region})
+}
+
+func (g *Gateway) listObjectsV2(w http.ResponseWriter, r *http.Request, bucket string) error {
+	if err := g.checkBucket(bucket); err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	result := listBucketResult{
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           defaultMaxKeys,
+	}
+
+	if query.Has("max-keys") {
+		maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || maxKeys < 0 {
+			return errInvalidArgument
+		}
+		result.MaxKeys = min(maxKeys, defaultMaxKeys)
+	}
+
+	after := result.StartAfter
+	if len(result.ContinuationToken) > 0 {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return errInvalidArgument
+		}
+		after = string(token)
+	}
+
+	list, err := g.fs.List(objectKey(bucket, result.Prefix))
+	if err != nil {
+		return err
+	}
+
+	var last string
+	for _, meta := range list {
+		name := strings.TrimPrefix(meta.Key, bucket+"/")
+		if name == bucketMarker || name <= after {
+			continue
+		}
+
+		// Everything under an already returned common prefix is skipped.
+		if len(result.Delimiter) > 0 && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(name, after) {
+			continue
+		}
+
+		commonPrefix := ""
+		if len(result.Delimiter) > 0 {
+			rest := strings.TrimPrefix(name, result.Prefix)
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				commonPrefix = result.Prefix + rest[:i+len(result.Delimiter)]
+			}
+		}
+
+		if len(commonPrefix) > 0 && commonPrefix == last {
+			continue
+		}
+
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if len(commonPrefix) > 0 {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefixEntry{Prefix: g.encodeKey(commonPrefix, result.EncodingType)})
+			last = commonPrefix
+		} else {
+			result.Contents = append(result.Contents, objectEntry{
+				Key:          g.encodeKey(name, result.EncodingType),
+				LastModified: meta.ModTime.UTC().Format(time.RFC3339Nano),
+				ETag:         etag(meta),
+				Size:         meta.Size,
+				StorageClass: "STANDARD",
+			})
+			last = name
+		}
+		result.KeyCount++
+	}
+
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key string) error {
+	f, sum, err := g.spool(r, sig)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := g.fs.StoreWith(objectKey(bucket, key), f, server.StoreOpts{ETag: sum}); err != nil {
+		return err
+	}
+
+	meta, err := g.fs.Stat(objectKey(bucket, key))
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag(meta))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	meta, reader, err := g.fs.Open(objectKey(bucket, key))
+	switch {
+	case errors.Is(err, server.ErrNotFound):
+		return errNoSuchKey
+	case errors.Is(err, server.ErrUnavailable), errors.Is(err, server.ErrServerClosed):
+		g.fs.Logger.Warn("S3 GET failed", "request_id", w.Header().Get("x-amz-request-id"), "bucket", bucket, "key", key, "err", err)
+		return errServiceUnavailable
+	case err != nil:
+		return err
+	}
+	if rc, ok := reader.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	var (
+		status = http.StatusOK
+		size   = meta.Size
+		start  int64
+		length = size
+	)
+
+	if spec := r.Header.Get("Range"); len(spec) > 0 {
+		start, length, err = parseRange(spec, size)
+		if err != nil {
+			return err
+		}
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	}
+
+	if start > 0 {
+		if seeker, ok := reader.(io.Seeker); ok {
+			_, err = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, reader, start)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	setObjectHeaders(w, meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+
+	if _, err := io.CopyN(w, reader, length); err != nil {
+		// The status line is already out, all we can do is drop the
+		// connection so the client sees a short body.
+		g.fs.Logger.Warn("S3 GET aborted", "request_id", w.Header().Get("x-amz-request-id"), "bucket", bucket, "key", key, "err", err)
+		panic(http.ErrAbortHandler)
+	}
+
+	return nil
+}
+
+func (g *Gateway) headObject(w http.ResponseWriter, bucket, key string) error {
+	meta, err := g.fs.Stat(objectKey(bucket, key))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+
+	setObjectHeaders(w, meta)
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) deleteObject(w http.ResponseWriter, bucket, key string) error {
+	// Deleting a missing key succeeds in S3 as well. The copies of the peers
+	// go too, even when this node has none.
+	if err := g.fs.DeleteNetwork(objectKey(bucket, key)); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// spool copies the verified request body into a temporary file, so nothing
+// reaches the file server before the whole payload has been checked. The
+// MD5 of the body is returned in hex.
+func (g *Gateway) spool(r *http.Request, sig *signature) (*os.File, string, error) {
+	body, apiErr := payloadReader(r, sig)
+	if apiErr != nil {
+		return nil, "", apiErr
+	}
+
+	if err := os.MkdirAll(g.MultipartDir, os.ModePerm); err != nil {
+		return nil, "", err
+	}
+
+	f, err := os.CreateTemp(g.MultipartDir, "spool-*")
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), body); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+
+	if contentMD5 := r.Header.Get("Content-MD5"); len(contentMD5) > 0 &&
+		contentMD5 != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", errBadDigest
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, "", err
+	}
+
+	return f, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (g *Gateway) checkBucket(bucket string) error {
+	if !g.fs.Has(objectKey(bucket, bucketMarker)) {
+		return errNoSuchBucket
+	}
+	return nil
+}
+
+func (g *Gateway) encodeKey(key, encodingType string) string {
+	if encodingType == "url" {
+		return encodePath(key)
+	}
+	return key
+}
+
+// parseRange parses a single range of a Range header into the offset and
+// length of the requested bytes.
+func parseRange(spec string, size int64) (int64, int64, error) {
+	spec, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+
+	// bytes=-n asks for the last n bytes.
+	if len(first) == 0 {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, errInvalidRange
+		}
+		n = min(n, size)
+		return size - n, n, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, errInvalidRange
+	}
+
+	end := size - 1
+	if len(last) > 0 {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, errInvalidRange
+		}
+		end = min(end, size-1)
+	}
+
+	return start, end - start + 1, nil
+}
+
+func setObjectHeaders(w http.ResponseWriter, meta store.Metadata) {
+	w.Header().Set("ETag", etag(meta))
+	w.Header().Set("Last-Modified", meta.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "binary/octet-stream")
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+func objectKey(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// etag is the ETag of the object, the one recorded when it was stored
+// through the gateway and its checksum for the files stored otherwise.
+func etag(meta store.Metadata) string {
+	if len(meta.ETag) > 0 {
+		return `"` + meta.ETag + `"`
+	}
+	return `"` + meta.Checksum + `"`
+}
+
+func newID(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+	return nil
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, requestID string, err *apiError) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(err.StatusCode)
+		return
+	}
+
+	writeXML(w, err.StatusCode, errorResponse{
+		Code:      err.Code,
+		Message:   err.Message,
+		Resource:  r.URL.Path,
+		RequestID: requestID,
+	})
+}
@@ -0,0 +1,342 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/stretchr/testify/assert"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestObjectLifecycle(t *testing.T) {
+	srv := newTestGateway(t)
+
+	resp := do(t, srv, http.MethodPut, "/photos", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodPut, "/photos/2024/cat.png", "Hello World")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("ETag"))
+
+	resp = do(t, srv, http.MethodGet, "/photos/2024/cat.png", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Hello World", readBody(t, resp))
+
+	req := newRequest(t, srv, http.MethodGet, "/photos/2024/cat.png", "")
+	req.Header.Set("Range", "bytes=6-")
+	resp = send(t, sign(req, ""))
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 6-10/11", resp.Header.Get("Content-Range"))
+	assert.Equal(t, "World", readBody(t, resp))
+
+	resp = do(t, srv, http.MethodHead, "/photos/2024/cat.png", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(11), resp.ContentLength)
+
+	resp = do(t, srv, http.MethodDelete, "/photos/2024/cat.png", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodHead, "/photos/2024/cat.png", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodGet, "/photos/2024/cat.png", "")
+	assert.Equal(t, "NoSuchKey", errorCode(t, resp))
+
+	resp = do(t, srv, http.MethodPut, "/missing/cat.png", "Hello World")
+	assert.Equal(t, "NoSuchBucket", errorCode(t, resp))
+}
+
+func TestListObjectsV2(t *testing.T) {
+	srv := newTestGateway(t)
+
+	do(t, srv, http.MethodPut, "/photos", "")
+	for _, key := range []string{"a.png", "2023/b.png", "2024/c.png", "2024/d.png"} {
+		do(t, srv, http.MethodPut, "/photos/"+key, "data")
+	}
+
+	resp := do(t, srv, http.MethodGet, "/photos?list-type=2&delimiter=%2F", "")
+	var result listBucketResult
+	assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&result))
+	assert.Len(t, result.Contents, 1)
+	assert.Equal(t, "a.png", result.Contents[0].Key)
+	assert.Equal(t, []commonPrefixEntry{{"2023/"}, {"2024/"}}, result.CommonPrefixes)
+
+	keys := []string{}
+	token := ""
+	for {
+		path := "/photos?list-type=2&max-keys=3&prefix=20"
+		if len(token) > 0 {
+			path += "&continuation-token=" + token
+		}
+
+		var page listBucketResult
+		resp := do(t, srv, http.MethodGet, path, "")
+		assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&page))
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+
+		if !page.IsTruncated {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	assert.Equal(t, []string{"2023/b.png", "2024/c.png", "2024/d.png"}, keys)
+}
+
+// TestAWSSDK talks to the gateway the way the AWS SDK does, with path-style
+// addressing and its default checksums.
+func TestAWSSDK(t *testing.T) {
+	srv := newTestGateway(t)
+	ctx := context.Background()
+	client := awss3.New(awss3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "us-east-1",
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider(testAccessKey, testSecretKey, ""),
+	})
+
+	_, err := client.CreateBucket(ctx, &awss3.CreateBucketInput{Bucket: aws.String("photos")})
+	assert.Nil(t, err)
+
+	sum := md5.Sum([]byte("Hello World"))
+	put, err := client.PutObject(ctx, &awss3.PutObjectInput{
+		Bucket: aws.String("photos"),
+		Key:    aws.String("2024/cat.png"),
+		Body:   strings.NewReader("Hello World"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, `"`+hex.EncodeToString(sum[:])+`"`, aws.ToString(put.ETag))
+
+	get, err := client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("2024/cat.png")})
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(get.Body)
+	get.Body.Close()
+	assert.Equal(t, "Hello World", string(body))
+	assert.Equal(t, aws.ToString(put.ETag), aws.ToString(get.ETag))
+
+	list, err := client.ListObjectsV2(ctx, &awss3.ListObjectsV2Input{Bucket: aws.String("photos"), Prefix: aws.String("2024/")})
+	assert.Nil(t, err)
+	if assert.Len(t, list.Contents, 1) {
+		assert.Equal(t, "2024/cat.png", aws.ToString(list.Contents[0].Key))
+		assert.Equal(t, int64(11), aws.ToInt64(list.Contents[0].Size))
+		assert.Equal(t, aws.ToString(put.ETag), aws.ToString(list.Contents[0].ETag))
+	}
+
+	upload, err := client.CreateMultipartUpload(ctx, &awss3.CreateMultipartUploadInput{Bucket: aws.String("photos"), Key: aws.String("album.tar")})
+	assert.Nil(t, err)
+	var parts []types.CompletedPart
+	for i, part := range []string{"first ", "second"} {
+		out, err := client.UploadPart(ctx, &awss3.UploadPartInput{
+			Bucket:     aws.String("photos"),
+			Key:        aws.String("album.tar"),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)),
+			Body:       strings.NewReader(part),
+		})
+		assert.Nil(t, err)
+		parts = append(parts, types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	completed, err := client.CompleteMultipartUpload(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String("photos"),
+		Key:             aws.String("album.tar"),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	assert.Nil(t, err)
+	assert.True(t, strings.HasSuffix(aws.ToString(completed.ETag), `-2"`))
+
+	get, err = client.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String("photos"), Key: aws.String("album.tar")})
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(get.Body)
+	get.Body.Close()
+	assert.Equal(t, "first second", string(body))
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := newTestGateway(t)
+	do(t, srv, http.MethodPut, "/backups", "")
+
+	resp := do(t, srv, http.MethodPost, "/backups/db.tar?uploads", "")
+	var initiated initiateMultipartUploadResult
+	assert.Nil(t, xml.NewDecoder(resp.Body).Decode(&initiated))
+
+	complete := completeMultipartUpload{}
+	for i, part := range []string{"first ", "second ", "third"} {
+		path := fmt.Sprintf("/backups/db.tar?partNumber=%d&uploadId=%s", i+1, initiated.UploadID)
+		resp := do(t, srv, http.MethodPut, path, part)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: i + 1, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(complete)
+	resp = do(t, srv, http.MethodPost, "/backups/db.tar?uploadId="+initiated.UploadID, string(body))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodGet, "/backups/db.tar", "")
+	assert.Equal(t, "first second third", readBody(t, resp))
+}
+
+func TestSignatureVerification(t *testing.T) {
+	srv := newTestGateway(t)
+
+	req := newRequest(t, srv, http.MethodGet, "/", "")
+	resp := send(t, req)
+	assert.Equal(t, "AccessDenied", errorCode(t, resp))
+
+	req = newRequest(t, srv, http.MethodGet, "/", "")
+	sign(req, "")
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Add(time.Second).Format(amzDateFormat))
+	resp = send(t, req)
+	assert.Equal(t, "SignatureDoesNotMatch", errorCode(t, resp))
+
+	do(t, srv, http.MethodPut, "/photos", "")
+	req = newRequest(t, srv, http.MethodPut, "/photos/cat.png", "Hello World")
+	sign(req, "")
+	req.Body = io.NopCloser(strings.NewReader("Tampered!!!"))
+	resp = send(t, req)
+	assert.Equal(t, "XAmzContentSHA256Mismatch", errorCode(t, resp))
+}
+
+func TestStreamingPayload(t *testing.T) {
+	srv := newTestGateway(t)
+	do(t, srv, http.MethodPut, "/logs", "")
+
+	chunks := []string{"Hello ", "streaming ", "World"}
+
+	req := newRequest(t, srv, http.MethodPut, "/logs/app.log", "")
+	req.Header.Set("Content-Encoding", "aws-chunked")
+	sign(req, streamingPayload)
+
+	sig, apiErr := parseAuthorization(req)
+	assert.Nil(t, apiErr)
+	key := signingKey(testSecretKey, sig.date.Format("20060102"), "us-east-1")
+
+	body := new(bytes.Buffer)
+	prev := sig.signature
+	for _, chunk := range append(chunks, "") {
+		hash := sha256.Sum256([]byte(chunk))
+		toSign := strings.Join([]string{signAlgorithm + "-PAYLOAD", sig.date.Format(amzDateFormat), sig.scope, prev, emptySHA256, hex.EncodeToString(hash[:])}, "\n")
+		prev = hex.EncodeToString(hmacSHA256(key, []byte(toSign)))
+		fmt.Fprintf(body, "%x;chunk-signature=%s\r\n%s\r\n", len(chunk), prev, chunk)
+	}
+	req.Body = io.NopCloser(body)
+
+	resp := send(t, req)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodGet, "/logs/app.log", "")
+	assert.Equal(t, strings.Join(chunks, ""), readBody(t, resp))
+}
+
+func newTestGateway(t *testing.T) *httptest.Server {
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+	})
+	fs := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            cipher.NewEncryptionKey(),
+	})
+
+	gw := NewGateway(fs, GatewayOpts{
+		Credentials:  map[string]string{testAccessKey: testSecretKey},
+		MultipartDir: t.TempDir(),
+	})
+
+	srv := httptest.NewServer(gw)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newRequest(t *testing.T, srv *httptest.Server, method, path, body string) *http.Request {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// sign signs the request with the test credentials the way AWS SDKs do.
+// The payload hash defaults to the SHA-256 of the body.
+func sign(req *http.Request, payloadHash string) *http.Request {
+	if len(payloadHash) == 0 {
+		body, _ := io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(hash[:])
+	}
+
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Date", now.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	sig := &signature{
+		date:          now,
+		scope:         now.Format("20060102") + "/us-east-1/s3/aws4_request",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		payloadHash:   payloadHash,
+	}
+	key := signingKey(testSecretKey, now.Format("20060102"), "us-east-1")
+	signed := hmacSHA256(key, []byte(stringToSign(now, sig.scope, canonicalRequest(req, sig))))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, testAccessKey, sig.scope, strings.Join(sig.signedHeaders, ";"), hex.EncodeToString(signed)))
+
+	return req
+}
+
+func send(t *testing.T, req *http.Request) *http.Response {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string) *http.Response {
+	return send(t, sign(newRequest(t, srv, method, path, body), ""))
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func errorCode(t *testing.T, resp *http.Response) string {
+	var e errorResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	return e.Code
+}
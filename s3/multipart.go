@@ -0,0 +1,211 @@
+package s3
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"natneam.github.io/dfs-core/server"
+)
+
+const maxPartNumber = 10000
+
+// upload is persisted in the directory of a multipart upload so parts can
+// only be added to and completed for the key the upload was created for.
+type upload struct {
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+func (g *Gateway) createMultipartUpload(w http.ResponseWriter, bucket, key string) error {
+	uploadID := newID(16)
+
+	dir := g.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(upload{Bucket: bucket, Key: key, Initiated: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "upload.json"), data, 0o644); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, initiateMultipartUploadResult{
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+	})
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key string) error {
+	uploadID := r.URL.Query().Get("uploadId")
+	if err := g.checkUpload(uploadID, bucket, key); err != nil {
+		return err
+	}
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+		return errInvalidArgument
+	}
+
+	f, sum, err := g.spool(r, sig)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := os.Rename(f.Name(), g.partPath(uploadID, partNumber)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	w.Header().Set("ETag", `"`+sum+`"`)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *Gateway) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	uploadID := r.URL.Query().Get("uploadId")
+	if err := g.checkUpload(uploadID, bucket, key); err != nil {
+		return err
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	// The ETag of the object is the MD5 of the MD5s of its parts followed
+	// by their count, like S3 makes it.
+	readers := make([]io.Reader, 0, len(req.Parts))
+	sums := md5.New()
+	for i, part := range req.Parts {
+		if i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber {
+			return errInvalidPartOrder
+		}
+
+		f, err := os.Open(g.partPath(uploadID, part.PartNumber))
+		if err != nil {
+			return errInvalidPart
+		}
+		defer f.Close()
+
+		tag, err := partETag(f)
+		if err != nil {
+			return err
+		}
+		if strings.Trim(part.ETag, `"`) != strings.Trim(tag, `"`) {
+			return errInvalidPart
+		}
+		sum, _ := hex.DecodeString(strings.Trim(tag, `"`))
+		sums.Write(sum)
+
+		readers = append(readers, f)
+	}
+
+	tag := fmt.Sprintf("%s-%d", hex.EncodeToString(sums.Sum(nil)), len(req.Parts))
+	if err := g.fs.StoreWith(objectKey(bucket, key), io.MultiReader(readers...), server.StoreOpts{ETag: tag}); err != nil {
+		return err
+	}
+
+	meta, err := g.fs.Stat(objectKey(bucket, key))
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(g.uploadDir(uploadID)); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + objectKey(bucket, key),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag(meta),
+	})
+}
+
+func (g *Gateway) abortMultipartUpload(w http.ResponseWriter, r *http.Request) error {
+	uploadID := r.URL.Query().Get("uploadId")
+	if _, err := os.Stat(g.uploadDir(uploadID)); err != nil || !isUploadID(uploadID) {
+		return errNoSuchUpload
+	}
+
+	if err := os.RemoveAll(g.uploadDir(uploadID)); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) checkUpload(uploadID, bucket, key string) error {
+	if !isUploadID(uploadID) {
+		return errNoSuchUpload
+	}
+
+	data, err := os.ReadFile(filepath.Join(g.uploadDir(uploadID), "upload.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return errNoSuchUpload
+	}
+	if err != nil {
+		return err
+	}
+
+	var u upload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return err
+	}
+	if u.Bucket != bucket || u.Key != key {
+		return errNoSuchUpload
+	}
+
+	return nil
+}
+
+func (g *Gateway) uploadDir(uploadID string) string {
+	return filepath.Join(g.MultipartDir, uploadID)
+}
+
+func (g *Gateway) partPath(uploadID string, partNumber int) string {
+	return filepath.Join(g.uploadDir(uploadID), fmt.Sprintf("part.%05d", partNumber))
+}
+
+// isUploadID guards against upload IDs escaping the multipart directory.
+func isUploadID(uploadID string) bool {
+	_, err := hex.DecodeString(uploadID)
+	return len(uploadID) > 0 && err == nil
+}
+
+// partETag is the MD5 of the part, like S3 reports it. The file is
+// rewound afterwards.
+func partETag(f *os.File) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
@@ -0,0 +1,81 @@
+package s3
+
+import "encoding/xml"
+
+// gatewayOwner is reported as the owner of every bucket, the gateway has no
+// notion of accounts.
+var gatewayOwner = owner{ID: "dfs-core", DisplayName: "dfs-core"}
+
+type owner struct {
+	ID          string
+	DisplayName string
+}
+
+type bucketInfo struct {
+	Name         string
+	CreationDate string
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+	Region  string   `xml:",chardata"`
+}
+
+type objectEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type commonPrefixEntry struct {
+	Prefix string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name            `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string              `xml:"Name"`
+	Prefix                string              `xml:"Prefix"`
+	Delimiter             string              `xml:"Delimiter,omitempty"`
+	StartAfter            string              `xml:"StartAfter,omitempty"`
+	ContinuationToken     string              `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string              `xml:"NextContinuationToken,omitempty"`
+	EncodingType          string              `xml:"EncodingType,omitempty"`
+	KeyCount              int                 `xml:"KeyCount"`
+	MaxKeys               int                 `xml:"MaxKeys"`
+	IsTruncated           bool                `xml:"IsTruncated"`
+	Contents              []objectEntry       `xml:"Contents"`
+	CommonPrefixes        []commonPrefixEntry `xml:"CommonPrefixes"`
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// errChecksumMismatch is returned when what a peer sent doesn't match the
+// checksum it announced, the transfer is then dropped.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checksumReader reads r and fails at its end when what it read doesn't
+// match the SHA-256 checksum sum.
+type checksumReader struct {
+	r    io.Reader
+	hash hash.Hash
+	sum  string
+}
+
+// newChecksumReader returns r as is when sum is empty, the peers don't know
+// the checksum of the files stored before they were recorded.
+func newChecksumReader(r io.Reader, sum string) io.Reader {
+	if len(sum) == 0 {
+		return r
+	}
+	return &checksumReader{r: r, hash: sha256.New(), sum: sum}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err == io.EOF {
+		if sum := hex.EncodeToString(c.hash.Sum(nil)); sum != c.sum {
+			return n, fmt.Errorf("%w: got %s instead of %s", errChecksumMismatch, sum, c.sum)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,765 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/store"
+)
+
+// ErasureOpts erasure codes the stored files into DataShards data shards
+// and ParityShards parity shards, kept by as many distinct peers. Any
+// DataShards of the shards rebuild a file, so ParityShards peers can be
+// lost, for (DataShards+ParityShards)/DataShards times the size of the file
+// instead of a full copy on every peer.
+type ErasureOpts struct {
+	DataShards   int
+	ParityShards int
+}
+
+// Enabled reports whether the files are erasure coded rather than
+// replicated.
+func (o ErasureOpts) Enabled() bool {
+	return o.DataShards > 0
+}
+
+// DefaultRepairInterval is how often the shards are checked by default.
+const DefaultRepairInterval = time.Hour
+
+// shardChunk is the size of the part of every shard encoded at once. The
+// file is encoded in stripes of DataShards chunks, the last one padded with
+// zeros.
+const shardChunk = 64 * 1024
+
+// shardTimeout is how long a peer asked for a shard or a copy has to
+// answer, and may stay silent while it sends it.
+const shardTimeout = 10 * time.Second
+
+var errPeerMissing = errors.New("the peer doesn't have the file")
+
+// shardKey is the network key the peers keep the shard of key under.
+func (s *FileServer) shardKey(key string, shard int) string {
+	return fmt.Sprintf("%s.%d", s.KeyHash.HashKey(key), shard)
+}
+
+// storeErasure erasure codes the file and sends every shard to a peer of
+// its own. Only the metadata of the file, which records where the shards
+// went, is kept locally, and sent to every peer. The peers are recorded by
+// the address they listen on, which any node can reach them at. The shards
+// are spooled to temporary files first since their size has to be known
+// before they're sent.
+func (s *FileServer) storeErasure(ctx context.Context, key string, r io.Reader, opts store.WriteOpts, policy store.Policy) error {
+	k, m := policy.DataShards, policy.ParityShards
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return err
+	}
+
+	peers := s.peerList()
+	if len(peers) < k+m {
+		return fmt.Errorf("erasure coding %d+%d needs %d peers, %d are connected", k, m, k+m, len(peers))
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+
+	shards, err := tempFiles(k + m)
+	if err != nil {
+		return err
+	}
+	defer closeFiles(shards)
+
+	writers, sums := checksumWriters(shards)
+	erasure, err := encodeShards(enc, k, r, writers)
+	if err != nil {
+		return err
+	}
+	erasure.ParityShards = m
+	erasure.Peers = make([]string, k+m)
+
+	errs := s.transferAll(k+m, func(i int) error {
+		if _, err := shards[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		msg := network.StoreMessagePayload{Key: s.shardKey(key, i), Size: erasure.ShardSize, Policy: wirePolicy(policy), ExpiresAt: opts.ExpiresAt, Checksum: sums(i)}
+		return s.sendStream(ctx, peers[i], msg, shards[i])
+	})
+
+	placed := 0
+	for i, err := range errs {
+		if err != nil {
+			s.log.Warn("Failed to send a shard", "key", key, "shard", i, "peer", peers[i].RemoteAddr().String(), "err", err)
+			continue
+		}
+		erasure.Peers[i] = peers[i].ListenAddr()
+		placed++
+	}
+	// The missing shards are rebuilt by the next repair, unless too few are
+	// left to rebuild them from, and the ones placed are then of no use.
+	if placed < k {
+		s.deleteShards(key, peers, erasure)
+		return fmt.Errorf("only %d of the %d shards of %s could be placed: %w", placed, k+m, key, errors.Join(errs...))
+	}
+
+	opts.Erasure = erasure
+	if _, err := s.store.WriteWith(key, bytes.NewReader(nil), opts); err != nil {
+		return err
+	}
+	s.publish(EventStore, key, erasure.Size)
+
+	return s.replicateShardMap(ctx, key, opts, policy)
+}
+
+// encodeShards encodes what's read from r into the k data shards and the
+// parity shards written to dst.
+func encodeShards(enc reedsolomon.Encoder, k int, r io.Reader, dst []io.Writer) (*store.Erasure, error) {
+	erasure := &store.Erasure{DataShards: k}
+	hash := sha256.New()
+
+	stripe := make([]byte, k*shardChunk)
+	shards := make([][]byte, len(dst))
+	for i := k; i < len(dst); i++ {
+		shards[i] = make([]byte, shardChunk)
+	}
+
+	for {
+		n, err := io.ReadFull(r, stripe)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+
+		hash.Write(stripe[:n])
+		erasure.Size += int64(n)
+		clear(stripe[n:])
+
+		for i := range k {
+			shards[i] = stripe[i*shardChunk : (i+1)*shardChunk]
+		}
+		if err := enc.Encode(shards); err != nil {
+			return nil, err
+		}
+		for i, w := range dst {
+			if _, err := w.Write(shards[i]); err != nil {
+				return nil, err
+			}
+		}
+		erasure.ShardSize += shardChunk
+
+		if n < len(stripe) {
+			break
+		}
+	}
+
+	erasure.Checksum = hex.EncodeToString(hash.Sum(nil))
+	return erasure, nil
+}
+
+// decodeShards reads the shards of src stripe by stripe, nil for the missing
+// ones. The file is written to data and the missing shards to the writers of
+// rebuilt by their index, either can be nil.
+func decodeShards(enc reedsolomon.Encoder, erasure *store.Erasure, src []io.Reader, data io.Writer, rebuilt []io.Writer) error {
+	bufs := make([][]byte, len(src))
+	shards := make([][]byte, len(src))
+	for i := range bufs {
+		bufs[i] = make([]byte, shardChunk)
+	}
+
+	left := erasure.Size
+	for off := int64(0); off < erasure.ShardSize; off += shardChunk {
+		for i, r := range src {
+			// Empty shards are the missing ones, rebuilt in their buffer.
+			shards[i] = bufs[i][:0]
+			if r == nil {
+				continue
+			}
+			if _, err := io.ReadFull(r, bufs[i]); err != nil {
+				return fmt.Errorf("reading shard %d: %w", i, err)
+			}
+			shards[i] = bufs[i]
+		}
+
+		if rebuilt != nil {
+			if err := enc.Reconstruct(shards); err != nil {
+				return err
+			}
+		} else if err := enc.ReconstructData(shards); err != nil {
+			return err
+		}
+
+		for i, w := range rebuilt {
+			if w == nil {
+				continue
+			}
+			if _, err := w.Write(shards[i]); err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < erasure.DataShards && left > 0 && data != nil; i++ {
+			n := min(left, shardChunk)
+			if _, err := data.Write(shards[i][:n]); err != nil {
+				return err
+			}
+			left -= n
+		}
+	}
+
+	return nil
+}
+
+// getErasure rebuilds the erasure coded file from the shards kept by the
+// peers. The file is rebuilt into a temporary file which is gone once the
+// returned reader is closed.
+func (s *FileServer) getErasure(ctx context.Context, key string, erasure *store.Erasure) (int64, io.Reader, error) {
+	shards := s.fetchShards(ctx, key, erasure)
+	defer closeFiles(shards)
+
+	src, found := shardReaders(shards)
+	if found < erasure.DataShards {
+		return 0, nil, fmt.Errorf("only %d of the %d shards of %s were found, %d are needed: %w", found, len(shards), key, erasure.DataShards, ErrUnavailable)
+	}
+
+	enc, err := reedsolomon.New(erasure.DataShards, erasure.ParityShards)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	files, err := tempFiles(1)
+	if err != nil {
+		return 0, nil, err
+	}
+	out := files[0]
+
+	hash := sha256.New()
+	if err := decodeShards(enc, erasure, src, io.MultiWriter(out, hash), nil); err != nil {
+		out.Close()
+		return 0, nil, err
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); checksum != erasure.Checksum {
+		out.Close()
+		return 0, nil, fmt.Errorf("the shards of %s rebuild a file with checksum %s instead of %s", key, checksum, erasure.Checksum)
+	}
+
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return 0, nil, err
+	}
+	return erasure.Size, out, nil
+}
+
+// fetchShards asks the peers keeping the shards of key for them, and
+// returns the shards by index in temporary files, nil for the shards which
+// couldn't be fetched. The shards this node keeps itself are read from its
+// store.
+func (s *FileServer) fetchShards(ctx context.Context, key string, erasure *store.Erasure) []*os.File {
+	peers := make([]network.Peer, len(erasure.Peers))
+	keys := make([]string, len(erasure.Peers))
+	local := make([]bool, len(erasure.Peers))
+	for i, addr := range erasure.Peers {
+		keys[i] = s.shardKey(key, i)
+		if s.store.Has(keys[i]) {
+			local[i] = true
+			continue
+		}
+		if peer, ok := s.peerAt(addr); ok {
+			peers[i] = peer
+		}
+	}
+
+	files, errs := s.fetchFiles(ctx, peers, keys)
+	for i := range local {
+		if local[i] {
+			files[i], errs[i] = s.readShard(keys[i])
+		}
+	}
+	shards := make([]*os.File, len(files))
+	for i, f := range files {
+		if errs[i] == nil && f != nil && f.size != erasure.ShardSize {
+			f.Close()
+			errs[i] = fmt.Errorf("got %d bytes instead of %d", f.size, erasure.ShardSize)
+		}
+		if errs[i] != nil {
+			s.log.Warn("Shard not received", "key", key, "shard", i, "peer", erasure.Peers[i], "err", errs[i])
+			continue
+		}
+		if f != nil {
+			shards[i] = f.File
+		}
+	}
+
+	return shards
+}
+
+// readShard copies the shard this node keeps into a temporary file, as if
+// it was fetched from a peer.
+func (s *FileServer) readShard(key string) (*remoteFile, error) {
+	size, r, err := s.store.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	files, err := tempFiles(1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(files[0], r); err != nil {
+		files[0].Close()
+		return nil, err
+	}
+	if _, err := files[0].Seek(0, io.SeekStart); err != nil {
+		files[0].Close()
+		return nil, err
+	}
+	return &remoteFile{File: files[0], size: size}, nil
+}
+
+// deleteShards asks the peers to delete the shards of key placed on them.
+func (s *FileServer) deleteShards(key string, peers []network.Peer, erasure *store.Erasure) {
+	for i, addr := range erasure.Peers {
+		if len(addr) == 0 {
+			continue
+		}
+		msg, err := encodeMessage(network.DataMessage{Payload: network.DeleteMessagePayload{Key: s.shardKey(key, i)}})
+		if err == nil {
+			err = s.sendTo(peers[i], msg)
+		}
+		if err != nil {
+			s.log.Warn("Failed to delete a shard", "key", key, "shard", i, "peer", addr, "err", err)
+		}
+	}
+}
+
+// remoteFile is the copy of a file a peer sent, in a temporary file.
+type remoteFile struct {
+	*os.File
+	size       int64
+	wrappedKey []byte
+	// erasure is the shard map the peer sent along, when the file is
+	// erasure coded. The file is then empty.
+	erasure *store.Erasure
+}
+
+// fetch is a get sent to a peer, waiting for its answer.
+type fetch struct {
+	peer   string
+	answer chan network.FileMessagePayload
+}
+
+// fetchFile asks the peer for its copy of key, and returns it in a
+// temporary file.
+func (s *FileServer) fetchFile(ctx context.Context, peer network.Peer, key string) (f *remoteFile, err error) {
+	ctx, span := s.startSpan(ctx, "network stream", attrKey.String(key), attrPeer.String(peer.RemoteAddr().String()))
+	defer func() {
+		if err == nil {
+			span.SetAttributes(attrBytes.Int64(f.size))
+		}
+		endSpan(span, err)
+	}()
+
+	id, answer := s.expectAnswer(peer)
+	msg, err := encodeMessage(network.DataMessage{
+		Payload: network.GetMessagePayload{ID: id, Key: key, Background: isBackground(ctx)},
+		Trace:   injectTrace(ctx),
+	})
+	if err == nil {
+		err = s.sendTo(peer, msg)
+	}
+	if err != nil {
+		s.dropAnswer(id)
+		return nil, err
+	}
+
+	timer := time.NewTimer(shardTimeout)
+	defer timer.Stop()
+	select {
+	case a := <-answer:
+		return s.receiveFile(ctx, peer, a)
+	case <-timer.C:
+		err = fmt.Errorf("no answer within %s", shardTimeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-s.quitchan:
+		err = ErrServerClosed
+	}
+	if s.dropAnswer(id) {
+		return nil, err
+	}
+	// The answer came in meanwhile.
+	return s.receiveFile(ctx, peer, <-answer)
+}
+
+// fetchFiles asks every peer for the file of its key, by index, and returns
+// their answers with the errors of the fetches. Both are nil for the nil
+// peers.
+func (s *FileServer) fetchFiles(ctx context.Context, peers []network.Peer, keys []string) ([]*remoteFile, []error) {
+	files := make([]*remoteFile, len(peers))
+	errs := make([]error, len(peers))
+
+	wg := sync.WaitGroup{}
+	for i, peer := range peers {
+		if peer == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			files[i], errs[i] = s.fetchFile(ctx, peer, keys[i])
+		}()
+	}
+	wg.Wait()
+
+	return files, errs
+}
+
+// expectAnswer registers a get sent to the peer, its answer comes on the
+// returned channel.
+func (s *FileServer) expectAnswer(peer network.Peer) (uint64, chan network.FileMessagePayload) {
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+
+	s.fetchID++
+	f := &fetch{peer: peer.RemoteAddr().String(), answer: make(chan network.FileMessagePayload, 1)}
+	s.fetches[s.fetchID] = f
+	return s.fetchID, f.answer
+}
+
+// dropAnswer gives up on the answer of a get, it's false when the answer
+// came already.
+func (s *FileServer) dropAnswer(id uint64) bool {
+	s.fetchLock.Lock()
+	defer s.fetchLock.Unlock()
+
+	_, ok := s.fetches[id]
+	delete(s.fetches, id)
+	return ok
+}
+
+// handleMessageFile hands the answer of a get over to the fetch waiting for
+// it, which reads the stream following it. The stream of an answer nobody
+// waits for anymore is skipped.
+func (s *FileServer) handleMessageFile(from string, msg network.FileMessagePayload) error {
+	s.fetchLock.Lock()
+	f, ok := s.fetches[msg.ID]
+	if ok && f.peer == from {
+		delete(s.fetches, msg.ID)
+	}
+	s.fetchLock.Unlock()
+
+	if ok && f.peer == from {
+		f.answer <- msg
+		return nil
+	}
+	if msg.Missing {
+		return nil
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+	}
+	defer peer.CloseStream()
+	r := newIdleReader(peer, shardTimeout)
+	defer r.Stop()
+	_, err := io.CopyN(io.Discard, r, msg.Size)
+	return err
+}
+
+// receiveFile reads the file of the answer of a peer to a get into a
+// temporary file.
+func (s *FileServer) receiveFile(ctx context.Context, peer network.Peer, answer network.FileMessagePayload) (*remoteFile, error) {
+	if answer.Missing {
+		return nil, errPeerMissing
+	}
+	defer peer.CloseStream()
+	defer s.trackTransfer()()
+
+	// Whatever happens, the rest of the stream is read and the peer's
+	// messages are read again. A peer which stops sending is dropped.
+	idle := newIdleReader(peer, shardTimeout)
+	defer idle.Stop()
+	in := io.LimitReader(s.limitReader(idle, peer.RemoteAddr().String(), isBackground(ctx)), answer.Size)
+	defer io.Copy(io.Discard, in)
+
+	var erasure *store.Erasure
+	if len(answer.Erasure) > 0 {
+		erasure = &store.Erasure{}
+		if err := json.Unmarshal(answer.Erasure, erasure); err != nil {
+			return nil, fmt.Errorf("bad shard map: %w", err)
+		}
+	}
+
+	files, err := tempFiles(1)
+	if err != nil {
+		return nil, err
+	}
+	f := files[0]
+
+	// The checksum is the one of the file the peer keeps.
+	decrypted, err := cipher.NewDecryptReader(s.EncKey, in)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	n, err := io.Copy(f, newChecksumReader(decrypted, answer.Checksum))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &remoteFile{File: f, size: n, wrappedKey: answer.WrappedKey, erasure: erasure}, nil
+}
+
+// idleReader reads the stream of a peer, and closes the connection of the
+// peer when nothing comes for timeout so the read fails instead of waiting
+// forever.
+type idleReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleReader(peer network.Peer, timeout time.Duration) *idleReader {
+	return &idleReader{
+		r:       peer,
+		timer:   time.AfterFunc(timeout, func() { peer.Close() }),
+		timeout: timeout,
+	}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+// Stop stops watching the peer once the stream was read.
+func (r *idleReader) Stop() {
+	r.timer.Stop()
+}
+
+// replicateShardMap sends the shard map of the erasure coded file to every
+// peer, which keeps it under the hashed key like a copy of the file, so the
+// file can be rebuilt from any of them and not only from this node.
+func (s *FileServer) replicateShardMap(ctx context.Context, key string, opts store.WriteOpts, policy store.Policy) error {
+	manifest, err := json.Marshal(opts.Erasure)
+	if err != nil {
+		return err
+	}
+
+	peers := s.peerList()
+	errs := s.transferAll(len(peers), func(i int) error {
+		return s.sendStream(ctx, peers[i], network.StoreMessagePayload{
+			Key:        s.KeyHash.HashKey(key),
+			WrappedKey: opts.WrappedKey,
+			Policy:     wirePolicy(policy),
+			ExpiresAt:  opts.ExpiresAt,
+			Erasure:    manifest,
+		}, bytes.NewReader(nil))
+	})
+
+	return errors.Join(errs...)
+}
+
+// RepairShards checks the shards of every erasure coded file, and rebuilds
+// the missing ones on peers which don't keep a shard of the file yet.
+func (s *FileServer) RepairShards() error {
+	list, err := s.store.List("")
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	now := time.Now()
+	for _, meta := range list {
+		// The expired files are left to the reaper, and the copies of the
+		// shard maps to the node the file was stored on.
+		if meta.Erasure == nil || meta.Erasure.Replica || meta.Expired(now) {
+			continue
+		}
+		if err := s.repairFile(meta); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", meta.Key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *FileServer) repairFile(meta store.Metadata) (err error) {
+	ctx, span := s.startSpan(withBackground(context.Background()), "Repair", attrKey.String(meta.Key))
+	defer func() { endSpan(span, err) }()
+
+	erasure := meta.Erasure
+	shards := s.fetchShards(ctx, meta.Key, erasure)
+	defer closeFiles(shards)
+
+	src, found := shardReaders(shards)
+	if found == len(shards) {
+		return nil
+	}
+	if found < erasure.DataShards {
+		return fmt.Errorf("only %d of the %d shards were found, %d are needed", found, len(shards), erasure.DataShards)
+	}
+
+	// The rebuilt shards go to peers keeping none of the others, so every
+	// peer still keeps a single shard of the file.
+	holders := map[string]bool{}
+	for i, addr := range erasure.Peers {
+		if shards[i] != nil {
+			holders[addr] = true
+		}
+	}
+	candidates := []network.Peer{}
+	for _, peer := range s.peerList() {
+		if !holders[peer.ListenAddr()] {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	rebuilt := make([]io.Writer, len(shards))
+	missing := []int{}
+	for i := range shards {
+		if shards[i] == nil && len(missing) < len(candidates) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return fmt.Errorf("%d shards are missing but no peer is left to keep them", len(shards)-found)
+	}
+
+	files, err := tempFiles(len(missing))
+	if err != nil {
+		return err
+	}
+	defer closeFiles(files)
+	writers, sums := checksumWriters(files)
+	for j, i := range missing {
+		rebuilt[i] = writers[j]
+	}
+
+	enc, err := reedsolomon.New(erasure.DataShards, erasure.ParityShards)
+	if err != nil {
+		return err
+	}
+	if err := decodeShards(enc, erasure, src, nil, rebuilt); err != nil {
+		return err
+	}
+
+	errs := s.transferAll(len(missing), func(j int) error {
+		if _, err := files[j].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		msg := network.StoreMessagePayload{Key: s.shardKey(meta.Key, missing[j]), Size: erasure.ShardSize, Policy: wirePolicy(s.PolicyFor(meta.Key)), ExpiresAt: meta.ExpiresAt, Checksum: sums(j)}
+		return s.sendStream(ctx, candidates[j], msg, files[j])
+	})
+	for j, i := range missing {
+		if errs[j] == nil {
+			erasure.Peers[i] = candidates[j].ListenAddr()
+		}
+	}
+
+	opts := store.WriteOpts{WrappedKey: meta.WrappedKey, Erasure: erasure, ExpiresAt: meta.ExpiresAt}
+	if _, err := s.store.WriteWith(meta.Key, bytes.NewReader(nil), opts); err != nil {
+		return err
+	}
+	s.log.Info("Rebuilt shards", "key", meta.Key, "count", len(missing))
+	errs = append(errs, s.replicateShardMap(ctx, meta.Key, opts, s.PolicyFor(meta.Key)))
+
+	return errors.Join(errs...)
+}
+
+// repairLoop repairs the shards every RepairInterval until the server
+// stops.
+func (s *FileServer) repairLoop() {
+	interval := s.RepairInterval
+	if interval <= 0 {
+		interval = DefaultRepairInterval
+	}
+	s.registerJob(JobRepair, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.runJob(JobRepair, s.RepairShards); err != nil {
+				s.log.Error("Shard repair failed", "err", err)
+			}
+		case <-s.quitchan:
+			return
+		}
+	}
+}
+
+// shardReaders returns the readers of the fetched shards, nil for the
+// missing ones, and how many there are.
+func shardReaders(shards []*os.File) ([]io.Reader, int) {
+	src := make([]io.Reader, len(shards))
+	found := 0
+	for i, f := range shards {
+		if f != nil {
+			src[i] = f
+			found++
+		}
+	}
+	return src, found
+}
+
+// checksumWriters returns writers to the files which hash what's written,
+// and the function returning the checksum of the file of an index.
+func checksumWriters(files []*os.File) ([]io.Writer, func(i int) string) {
+	writers := make([]io.Writer, len(files))
+	hashes := make([]hash.Hash, len(files))
+	for i, f := range files {
+		hashes[i] = sha256.New()
+		writers[i] = io.MultiWriter(f, hashes[i])
+	}
+	return writers, func(i int) string {
+		return hex.EncodeToString(hashes[i].Sum(nil))
+	}
+}
+
+// tempFiles creates n temporary files which are removed right away, they're
+// gone once closed.
+func tempFiles(n int) ([]*os.File, error) {
+	files := make([]*os.File, 0, n)
+	for range n {
+		f, err := os.CreateTemp("", "dfs-shard-*")
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		os.Remove(f.Name())
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
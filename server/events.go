@@ -0,0 +1,78 @@
+package server
+
+import "time"
+
+// subscriberBuffer is how many events a subscriber may lag behind before
+// new events are dropped for it.
+const subscriberBuffer = 64
+
+type EventType int
+
+const (
+	// EventStore is emitted when a file is written to the local server,
+	// whether stored by a client, replicated from a peer or fetched from
+	// the network.
+	EventStore EventType = iota + 1
+	// EventDelete is emitted when a file is removed from the local server.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStore:
+		return "store"
+	case EventDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// Event describes a change to the files held by the local server.
+type Event struct {
+	Type EventType
+	Key  string
+	Size int64
+	Time time.Time
+}
+
+// Subscribe returns a channel receiving the events of the local server and
+// a function to cancel the subscription. Events are dropped rather than
+// blocking the server when the subscriber doesn't keep up.
+func (s *FileServer) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+
+	s.subscriberLock.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.subscriberLock.Unlock()
+
+	cancel := func() {
+		s.subscriberLock.Lock()
+		defer s.subscriberLock.Unlock()
+
+		if _, ok := s.subscribers[ch]; ok {
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+func (s *FileServer) publish(typ EventType, key string, size int64) {
+	ev := Event{
+		Type: typ,
+		Key:  key,
+		Size: size,
+		Time: time.Now().UTC(),
+	}
+
+	s.subscriberLock.Lock()
+	defer s.subscriberLock.Unlock()
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
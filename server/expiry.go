@@ -0,0 +1,83 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"natneam.github.io/dfs-core/network"
+)
+
+// DefaultReapInterval is how often the expired files are deleted by default.
+const DefaultReapInterval = time.Minute
+
+// Reap deletes the local files which expired, and sends a tombstone of each
+// to the peers so their copies go as well, and returns how many it deleted.
+// Every node reaps its own copies, the tombstones only hurry the peers up.
+func (s *FileServer) Reap() (int, error) {
+	list, err := s.store.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	reaped := 0
+	errs := []error{}
+	now := time.Now()
+	for _, meta := range list {
+		if !meta.Expired(now) {
+			continue
+		}
+		if err := s.Delete(meta.Key); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", meta.Key, err))
+			continue
+		}
+		reaped++
+
+		keys := []string{s.KeyHash.HashKey(meta.Key)}
+		if meta.Erasure != nil && !meta.Erasure.Replica {
+			for i := range meta.Erasure.Peers {
+				keys = append(keys, s.shardKey(meta.Key, i))
+			}
+		}
+		for _, key := range keys {
+			msg := network.DataMessage{
+				Payload: network.DeleteMessagePayload{Key: key, ExpiresAt: meta.ExpiresAt},
+			}
+			if err := s.broadcast(msg); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", meta.Key, err))
+			}
+		}
+	}
+
+	return reaped, errors.Join(errs...)
+}
+
+func (s *FileServer) reapLoop() {
+	interval := s.ReapInterval
+	if interval <= 0 {
+		interval = DefaultReapInterval
+	}
+	s.registerJob(JobReap, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var n int
+			err := s.runJob(JobReap, func() (err error) {
+				n, err = s.Reap()
+				return err
+			})
+			if n > 0 {
+				s.log.Info("Deleted expired files", "count", n)
+			}
+			if err != nil {
+				s.log.Error("Expiration failed", "err", err)
+			}
+		case <-s.quitchan:
+			return
+		}
+	}
+}
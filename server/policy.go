@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/store"
+)
+
+// policyTable holds the policies of the cluster by prefix, including the
+// deleted ones. Every node keeps a copy, the changes are spread to the
+// peers and the latest change of a prefix wins.
+type policyTable struct {
+	mu       sync.RWMutex
+	policies map[string]store.Policy
+	// path is the file the table is saved to, if any.
+	path string
+}
+
+func newPolicyTable(path string) (*policyTable, error) {
+	t := &policyTable{policies: make(map[string]store.Policy), path: path}
+	if len(path) == 0 {
+		return t, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	policies := []store.Policy{}
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, p := range policies {
+		t.policies[p.Prefix] = p
+	}
+	return t, nil
+}
+
+// match returns the policy with the longest prefix of key.
+func (t *policyTable) match(key string) (store.Policy, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var best store.Policy
+	found := false
+	for prefix, p := range t.policies {
+		if p.Deleted || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if !found || len(prefix) > len(best.Prefix) {
+			best, found = p, true
+		}
+	}
+	return best, found
+}
+
+func (t *policyTable) get(prefix string) (store.Policy, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	p, ok := t.policies[prefix]
+	return p, ok
+}
+
+// merge records p unless the table has a later change of its prefix, and
+// reports whether it did.
+func (t *policyTable) merge(p store.Policy) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if current, ok := t.policies[p.Prefix]; ok && !p.UpdatedAt.After(current.UpdatedAt) {
+		return false, nil
+	}
+	t.policies[p.Prefix] = p
+
+	return true, t.save()
+}
+
+// list returns the policies sorted by prefix, with the deleted ones when
+// deleted is set.
+func (t *policyTable) list(deleted bool) []store.Policy {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	list := []store.Policy{}
+	for _, p := range t.policies {
+		if deleted || !p.Deleted {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Prefix < list[j].Prefix })
+
+	return list
+}
+
+// save writes the table to its file, the caller holds the lock.
+func (t *policyTable) save() error {
+	if len(t.path) == 0 {
+		return nil
+	}
+
+	policies := make([]store.Policy, 0, len(t.policies))
+	for _, p := range t.policies {
+		policies = append(policies, p)
+	}
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.path)
+}
+
+// SetPolicy sets the policy of the keys starting with p.Prefix, on this
+// node and on the rest of the cluster. It applies to the files stored from
+// then on.
+func (s *FileServer) SetPolicy(p store.Policy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	p.UpdatedAt = time.Now().UTC()
+	p.Deleted = false
+	return s.changePolicy(p)
+}
+
+// DeletePolicy removes the policy of prefix, the files are then stored
+// under the policy of the next shorter prefix, or the default one.
+func (s *FileServer) DeletePolicy(prefix string) error {
+	if p, ok := s.policies.get(prefix); !ok || p.Deleted {
+		return fmt.Errorf("no policy for %q", prefix)
+	}
+
+	return s.changePolicy(store.Policy{Prefix: prefix, UpdatedAt: time.Now().UTC(), Deleted: true})
+}
+
+// Policies returns the policies of the cluster, sorted by prefix.
+func (s *FileServer) Policies() []store.Policy {
+	return s.policies.list(false)
+}
+
+// PolicyFor returns the policy the file of key is stored under, the
+// default one is made of the options of the server.
+func (s *FileServer) PolicyFor(key string) store.Policy {
+	if p, ok := s.policies.match(key); ok {
+		return p
+	}
+
+	return store.Policy{
+		DataShards:   s.Erasure.DataShards,
+		ParityShards: s.Erasure.ParityShards,
+		Compression:  s.Compression,
+	}
+}
+
+func (s *FileServer) changePolicy(p store.Policy) error {
+	if _, err := s.policies.merge(p); err != nil {
+		return err
+	}
+
+	return s.broadcast(network.DataMessage{Payload: network.PolicyMessagePayload{Policy: wirePolicy(p)}})
+}
+
+// wirePolicy returns the policy as it's sent to the peers.
+func wirePolicy(p store.Policy) network.Policy {
+	return network.Policy{
+		Prefix:       p.Prefix,
+		Replicas:     p.Replicas,
+		DataShards:   p.DataShards,
+		ParityShards: p.ParityShards,
+		Plaintext:    p.Plaintext,
+		Compression:  p.Compression,
+		TTL:          p.TTL,
+		UpdatedAt:    p.UpdatedAt,
+		Deleted:      p.Deleted,
+	}
+}
+
+// storePolicy returns the policy a peer sent.
+func storePolicy(p network.Policy) store.Policy {
+	return store.Policy{
+		Prefix:       p.Prefix,
+		Replicas:     p.Replicas,
+		DataShards:   p.DataShards,
+		ParityShards: p.ParityShards,
+		Plaintext:    p.Plaintext,
+		Compression:  p.Compression,
+		TTL:          p.TTL,
+		UpdatedAt:    p.UpdatedAt,
+		Deleted:      p.Deleted,
+	}
+}
+
+// handleMessagePolicy records a change of the policies and passes it on to
+// the other peers, unless it's known already.
+func (s *FileServer) handleMessagePolicy(from string, msg network.PolicyMessagePayload) error {
+	changed, err := s.policies.merge(storePolicy(msg.Policy))
+	if err != nil || !changed {
+		return err
+	}
+
+	buf, err := encodeMessage(network.DataMessage{Payload: msg})
+	if err != nil {
+		return err
+	}
+	for _, peer := range s.peerList() {
+		if peer.RemoteAddr().String() == from {
+			continue
+		}
+		if err := s.sendTo(peer, buf); err != nil {
+			s.log.Warn("Failed to pass the policy on", "prefix", msg.Policy.Prefix, "peer", peer.RemoteAddr().String(), "err", err)
+		}
+	}
+
+	return nil
+}
+
+// sendPolicies sends the whole policy table to a new peer, a message per
+// policy.
+func (s *FileServer) sendPolicies(peer network.Peer) {
+	for _, p := range s.policies.list(true) {
+		buf, err := encodeMessage(network.DataMessage{Payload: network.PolicyMessagePayload{Policy: wirePolicy(p)}})
+		if err == nil {
+			err = s.sendTo(peer, buf)
+		}
+		if err != nil {
+			s.log.Warn("Failed to send the policies", "peer", peer.RemoteAddr().String(), "err", err)
+			return
+		}
+	}
+}
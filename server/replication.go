@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/store"
+)
+
+// DefaultTransferMemory is the default memory budget of a transfer.
+const DefaultTransferMemory = 1 << 20
+
+// streamMemory is the memory used to stream a file to a single peer, the
+// encryption buffer and the buffer in front of the connection.
+const streamMemory = 2 * 32 * 1024
+
+// replicate streams the local copy of key to every peer. Each peer gets its
+// own reader of the file, so a slow peer only holds back its own stream
+// instead of the whole transfer, and TCP flow control slows the reads down
+// to the pace of the peer. As many streams run at once as the transfer
+// memory allows.
+//
+// The policy of the file tells how many peers get a copy, and how they keep
+// it.
+func (s *FileServer) replicate(ctx context.Context, key string, size int64, opts store.WriteOpts, policy store.Policy) (err error) {
+	ctx, span := s.startSpan(ctx, "replicate", attrKey.String(key))
+	defer func() { endSpan(span, err) }()
+
+	meta, err := s.store.Stat(key)
+	if err != nil {
+		return err
+	}
+
+	peers := s.peerList()
+	if policy.Replicas > 0 && policy.Replicas < len(peers) {
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+		peers = peers[:policy.Replicas]
+	}
+
+	start := time.Now()
+	errs := s.transferAll(len(peers), func(i int) error {
+		if err := s.sendFile(ctx, peers[i], key, size, meta.Checksum, opts, policy); err != nil {
+			return fmt.Errorf("failed to send file content to %s: %s", peers[i].RemoteAddr(), err)
+		}
+		s.Metrics.ReplicationLag.Observe(time.Since(start).Seconds())
+		return nil
+	})
+
+	return errors.Join(errs...)
+}
+
+// transferAll runs the n transfers of send at once, as many at a time as
+// the transfer memory allows, and returns their errors by index.
+func (s *FileServer) transferAll(n int, send func(i int) error) []error {
+	budget := s.TransferMemory
+	if budget <= 0 {
+		budget = DefaultTransferMemory
+	}
+	sem := make(chan struct{}, max(1, budget/streamMemory))
+
+	errs := make([]error, n)
+	wg := sync.WaitGroup{}
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			errs[i] = send(i)
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// sendFile streams the local copy of key, encrypted, to the peer. checksum
+// is the one of the file, recorded by the store.
+func (s *FileServer) sendFile(ctx context.Context, peer network.Peer, key string, size int64, checksum string, opts store.WriteOpts, policy store.Policy) error {
+	_, r, err := s.store.Read(key)
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	return s.sendStream(ctx, peer, network.StoreMessagePayload{
+		Key:        s.KeyHash.HashKey(key),
+		Size:       size,
+		WrappedKey: opts.WrappedKey,
+		Policy:     wirePolicy(policy),
+		ExpiresAt:  opts.ExpiresAt,
+		Checksum:   checksum,
+	}, r)
+}
+
+// sendStream streams msg.Size bytes of r, encrypted, to the peer which
+// stores them as msg says. The peer checks what it decrypts against
+// msg.Checksum, the checksum of what's read from r.
+func (s *FileServer) sendStream(ctx context.Context, peer network.Peer, msg network.StoreMessagePayload, r io.Reader) (err error) {
+	ctx, span := s.startSpan(ctx, "network stream", attrKey.String(msg.Key), attrPeer.String(peer.RemoteAddr().String()))
+	defer func() { endSpan(span, err) }()
+	defer s.trackTransfer()()
+
+	msg.Size += cipher.IVSize // Because of the IV prepended to the stream
+	msg.Background = isBackground(ctx)
+	enc, err := cipher.NewEncryptReader(s.EncKey, r)
+	if err != nil {
+		return err
+	}
+
+	msgBuf, err := encodeMessage(network.DataMessage{Payload: msg, Trace: injectTrace(ctx)})
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockPeer(peer)
+	defer unlock()
+
+	if err := peer.Send(network.EncodeStream(msgBuf)); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriterSize(s.limitWriter(peer, peer.RemoteAddr().String(), msg.Background), streamMemory/2)
+	if _, err := io.CopyN(w, enc, msg.Size); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+// peerList returns the connected peers.
+func (s *FileServer) peerList() []network.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]network.Peer, 0, len(s.peers))
+	for addr, peer := range s.peers {
+		if s.health[addr].leaving {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func (s *FileServer) peer(addr string) (network.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// peerAt returns the peer listening on addr, as the shard maps record it.
+func (s *FileServer) peerAt(addr string) (network.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for _, peer := range s.peers {
+		if peer.ListenAddr() == addr {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// lockPeer gives the caller the exclusive use of the connection to the peer
+// until the returned function is called.
+func (s *FileServer) lockPeer(peer network.Peer) func() {
+	s.peerLock.Lock()
+	lock, ok := s.sendLocks[peer.RemoteAddr().String()]
+	s.peerLock.Unlock()
+
+	if !ok {
+		return func() {}
+	}
+
+	lock.Lock()
+	return lock.Unlock
+}
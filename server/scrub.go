@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/store"
+)
+
+// DefaultScrubInterval is how often the files are scrubbed by default.
+const DefaultScrubInterval = 24 * time.Hour
+
+// ErrScrubRunning is returned when starting a scrub while one is running.
+var ErrScrubRunning = errors.New("a scrub is running already")
+
+// ScrubStatus is the progress and the findings of the running or the last
+// scrub.
+type ScrubStatus struct {
+	Running    bool      `json:"running"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// Total is the number of files the scrub checks, Checked the number it
+	// checked so far.
+	Total   int `json:"total"`
+	Checked int `json:"checked"`
+	// Findings are the corrupted copies found.
+	Findings []ScrubFinding `json:"findings"`
+}
+
+// ScrubFinding is a corrupted copy found by a scrub.
+type ScrubFinding struct {
+	Key string `json:"key"`
+	// Error is what's wrong with the copy.
+	Error string `json:"error"`
+	// Quarantine is where the copy was moved to, it's empty when the
+	// backend could only delete it.
+	Quarantine string `json:"quarantine,omitempty"`
+	// Repaired is set when a good copy was fetched from a peer.
+	Repaired bool `json:"repaired"`
+}
+
+// quarantiner is a backend which can set corrupted blobs aside.
+type quarantiner interface {
+	Quarantine(key string) (string, error)
+}
+
+// Scrub reads every local file back and checks it against its checksum.
+// The corrupted copies are quarantined and replaced with a good copy of a
+// peer. It returns once every file is checked.
+func (s *FileServer) Scrub() (ScrubStatus, error) {
+	list, err := s.beginScrub()
+	if err != nil {
+		return ScrubStatus{}, err
+	}
+
+	return s.scrub(list), nil
+}
+
+// StartScrub runs a scrub in the background, unless one is running.
+func (s *FileServer) StartScrub() error {
+	list, err := s.beginScrub()
+	if err != nil {
+		return err
+	}
+
+	go s.scrub(list)
+	return nil
+}
+
+// ScrubProgress returns the status of the running or the last scrub.
+func (s *FileServer) ScrubProgress() ScrubStatus {
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+
+	status := s.scrubStatus
+	status.Findings = slices.Clone(status.Findings)
+	return status
+}
+
+func (s *FileServer) beginScrub() ([]store.Metadata, error) {
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+
+	if s.scrubStatus.Running {
+		return nil, ErrScrubRunning
+	}
+	list, err := s.store.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	s.scrubStatus = ScrubStatus{Running: true, StartedAt: time.Now().UTC(), Total: len(list)}
+	return list, nil
+}
+
+func (s *FileServer) scrub(list []store.Metadata) ScrubStatus {
+	for _, meta := range list {
+		err := store.Verify(s.store, meta.Key)
+		switch {
+		case errors.Is(err, store.ErrCorrupt):
+			s.log.Warn("Corrupted copy", "key", meta.Key, "err", err)
+			finding := s.scrubFile(meta, err)
+			s.scrubLock.Lock()
+			s.scrubStatus.Findings = append(s.scrubStatus.Findings, finding)
+			s.scrubLock.Unlock()
+		case err != nil && !errors.Is(err, os.ErrNotExist):
+			// The files deleted since the scrub started are skipped.
+			s.log.Error("Failed to scrub", "key", meta.Key, "err", err)
+		}
+
+		s.scrubLock.Lock()
+		s.scrubStatus.Checked++
+		s.scrubLock.Unlock()
+	}
+
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+	s.scrubStatus.Running = false
+	s.scrubStatus.FinishedAt = time.Now().UTC()
+
+	status := s.scrubStatus
+	status.Findings = slices.Clone(status.Findings)
+	return status
+}
+
+// scrubFile sets the corrupted copy of meta aside and replaces it with a
+// good copy of a peer.
+func (s *FileServer) scrubFile(meta store.Metadata, cause error) ScrubFinding {
+	finding := ScrubFinding{Key: meta.Key, Error: cause.Error()}
+
+	var err error
+	if q, ok := s.store.(quarantiner); ok {
+		finding.Quarantine, err = q.Quarantine(meta.Key)
+	} else {
+		err = s.store.Delete(meta.Key)
+	}
+	if err != nil {
+		finding.Error = fmt.Sprintf("%s, and it couldn't be set aside: %s", finding.Error, err)
+		return finding
+	}
+
+	if err := s.refetch(meta); err != nil {
+		s.log.Error("No good copy found", "key", meta.Key, "err", err)
+		return finding
+	}
+	finding.Repaired = true
+
+	return finding
+}
+
+// refetch asks the peers one at a time for their copy of the file, until
+// one matches the checksum of meta, and stores it back as meta says. The
+// peers keep the file under its hashed key when this node is the one it was
+// stored on, and under the same key otherwise.
+func (s *FileServer) refetch(meta store.Metadata) error {
+	for _, peer := range s.peerList() {
+		for _, key := range []string{s.KeyHash.HashKey(meta.Key), meta.Key} {
+			err := s.fetchCopy(peer, key, meta)
+			if err == nil {
+				return nil
+			}
+			if !errors.Is(err, errPeerMissing) {
+				s.log.Warn("Bad copy from a peer", "key", meta.Key, "peer", peer.RemoteAddr().String(), "err", err)
+			}
+		}
+	}
+
+	return errors.New("no peer has a good copy")
+}
+
+func (s *FileServer) fetchCopy(peer network.Peer, key string, meta store.Metadata) error {
+	// The scrub is the only one fetching copies, so they come within the
+	// background bandwidth.
+	f, err := s.fetchFile(withBackground(context.Background()), peer, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != meta.Checksum {
+		return fmt.Errorf("%w: got %s instead of %s", store.ErrCorrupt, sum, meta.Checksum)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err = s.store.WriteWith(meta.Key, f, store.WriteOpts{
+		WrappedKey:  meta.WrappedKey,
+		Plaintext:   !meta.Encrypted,
+		ExpiresAt:   meta.ExpiresAt,
+		Compression: meta.Compression,
+		Replica:     meta.Replica,
+	})
+	return err
+}
+
+func (s *FileServer) scrubLoop() {
+	interval := s.ScrubInterval
+	if interval <= 0 {
+		interval = DefaultScrubInterval
+	}
+	s.registerJob(JobScrub, interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var status ScrubStatus
+			err := s.runJob(JobScrub, func() (err error) {
+				status, err = s.Scrub()
+				return err
+			})
+			if err != nil {
+				s.log.Error("Scrub failed", "err", err)
+				continue
+			}
+			if len(status.Findings) > 0 {
+				s.log.Warn("Scrub found corrupted files", "corrupted", len(status.Findings), "checked", status.Checked)
+			}
+		case <-s.quitchan:
+			return
+		}
+	}
+}
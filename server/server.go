@@ -2,55 +2,230 @@ package server
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/metrics"
 	"natneam.github.io/dfs-core/network"
 	"natneam.github.io/dfs-core/store"
 )
 
+// ErrServerClosed is returned by the calls made once the server is shutting
+// down.
+var ErrServerClosed = errors.New("server closed")
+
+// ErrNotFound is returned by Get when neither the node nor its peers have
+// the file.
+var ErrNotFound = errors.New("file not found")
+
+// ErrUnavailable is returned by Get when the file couldn't be fetched from
+// the peers which may have it.
+var ErrUnavailable = errors.New("file unavailable")
+
 type FileServerOpts struct {
 	StorageRoot       string
 	Transporter       network.Transporter
 	PathTransformFunc store.PathTransformFunc
 	BootstrapNodes    []string
 	EncKey            []byte
+	// StorageKey encrypts the files at rest, on every node they're stored
+	// on. Files are stored in clear when it's nil.
+	StorageKey []byte
+	// TransferMemory is the memory in bytes a single transfer may use to
+	// send a file to the peers, it limits how many peers are sent to at
+	// once. Defaults to DefaultTransferMemory.
+	TransferMemory int64
+	// KeyHash hashes the keys of the files sent to peers, and lays the
+	// files out on disk when PathTransformFunc is nil. Every node of the
+	// network has to use the same one. Defaults to cipher.SHA256.
+	KeyHash cipher.KeyHash
+	// Backend keeps the files of the node. Defaults to a store.Store at
+	// StorageRoot, laid out by PathTransformFunc and encrypted with
+	// StorageKey, which only configure that default.
+	Backend store.Backend
+	// Erasure erasure codes the files instead of replicating them to
+	// every peer, when its DataShards are set.
+	Erasure ErasureOpts
+	// RepairInterval is how often the shards of the erasure coded files
+	// are checked and the missing ones rebuilt. Defaults to
+	// DefaultRepairInterval.
+	RepairInterval time.Duration
+	// PolicyFile keeps the policies of the cluster, they're only kept in
+	// memory when it's empty.
+	PolicyFile string
+	// ReapInterval is how often the expired files are deleted. Defaults
+	// to DefaultReapInterval.
+	ReapInterval time.Duration
+	// Compression is the algorithm the files are compressed with at rest
+	// unless their policy says otherwise, see store.Compressions.
+	Compression string
+	// ScrubInterval is how often the files are read back and checked
+	// against their checksum. Defaults to DefaultScrubInterval.
+	ScrubInterval time.Duration
+	// Logger logs what the server does, with the address of the node.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// Metrics count what the server does, share them with the
+	// TCPTransporter to expose them. Defaults to metrics of their own.
+	Metrics *metrics.Metrics
+	// TracerProvider traces the reads and the writes across the nodes.
+	// Defaults to the global provider of otel.
+	TracerProvider trace.TracerProvider
+	// HeartbeatInterval is how often the peers are pinged, to measure the
+	// round trip time and to spot the unresponsive ones. Defaults to
+	// DefaultHeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// Bandwidth limits the bytes per second of the transfers with the
+	// peers, in both directions. Unlimited by default.
+	Bandwidth BandwidthLimits
+}
+
+// StoreOpts are the options of a file being stored.
+type StoreOpts struct {
+	// WrappedKey is the data key of a file the client encrypted end to
+	// end, wrapped by the client's key.
+	WrappedKey []byte
+	// TTL is how long the file is kept, it overrides the TTL of the
+	// policy of the file when it's set.
+	TTL time.Duration
+	// ETag is the entity tag recorded in the metadata of the file.
+	ETag string
 }
 
 type FileServer struct {
 	FileServerOpts
 
+	// peerLock guards the peers and the BootstrapNodes, which change
+	// along with them.
 	peerLock sync.Mutex
 	peers    map[string]network.Peer
-
-	store    *store.Store
+	health   map[string]*peerHealth
+	// sendLocks keep the messages and streams sent to a peer from
+	// interleaving on its connection.
+	sendLocks map[string]*sync.Mutex
+
+	subscriberLock sync.Mutex
+	subscribers    map[chan Event]struct{}
+
+	policies *policyTable
+
+	// fetches are the gets sent to the peers waiting for their answer, by
+	// ID.
+	fetchLock sync.Mutex
+	fetches   map[uint64]*fetch
+	fetchID   uint64
+
+	scrubLock   sync.Mutex
+	scrubStatus ScrubStatus
+
+	throttle *throttle
+
+	jobLock   sync.Mutex
+	jobs      map[string]*JobStatus
+	transfers atomic.Int64
+	// startedAt is when Start got the node up, which Status reads from
+	// other goroutines.
+	startedAt atomic.Pointer[time.Time]
+
+	// calls counts the calls of the clients in flight, which Shutdown
+	// waits for along with the transfers. closing is set once it started.
+	calls   atomic.Int64
+	closing atomic.Bool
+	// wg waits for the loops Start runs.
+	wg sync.WaitGroup
+
+	store    store.Backend
 	quitchan chan struct{}
+	stopOnce sync.Once
+	log      *slog.Logger
+	tracer   trace.Tracer
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	gob.Register(network.GetMessagePayload{})
+	gob.Register(network.FileMessagePayload{})
 	gob.Register(network.StoreMessagePayload{})
+	gob.Register(network.DeleteMessagePayload{})
+	gob.Register(network.PolicyMessagePayload{})
+	gob.Register(network.PingMessagePayload{})
+	gob.Register(network.LeaveMessagePayload{})
 
-	storeOpts := store.StoreOpts{
-		Root:              opts.StorageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
+	if opts.KeyHash == nil {
+		opts.KeyHash = cipher.SHA256
+	}
+
+	backend := opts.Backend
+	if backend == nil {
+		storeOpts := store.StoreOpts{
+			Root:              opts.StorageRoot,
+			PathTransformFunc: opts.PathTransformFunc,
+			EncKey:            opts.StorageKey,
+		}
+		// The hash is only recorded when it's the one the files are laid
+		// out with.
+		if opts.PathTransformFunc == nil {
+			storeOpts.KeyHash = opts.KeyHash
+		}
+		backend = store.NewStore(storeOpts)
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.New()
 	}
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = otel.GetTracerProvider()
+	}
+	logger := opts.Logger.With("node", opts.Transporter.RemoteAddr())
+
+	policies, err := newPolicyTable(opts.PolicyFile)
+	if err != nil {
+		// Kept in memory, so the file isn't overwritten.
+		logger.Error("Failed to load the policies, they're reset", "err", err)
+		policies, _ = newPolicyTable("")
+	}
+
 	return &FileServer{
 		FileServerOpts: opts,
+		policies:       policies,
 		peers:          make(map[string]network.Peer),
-		store:          store.NewStore(storeOpts),
+		health:         make(map[string]*peerHealth),
+		jobs:           make(map[string]*JobStatus),
+		sendLocks:      make(map[string]*sync.Mutex),
+		fetches:        make(map[uint64]*fetch),
+		throttle:       newThrottle(opts.Bandwidth),
+		subscribers:    make(map[chan Event]struct{}),
+		store:          backend,
 		quitchan:       make(chan struct{}),
+		log:            logger,
+		tracer:         opts.TracerProvider.Tracer(tracerName),
 	}
 }
 
 func (s *FileServer) Start() error {
+	if s.closing.Load() {
+		return ErrServerClosed
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
+
 	if err := s.Transporter.ListenAndAccept(); err != nil {
 		return err
 	}
@@ -59,137 +234,384 @@ func (s *FileServer) Start() error {
 		return err
 	}
 
+	startedAt := time.Now().UTC()
+	s.startedAt.Store(&startedAt)
+	for _, loop := range []func(){s.repairLoop, s.reapLoop, s.scrubLoop, s.heartbeatLoop} {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			loop()
+		}()
+	}
 	s.loop()
 
 	return nil
 }
 
+// Stop stops the server right away, closing the connections of the peers
+// whatever they're doing. Shutdown stops it gracefully.
 func (s *FileServer) Stop() {
-	close(s.quitchan)
+	s.stopOnce.Do(func() { close(s.quitchan) })
 }
 
+// Get returns the file of key, from the local store when it's there and
+// from the peers otherwise.
 func (s *FileServer) Get(key string) (int64, io.Reader, error) {
-	if s.store.Has(key) {
-		println("serving from local file")
-		return s.store.Read(key)
+	meta, r, err := s.Open(key)
+	return meta.Size, r, err
+}
+
+// Open is Get, returning the metadata of the file along with it wherever
+// it was found, with its wrapped key when it's encrypted by the client.
+func (s *FileServer) Open(key string) (store.Metadata, io.Reader, error) {
+	if err := s.beginCall(); err != nil {
+		return store.Metadata{}, nil, err
 	}
+	defer s.endCall()
 
-	fmt.Printf("[%s] File not found locally searching it on the network!\n", s.Transporter.RemoteAddr())
-	msg := network.DataMessage{
-		Payload: network.GetMessagePayload{
-			Key: cipher.HashKey(key),
-		},
+	ctx, span := s.startSpan(context.Background(), "Get", attrKey.String(key))
+
+	start := time.Now()
+	meta, r, source, err := s.get(ctx, key)
+	if err != nil {
+		source = metrics.SourceMiss
+	} else {
+		s.Metrics.BytesServed.WithLabelValues("client").Add(float64(meta.Size))
 	}
+	s.Metrics.Gets.WithLabelValues(source).Inc()
+	s.Metrics.GetDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+
+	span.SetAttributes(attrSource.String(source))
+	endSpan(span, err)
 
-	if err := s.broadcast(msg); err != nil {
-		return 0, nil, err
+	return meta, r, err
+}
+
+// get returns the file of key and its metadata, along with where it was
+// found.
+func (s *FileServer) get(ctx context.Context, key string) (store.Metadata, io.Reader, string, error) {
+	if s.store.Has(key) {
+		meta, err := s.store.Stat(key)
+		if err != nil {
+			return store.Metadata{}, nil, "", err
+		}
+		// It's gone as far as the reader is concerned, the reaper deletes
+		// it soon.
+		if meta.Expired(time.Now()) {
+			return store.Metadata{}, nil, "", fmt.Errorf("%s: %w", key, ErrNotFound)
+		}
+		if meta.Erasure != nil {
+			_, r, err := s.getErasure(ctx, key, meta.Erasure)
+			return fileMetadata(meta), r, metrics.SourceErasure, err
+		}
+
+		s.log.Debug("Serving from the local store", "key", key)
+		size, r, err := s.store.Read(key)
+		meta.Size = size
+		return meta, r, metrics.SourceLocal, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// The shard map of an erasure coded file stored on another node is kept
+	// under the hashed key, and the file is rebuilt from it here.
+	if meta, err := s.store.Stat(s.KeyHash.HashKey(key)); err == nil && meta.Erasure != nil && !meta.Expired(time.Now()) {
+		meta.Key = key
+		_, r, err := s.getErasure(ctx, key, meta.Erasure)
+		return fileMetadata(meta), r, metrics.SourceErasure, err
+	}
 
-	for _, peer := range s.peers {
-		var fileSize int64
-		if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
+	s.log.Info("File not found locally, searching the network", "key", key)
+	failed := []error{}
+	for _, peer := range s.peerList() {
+		f, err := s.fetchFile(ctx, peer, s.KeyHash.HashKey(key))
+		if err != nil {
 			// if error happens try fetching the data from other peers
+			if !errors.Is(err, errPeerMissing) {
+				s.log.Warn("Failed to receive the file", "key", key, "peer", peer.RemoteAddr().String(), "err", err)
+				failed = append(failed, err)
+			}
 			continue
 		}
 
-		n, err := s.store.WriteDecrypt(key, s.EncKey, io.LimitReader(peer, fileSize))
-		if err != nil { // if error try finding it from other peers
+		// The peer keeps the shard map of an erasure coded file, which is
+		// rebuilt from the shards without being kept here.
+		if f.erasure != nil {
+			f.Close()
+			meta := store.Metadata{Key: key, WrappedKey: f.wrappedKey, Erasure: f.erasure}
+			_, r, err := s.getErasure(ctx, key, meta.Erasure)
+			return fileMetadata(meta), r, metrics.SourceErasure, err
+		}
+
+		_, write := s.startSpan(ctx, "local write", attrKey.String(key))
+		n, err := s.store.WriteWith(key, f, store.WriteOpts{WrappedKey: f.wrappedKey})
+		endSpan(write, err)
+		f.Close()
+		if err != nil {
+			s.log.Warn("Failed to store the file", "key", key, "peer", peer.RemoteAddr().String(), "err", err)
+			failed = append(failed, err)
 			continue
 		}
+		s.log.Info("Received the file from the network", "key", key, "peer", peer.RemoteAddr().String(), "bytes", n)
+		s.Metrics.BytesStored.WithLabelValues("peer").Add(float64(n))
 
-		fmt.Printf("[%s] Received (%d) data over the network from %s\n", s.Transporter.RemoteAddr(), n, peer.LocalAddr())
-		peer.CloseStream()
-		return s.store.Read(key)
+		meta, err := s.store.Stat(key)
+		if err != nil {
+			return store.Metadata{}, nil, "", err
+		}
+		size, r, err := s.store.Read(key)
+		if err == nil {
+			s.publish(EventStore, key, size)
+		}
+		meta.Size = size
+		return meta, r, metrics.SourceNetwork, err
 	}
 
-	return 0, nil, fmt.Errorf("couldn't find file in any of the peers")
+	// The peers which failed may have had it.
+	if len(failed) > 0 {
+		return store.Metadata{}, nil, "", fmt.Errorf("%s: %w: %w", key, ErrUnavailable, errors.Join(failed...))
+	}
+	return store.Metadata{}, nil, "", fmt.Errorf("couldn't find %s in any of the peers: %w", key, ErrNotFound)
 }
+
+// Store writes the file locally, then streams the local copy to the peers.
+// Nothing is buffered in memory besides the copy buffers, whatever the size
+// of the file.
 func (s *FileServer) Store(key string, r io.Reader) error {
-	fileBuf := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuf)
+	return s.StoreWith(key, r, StoreOpts{})
+}
 
-	n, err := s.store.Write(key, tee)
-	if err != nil {
+// StoreEncrypted stores a file the client encrypted end to end with a data
+// key of its own. The nodes only keep the ciphertext and the data key
+// wrapped by the client's key, which Stat returns to the client.
+func (s *FileServer) StoreEncrypted(key string, wrappedKey []byte, r io.Reader) error {
+	return s.StoreWith(key, r, StoreOpts{WrappedKey: wrappedKey})
+}
+
+// StoreWith stores a file as its policy and opts say.
+func (s *FileServer) StoreWith(key string, r io.Reader, opts StoreOpts) error {
+	if opts.TTL < 0 {
+		return fmt.Errorf("negative TTL")
+	}
+	if err := s.beginCall(); err != nil {
 		return err
 	}
+	defer s.endCall()
+	defer prometheus.NewTimer(s.Metrics.StoreDuration).ObserveDuration()
 
-	// Send the Store message with size and key
-	msg := network.DataMessage{
-		Payload: network.StoreMessagePayload{
-			Key:  cipher.HashKey(key),
-			Size: n + 16, // Because of the 16 byte of IV prepended to the stream
-		},
-	}
+	ctx, span := s.startSpan(context.Background(), "Store", attrKey.String(key))
 
-	if err := s.broadcast(msg); err != nil {
-		return err
+	policy := s.PolicyFor(key)
+	if opts.TTL > 0 {
+		policy.TTL = opts.TTL
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	err := s.storeFile(ctx, key, r, store.WriteOpts{
+		WrappedKey:  opts.WrappedKey,
+		Plaintext:   policy.Plaintext,
+		ExpiresAt:   policy.ExpiresAt(time.Now()),
+		Compression: policy.Compression,
+		ETag:        opts.ETag,
+	}, policy)
+	endSpan(span, err)
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	return err
+}
+
+// storeFile stores the file on this node and the peers as policy says.
+func (s *FileServer) storeFile(ctx context.Context, key string, r io.Reader, opts store.WriteOpts, policy store.Policy) error {
+	if policy.DataShards > 0 {
+		return s.storeErasure(ctx, key, r, opts, policy)
 	}
 
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{network.IncomingStream})
-	if _, err = cipher.CopyEncrypt(s.EncKey, fileBuf, mw); err != nil {
-		return fmt.Errorf("failed to send file content to peers: %s", err)
+	_, span := s.startSpan(ctx, "local write", attrKey.String(key))
+	n, err := s.store.WriteWith(key, r, opts)
+	endSpan(span, err)
+	if err != nil {
+		return err
 	}
+	s.Metrics.BytesStored.WithLabelValues("client").Add(float64(n))
+	s.publish(EventStore, key, n)
 
-	return nil
+	return s.replicate(ctx, key, n, opts, policy)
 }
 
 // Delete method deletes file on the local server
 func (s *FileServer) Delete(key string) error {
 	if s.store.Has(key) {
-		return s.store.Delete(key)
+		if err := s.store.Delete(key); err != nil {
+			return err
+		}
+		s.publish(EventDelete, key, 0)
+		return nil
 	}
 
 	return fmt.Errorf("file not found")
 }
 
-func (s *FileServer) OnPeer(p network.Peer) error {
+// Has reports whether the file is stored on the local server
+func (s *FileServer) Has(key string) bool {
+	return s.store.Has(key)
+}
+
+// DeleteNetwork deletes the file on the local server and asks every peer
+// to delete its copy as well
+func (s *FileServer) DeleteNetwork(key string) error {
+	if err := s.beginCall(); err != nil {
+		return err
+	}
+	defer s.endCall()
+
+	if s.store.Has(key) {
+		meta, err := s.store.Stat(key)
+		if err != nil {
+			return err
+		}
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+
+		if meta.Erasure != nil {
+			for i := range meta.Erasure.Peers {
+				msg := network.DataMessage{
+					Payload: network.DeleteMessagePayload{Key: s.shardKey(key, i)},
+				}
+				if err := s.broadcast(msg); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	msg := network.DataMessage{
+		Payload: network.DeleteMessagePayload{
+			Key: s.KeyHash.HashKey(key),
+		},
+	}
+
+	return s.broadcast(msg)
+}
+
+// Stat returns the metadata of a file stored on the local server
+func (s *FileServer) Stat(key string) (store.Metadata, error) {
+	meta, err := s.store.Stat(key)
+	return fileMetadata(meta), err
+}
+
+// List returns the metadata of the files stored on the local server whose
+// key starts with prefix
+func (s *FileServer) List(prefix string) ([]store.Metadata, error) {
+	list, err := s.store.List(prefix)
+	for i := range list {
+		list[i] = fileMetadata(list[i])
+	}
+	return list, err
+}
+
+// fileMetadata describes the file rather than the local blob, which is
+// empty for the erasure coded files.
+func fileMetadata(meta store.Metadata) store.Metadata {
+	if meta.Erasure != nil {
+		meta.Size = meta.Erasure.Size
+		meta.Checksum = meta.Erasure.Checksum
+	}
+	return meta
+}
+
+// Peers returns the addresses of the connected peers, but the ones leaving
+func (s *FileServer) Peers() []string {
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
 
-	log.Printf("Connected with remote %s", p.LocalAddr())
+	addrs := make([]string, 0, len(s.peers))
+	for addr := range s.peers {
+		if s.health[addr].leaving {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
 
-	return nil
+	return addrs
 }
 
-func (s *FileServer) broadcast(msg network.DataMessage) error {
-	msgBuf := new(bytes.Buffer)
-	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
-		return err
+func (s *FileServer) OnPeer(p network.Peer) error {
+	if s.closing.Load() {
+		return ErrServerClosed
 	}
 
-	peers := []io.Writer{}
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	s.peers[p.RemoteAddr().String()] = p
+	s.sendLocks[p.RemoteAddr().String()] = &sync.Mutex{}
+	now := time.Now()
+	s.health[p.RemoteAddr().String()] = &peerHealth{connectedAt: now.UTC(), lastSeen: now}
+
+	s.log.Info("Connected with a peer", "peer", p.RemoteAddr().String())
+	go func() {
+		s.sendPolicies(p)
+		if err := s.ping(p); err != nil {
+			s.log.Debug("Failed to ping a peer", "peer", p.RemoteAddr().String(), "err", err)
+		}
+	}()
+
+	return nil
+}
 
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+// OnPeerClose forgets a peer whose connection was closed.
+func (s *FileServer) OnPeerClose(p network.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr := p.RemoteAddr().String()
+	// The peer may have connected again already.
+	if s.peers[addr] != p {
+		return
 	}
+	delete(s.peers, addr)
+	delete(s.sendLocks, addr)
+	delete(s.health, addr)
+	s.throttle.forget(addr)
 
-	mw := io.MultiWriter(peers...)
+	s.log.Info("Disconnected from a peer", "peer", addr)
+}
 
-	if _, err := io.Copy(mw, bytes.NewReader([]byte{network.IncomingMessage})); err != nil {
+func (s *FileServer) broadcast(msg network.DataMessage) error {
+	msgBuf, err := encodeMessage(msg)
+	if err != nil {
 		return err
 	}
 
-	if _, err := io.Copy(mw, bytes.NewReader(msgBuf.Bytes())); err != nil {
-		return err
+	for _, peer := range s.peerList() {
+		if err := s.sendTo(peer, msgBuf); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func encodeMessage(msg network.DataMessage) ([]byte, error) {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return nil, err
+	}
+	return msgBuf.Bytes(), nil
+}
+
+// sendTo sends an encoded message to the peer.
+func (s *FileServer) sendTo(peer network.Peer, msg []byte) error {
+	unlock := s.lockPeer(peer)
+	defer unlock()
+
+	return sendMessage(peer, msg)
+}
+
+func sendMessage(peer network.Peer, msg []byte) error {
+	return peer.Send(network.EncodeMessage(msg))
+}
+
 func (s *FileServer) loop() {
 	defer func() {
-		fmt.Printf("[%s] File Server Stopped Due to Error or User Quit Action.\n", s.Transporter.RemoteAddr())
+		s.log.Info("File server stopped")
 		s.Transporter.Close()
 	}()
 
@@ -198,11 +620,17 @@ func (s *FileServer) loop() {
 		case rpc := <-s.Transporter.Consume():
 			var msg network.DataMessage
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				log.Fatal(err)
+				s.Metrics.DecodeErrors.WithLabelValues("message").Inc()
+				s.log.Error("Failed to decode a message", "peer", rpc.From.String(), "err", err)
+				// The stream which follows can't be skipped.
+				if peer, ok := s.peer(rpc.From.String()); ok && rpc.Stream {
+					peer.Close()
+				}
+				continue
 			}
 
 			if err := s.handleMessage(rpc.From.String(), &msg); err != nil {
-				log.Printf("[%s] Handle message error: %s\n", s.Transporter.RemoteAddr(), err)
+				s.log.Warn("Failed to handle a message", "peer", rpc.From.String(), "err", err)
 			}
 
 		case <-s.quitchan:
@@ -212,73 +640,212 @@ func (s *FileServer) loop() {
 }
 
 func (s *FileServer) handleMessage(from string, msg *network.DataMessage) error {
+	s.seen(from)
+
+	ctx := extractTrace(msg.Trace)
 	switch v := msg.Payload.(type) {
 	case network.StoreMessagePayload:
-		return s.handleMessageStore(from, v)
+		return s.handleMessageStore(ctx, from, v)
 	case network.GetMessagePayload:
-		return s.handleMessageGet(from, v)
+		return s.handleMessageGet(ctx, from, v)
+	case network.FileMessagePayload:
+		return s.handleMessageFile(from, v)
+	case network.DeleteMessagePayload:
+		return s.handleMessageDelete(from, v)
+	case network.PolicyMessagePayload:
+		return s.handleMessagePolicy(from, v)
+	case network.PingMessagePayload:
+		return s.handleMessagePing(from, v)
+	case network.LeaveMessagePayload:
+		return s.handleMessageLeave(from)
 	}
 	return nil
 }
 
-func (s *FileServer) handleMessageStore(from string, msg network.StoreMessagePayload) error {
-
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageStore(ctx context.Context, from string, msg network.StoreMessagePayload) (err error) {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	_, err := s.store.Write(msg.Key, io.LimitReader(peer, msg.Size))
-	if err != nil {
+	in := s.limitReader(peer, from, msg.Background)
+
+	// A copy which expired on the way would only be deleted again.
+	if !msg.ExpiresAt.IsZero() && !time.Now().Before(msg.ExpiresAt) {
+		defer peer.CloseStream()
+		_, err := io.Copy(io.Discard, io.LimitReader(in, msg.Size))
 		return err
 	}
 
-	fmt.Printf("[%s] Data received and stored to disk %+v\n", s.Transporter.RemoteAddr(), msg)
-	peer.CloseStream()
+	// The copy is kept as the policy of the file says.
+	opts := store.WriteOpts{
+		WrappedKey:  msg.WrappedKey,
+		Plaintext:   msg.Policy.Plaintext,
+		ExpiresAt:   msg.ExpiresAt,
+		Compression: msg.Policy.Compression,
+		Replica:     true,
+	}
+	// The copy is only kept once it matches the checksum of the sender.
+	defer peer.CloseStream()
+	defer s.trackTransfer()()
+	_, span := s.startSpan(ctx, "local write", attrKey.String(msg.Key), attrPeer.String(from))
+	defer func() { endSpan(span, err) }()
+	// The copies of a shard map are set apart from the one the node the
+	// file was stored on keeps.
+	if len(msg.Erasure) > 0 {
+		opts.Erasure = &store.Erasure{}
+		if err := json.Unmarshal(msg.Erasure, opts.Erasure); err != nil {
+			io.Copy(io.Discard, io.LimitReader(in, msg.Size))
+			return fmt.Errorf("store %s from %s: bad shard map: %w", msg.Key, from, err)
+		}
+		opts.Erasure.Replica = true
+	}
+	// The stream is decrypted for the store to compress and encrypt the
+	// copy as the policy says, like the one of the node it comes from. The
+	// checksum is the one of the file, so a copy decrypted with another
+	// key than the sender's isn't kept.
+	r := io.LimitReader(in, msg.Size)
+	decrypted, err := cipher.NewDecryptReader(s.EncKey, r)
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return fmt.Errorf("store %s from %s: %w", msg.Key, from, err)
+	}
+	n, err := s.store.WriteWith(msg.Key, newChecksumReader(decrypted, msg.Checksum), opts)
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return fmt.Errorf("store %s from %s: %w", msg.Key, from, err)
+	}
+	s.Metrics.BytesStored.WithLabelValues("peer").Add(float64(n))
+	s.publish(EventStore, msg.Key, n)
+
+	s.log.Debug("Stored a file from a peer", "key", msg.Key, "peer", from, "bytes", n)
 
 	return nil
 }
 
-func (s *FileServer) handleMessageGet(from string, msg network.GetMessagePayload) error {
-	if !s.store.Has(msg.Key) {
-		return errors.New("requested to stream file but it doesn't exist")
-	}
-
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageGet(ctx context.Context, from string, msg network.GetMessagePayload) (err error) {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
+	_, span := s.startSpan(ctx, "remote store read", attrKey.String(msg.Key), attrPeer.String(from))
+	defer func() { endSpan(span, err) }()
+
+	if !s.store.Has(msg.Key) {
+		return s.sendMissing(peer, msg.ID)
+	}
+
+	meta, err := s.store.Stat(msg.Key)
+	if err != nil {
+		return errors.Join(err, s.sendMissing(peer, msg.ID))
+	}
 	fileSize, file, err := s.store.Read(msg.Key)
 	if err != nil {
-		return err
+		return errors.Join(err, s.sendMissing(peer, msg.ID))
 	}
+	defer s.trackTransfer()()
 
 	if rc, ok := file.(io.ReadCloser); ok {
 		defer rc.Close()
 	}
 
-	peer.Send([]byte{network.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	if _, err := io.Copy(peer, file); err != nil {
+	// The file is encrypted for the way, the checksum is the one of the
+	// file, which the peer checks once it decrypted it.
+	answer := network.FileMessagePayload{
+		ID:         msg.ID,
+		Size:       fileSize + cipher.IVSize,
+		WrappedKey: meta.WrappedKey,
+		Checksum:   meta.Checksum,
+	}
+	if meta.Erasure != nil {
+		if answer.Erasure, err = json.Marshal(meta.Erasure); err != nil {
+			return err
+		}
+	}
+	header, err := encodeMessage(network.DataMessage{Payload: answer})
+	if err != nil {
+		return err
+	}
+
+	unlock := s.lockPeer(peer)
+	defer unlock()
+
+	if err := peer.Send(network.EncodeStream(header)); err != nil {
+		return err
+	}
+	if _, err := cipher.CopyEncrypt(s.EncKey, file, s.limitWriter(peer, from, msg.Background)); err != nil {
 		return err
 	}
+	s.Metrics.BytesServed.WithLabelValues("peer").Add(float64(fileSize))
 
-	fmt.Printf("[%s] Wrote (%d) data to peer\n", s.Transporter.RemoteAddr(), fileSize)
+	s.log.Debug("Sent a file to a peer", "key", msg.Key, "peer", from, "bytes", fileSize)
+	return nil
+}
+
+// sendMissing answers a get of a file the server doesn't have.
+func (s *FileServer) sendMissing(peer network.Peer, id uint64) error {
+	msg, err := encodeMessage(network.DataMessage{Payload: network.FileMessagePayload{ID: id, Missing: true}})
+	if err != nil {
+		return err
+	}
+	return s.sendTo(peer, msg)
+}
+
+func (s *FileServer) handleMessageDelete(from string, msg network.DeleteMessagePayload) error {
+	if !s.store.Has(msg.Key) {
+		return nil
+	}
+
+	meta, err := s.store.Stat(msg.Key)
+	if err != nil {
+		return err
+	}
+	// A tombstone spares a copy of a file stored again since it expired.
+	if !msg.ExpiresAt.IsZero() {
+		if meta.ExpiresAt.IsZero() || meta.ExpiresAt.After(msg.ExpiresAt) {
+			return nil
+		}
+	}
+
+	if err := s.store.Delete(msg.Key); err != nil {
+		return err
+	}
+	s.publish(EventDelete, msg.Key, 0)
+
+	// The shards this node keeps of the erasure coded file go with its
+	// shard map, whichever node asked for the delete.
+	if meta.Erasure != nil && meta.Erasure.Replica {
+		for i := range meta.Erasure.Peers {
+			shard := fmt.Sprintf("%s.%d", msg.Key, i)
+			if s.store.Has(shard) {
+				if err := s.store.Delete(shard); err != nil {
+					return err
+				}
+				s.publish(EventDelete, shard, 0)
+			}
+		}
+	}
+
+	s.log.Debug("Deleted a file as requested", "key", msg.Key, "peer", from)
 	return nil
 }
 
 func (s *FileServer) bootstrapNetwork() error {
-	if len(s.BootstrapNodes) == 0 {
+	s.peerLock.Lock()
+	nodes := slices.Clone(s.BootstrapNodes)
+	s.peerLock.Unlock()
+
+	if len(nodes) == 0 {
 		return nil
 	}
 	wg := sync.WaitGroup{}
-	for _, node := range s.BootstrapNodes {
+	for _, node := range nodes {
 		wg.Add(1)
 		go func(node string) {
-			fmt.Println("Attempting to connect with remote => ", node)
+			s.log.Info("Connecting with a peer", "peer", node)
 			if err := s.Transporter.Dial(node); err != nil {
-				log.Printf("dial error : %s\n", err)
+				s.log.Error("Failed to connect with a peer", "peer", node, "err", err)
 				wg.Done()
 				return
 			}
@@ -290,12 +857,52 @@ func (s *FileServer) bootstrapNetwork() error {
 }
 
 func (s *FileServer) BootstrapNode(url string) error {
-	fmt.Println("Attempting to connect with remote => ", url)
+	s.log.Info("Connecting with a peer", "peer", url)
 	if err := s.Transporter.Dial(url); err != nil {
-		log.Printf("dial error : %s\n", err)
+		s.log.Error("Failed to connect with a peer", "peer", url, "err", err)
 		return err
 	}
 	// Add the node into list of nodes
+	s.peerLock.Lock()
 	s.BootstrapNodes = append(s.BootstrapNodes, url)
+	s.peerLock.Unlock()
+	return nil
+}
+
+// Disconnect closes the connection with the peer at addr, as it was dialed
+// or as it's listed by Peers, and drops it from the bootstrap nodes.
+func (s *FileServer) Disconnect(addr string) error {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.peerLock.Lock()
+	s.BootstrapNodes = slices.DeleteFunc(slices.Clone(s.BootstrapNodes), func(node string) bool { return node == addr })
+	s.peerLock.Unlock()
+
+	found := false
+	for _, peer := range s.peerList() {
+		if got, ok := peer.RemoteAddr().(*net.TCPAddr); ok && sameAddr(want, got) {
+			s.log.Info("Disconnecting from a peer", "peer", peer.RemoteAddr().String())
+			peer.Close()
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("not connected to %s", addr)
+	}
 	return nil
 }
+
+// sameAddr tells whether got is the address want, which stands for the
+// local host when it has no IP.
+func sameAddr(want, got *net.TCPAddr) bool {
+	if want.Port != got.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return got.IP.IsLoopback()
+	}
+	return want.IP.Equal(got.IP)
+}
@@ -0,0 +1,812 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/metrics"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/store"
+)
+
+func TestStoreStreamsToPeers(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s := nodes[0]
+	// One stream at a time.
+	s.TransferMemory = streamMemory
+
+	const size = 16 << 20
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	assert.Nil(t, s.Store("big", io.LimitReader(&pattern{}, size)))
+
+	runtime.ReadMemStats(&after)
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/4))
+
+	assertEncrypted(t, s, "big")
+	for _, peer := range nodes[1:] {
+		key := s.KeyHash.HashKey("big")
+		eventually(t, func() bool { return peer.Has(key) })
+		assertEncrypted(t, peer, key)
+
+		// The peer keeps the file itself, encrypted at rest with its own
+		// key.
+		_, r, err := peer.store.Read(key)
+		assert.Nil(t, err)
+		plain, err := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Nil(t, err)
+
+		expected, _ := io.ReadAll(io.LimitReader(&pattern{}, size))
+		assert.True(t, bytes.Equal(expected, plain))
+	}
+}
+
+func TestStoreEncryptedReplicatesWrappedKey(t *testing.T) {
+	nodes := newNetwork(t, 2)
+
+	wrappedKey := []byte("wrapped data key")
+	assert.Nil(t, nodes[0].StoreEncrypted("secret", wrappedKey, bytes.NewReader([]byte("ciphertext"))))
+
+	meta, err := nodes[0].Stat("secret")
+	assert.Nil(t, err)
+	assert.Equal(t, wrappedKey, meta.WrappedKey)
+
+	key := nodes[0].KeyHash.HashKey("secret")
+	eventually(t, func() bool { return nodes[1].Has(key) })
+	meta, err = nodes[1].Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, wrappedKey, meta.WrappedKey)
+}
+
+func TestBackend(t *testing.T) {
+	backend := store.NewMemoryStore(store.MemoryStoreOpts{EncKey: cipher.NewEncryptionKey()})
+	s := NewFileServer(FileServerOpts{
+		StorageRoot: t.TempDir(),
+		Transporter: network.NewTCPTransporter(network.TCPTransporterOpts{ListenAddress: freeAddr(t)}),
+		EncKey:      cipher.NewEncryptionKey(),
+		Backend:     backend,
+	})
+
+	assert.Nil(t, s.Store("key", bytes.NewReader([]byte("Hello World"))))
+	assert.True(t, backend.Has("key"))
+
+	_, r, err := s.Get("key")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "Hello World", string(data))
+
+	entries, err := os.ReadDir(s.StorageRoot)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestErasureCoding(t *testing.T) {
+	nodes := newNetwork(t, 4)
+	s, peers := nodes[0], nodes[1:]
+	s.Erasure = ErasureOpts{DataShards: 2, ParityShards: 1}
+
+	const size = 3*shardChunk + 100
+	expected, _ := io.ReadAll(io.LimitReader(&pattern{}, size))
+	assert.Nil(t, s.Store("file", bytes.NewReader(expected)))
+
+	meta, err := s.Stat("file")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(size), meta.Size)
+	assert.Len(t, meta.Erasure.Peers, 3)
+
+	// Every peer keeps a single shard.
+	holder := map[int]*FileServer{}
+	for i := range 3 {
+		key := s.shardKey("file", i)
+		eventually(t, func() bool {
+			for _, peer := range peers {
+				if peer.Has(key) {
+					holder[i] = peer
+					return true
+				}
+			}
+			return false
+		})
+	}
+	assert.Len(t, map[*FileServer]bool{holder[0]: true, holder[1]: true, holder[2]: true}, 3)
+
+	get := func() ([]byte, error) {
+		_, r, err := s.Get("file")
+		if err != nil {
+			return nil, err
+		}
+		defer r.(io.Closer).Close()
+		return io.ReadAll(r)
+	}
+
+	// Any two shards rebuild the file.
+	assert.Nil(t, holder[0].Delete(s.shardKey("file", 0)))
+	data, err := get()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+
+	// The repair rebuilds the shard on the only peer without one.
+	assert.Nil(t, s.RepairShards())
+	eventually(t, func() bool { return holder[0].Has(s.shardKey("file", 0)) })
+
+	// The peers keep the shard map as well, so the file is rebuilt
+	// without the one of this node.
+	for _, peer := range peers {
+		eventually(t, func() bool { return peer.Has(s.KeyHash.HashKey("file")) })
+	}
+	assert.Nil(t, s.Delete("file"))
+	data, err = get()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+	assert.False(t, s.Has("file"))
+
+	assert.Nil(t, holder[1].Delete(s.shardKey("file", 1)))
+	data, err = get()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+
+	assert.Nil(t, holder[2].Delete(s.shardKey("file", 2)))
+	_, err = get()
+	assert.NotNil(t, err)
+}
+
+func TestErasureFromAnotherNode(t *testing.T) {
+	nodes := make([]*FileServer, 4)
+	addrs := make([]string, len(nodes))
+	for i := range nodes {
+		addrs[i] = freeAddr(t)
+		nodes[i] = newServer(t, addrs[i])
+		go nodes[i].Start()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The first node only knows the others by the connections they opened,
+	// from ports they don't listen on.
+	for i := 1; i < len(nodes); i++ {
+		assert.Nil(t, nodes[i].BootstrapNode(addrs[0]))
+		if i > 1 {
+			assert.Nil(t, nodes[i].BootstrapNode(addrs[1]))
+		}
+	}
+	eventually(t, func() bool { return len(nodes[0].Peers()) == 3 && len(nodes[1].Peers()) == 3 })
+
+	s := nodes[0]
+	s.Erasure = ErasureOpts{DataShards: 2, ParityShards: 1}
+	expected, _ := io.ReadAll(io.LimitReader(&pattern{}, 2*shardChunk+100))
+	assert.Nil(t, s.Store("file", bytes.NewReader(expected)))
+
+	// The shard map records the addresses the peers listen on.
+	meta, err := s.Stat("file")
+	assert.Nil(t, err)
+	for i, addr := range meta.Erasure.Peers {
+		_, port, err := net.SplitHostPort(addr)
+		assert.Nil(t, err)
+		holder := slices.Index(addrs, ":"+port)
+		assert.Greater(t, holder, 0)
+		eventually(t, func() bool { return nodes[holder].Has(s.shardKey("file", i)) })
+	}
+
+	// Another node rebuilds the file from its copy of the shard map, with
+	// the shard it keeps itself and the ones of the other peers.
+	eventually(t, func() bool { return nodes[1].Has(s.KeyHash.HashKey("file")) })
+	_, r, err := nodes[1].Get("file")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(expected, data))
+}
+
+func TestPolicies(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s := nodes[0]
+
+	assert.Nil(t, s.SetPolicy(store.Policy{Prefix: "logs/", Replicas: 1, TTL: time.Hour}))
+	assert.Nil(t, s.SetPolicy(store.Policy{Prefix: "logs/public/", Plaintext: true}))
+	assert.NotNil(t, s.SetPolicy(store.Policy{Prefix: "bad/", Replicas: 1, DataShards: 2}))
+	assert.NotNil(t, s.SetPolicy(store.Policy{Prefix: strings.Repeat("a", 257), Replicas: 1}))
+	for _, peer := range nodes[1:] {
+		eventually(t, func() bool { return len(peer.Policies()) == 2 })
+	}
+
+	// The longest prefix wins.
+	assert.Equal(t, 1, s.PolicyFor("logs/app.log").Replicas)
+	assert.True(t, s.PolicyFor("logs/public/app.log").Plaintext)
+	assert.Equal(t, store.Policy{}, s.PolicyFor("docs/readme"))
+
+	// A single peer gets a copy.
+	before := time.Now()
+	assert.Nil(t, s.Store("logs/app.log", bytes.NewReader([]byte("Hello World"))))
+	key := s.KeyHash.HashKey("logs/app.log")
+	eventually(t, func() bool { return nodes[1].Has(key) || nodes[2].Has(key) })
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, nodes[1].Has(key) && nodes[2].Has(key))
+
+	meta, err := s.Stat("logs/app.log")
+	assert.Nil(t, err)
+	assert.WithinRange(t, meta.ExpiresAt, before.Add(time.Hour), time.Now().Add(time.Hour))
+
+	assert.Nil(t, s.Store("logs/public/app.log", bytes.NewReader([]byte("Hello World"))))
+	meta, err = s.Stat("logs/public/app.log")
+	assert.Nil(t, err)
+	assert.False(t, meta.Encrypted)
+	assert.True(t, meta.ExpiresAt.IsZero())
+
+	// The deletion reaches the peers too.
+	assert.Nil(t, s.DeletePolicy("logs/"))
+	assert.NotNil(t, s.DeletePolicy("logs/"))
+	for _, peer := range nodes[1:] {
+		eventually(t, func() bool { return len(peer.Policies()) == 1 })
+	}
+}
+
+func TestCompressedCopies(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+	assert.Nil(t, s.SetPolicy(store.Policy{Prefix: "logs/", Compression: store.CompressionZstd}))
+
+	text := bytes.Repeat([]byte("GET /index.html 200 12ms\n"), 10000)
+	assert.Nil(t, s.Store("logs/access", bytes.NewReader(text)))
+
+	// The copy of the peer is compressed like the one of the node.
+	key := s.KeyHash.HashKey("logs/access")
+	eventually(t, func() bool { return peer.Has(key) })
+	meta, err := peer.Stat(key)
+	assert.Nil(t, err)
+	assert.Equal(t, store.CompressionZstd, meta.Compression)
+	assert.Equal(t, int64(len(text)), meta.Size)
+
+	assert.Nil(t, s.Delete("logs/access"))
+	_, r, err := s.Get("logs/access")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.True(t, bytes.Equal(text, data))
+}
+
+func TestExpiration(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s := nodes[0]
+
+	assert.Nil(t, s.StoreWith("tmp/build", bytes.NewReader([]byte("Hello World")), StoreOpts{TTL: time.Second}))
+	assert.Nil(t, s.Store("docs/readme", bytes.NewReader([]byte("Hello World"))))
+	key := s.KeyHash.HashKey("tmp/build")
+	for _, peer := range nodes[1:] {
+		eventually(t, func() bool { return peer.Has(key) })
+		meta, err := peer.Stat(key)
+		assert.Nil(t, err)
+		assert.False(t, meta.ExpiresAt.IsZero())
+	}
+	_, _, err := s.Get("tmp/build")
+	assert.Nil(t, err)
+
+	// A peer got the file again since, without a TTL.
+	time.Sleep(time.Second)
+	_, err = nodes[2].store.Write(key, bytes.NewReader([]byte("Hello again")))
+	assert.Nil(t, err)
+
+	_, _, err = s.Get("tmp/build")
+	assert.NotNil(t, err)
+
+	n, err := s.Reap()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.False(t, s.Has("tmp/build"))
+	assert.True(t, s.Has("docs/readme"))
+
+	// The tombstone deletes the expired copy and spares the new one.
+	eventually(t, func() bool { return !nodes[1].Has(key) })
+	assert.True(t, nodes[2].Has(key))
+}
+
+func TestScrub(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s := nodes[0]
+
+	expected, _ := io.ReadAll(io.LimitReader(&pattern{}, 100<<10))
+	assert.Nil(t, s.Store("file", bytes.NewReader(expected)))
+	assert.Nil(t, s.Store("other", bytes.NewReader([]byte("Hello World"))))
+	eventually(t, func() bool { return nodes[1].Has(s.KeyHash.HashKey("file")) })
+
+	status, err := s.Scrub()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, status.Checked)
+	assert.Empty(t, status.Findings)
+
+	// Rot a bit of the local copy.
+	path := s.StorageRoot + "/" + s.PathTransformFunc("file").FullPath()
+	blob, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	blob[len(blob)/2] ^= 0x10
+	assert.Nil(t, os.WriteFile(path, blob, 0o644))
+
+	status, err = s.Scrub()
+	assert.Nil(t, err)
+	assert.False(t, status.Running)
+	assert.Equal(t, 2, status.Total)
+	assert.Len(t, status.Findings, 1)
+	finding := status.Findings[0]
+	assert.Equal(t, "file", finding.Key)
+	assert.True(t, finding.Repaired)
+	quarantined, err := os.ReadFile(finding.Quarantine)
+	assert.Nil(t, err)
+	assert.Equal(t, blob, quarantined)
+
+	_, r, err := s.Get("file")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.True(t, bytes.Equal(expected, data))
+
+	assert.Equal(t, status, s.ScrubProgress())
+}
+
+func TestTransferChecksums(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s := nodes[0]
+
+	// A stream which doesn't match its checksum isn't kept.
+	peer := s.peerList()[0]
+	msg, err := encodeMessage(network.DataMessage{Payload: network.StoreMessagePayload{Key: "bad", Size: 11, Checksum: "00"}})
+	assert.Nil(t, err)
+	assert.Nil(t, peer.Send(append(network.EncodeStream(msg), "Hello World"...)))
+
+	expected, _ := io.ReadAll(io.LimitReader(&pattern{}, 100<<10))
+	assert.Nil(t, s.Store("file", bytes.NewReader(expected)))
+	key := s.KeyHash.HashKey("file")
+	for _, peer := range nodes[1:] {
+		eventually(t, func() bool { return peer.Has(key) })
+	}
+	assert.False(t, nodes[1].Has("bad") || nodes[2].Has("bad"))
+
+	// The copy of a peer rots, the file comes from the other one.
+	path := nodes[1].StorageRoot + "/" + nodes[1].PathTransformFunc(key).FullPath()
+	blob, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	blob[len(blob)/2] ^= 0x10
+	assert.Nil(t, os.WriteFile(path, blob, 0o644))
+
+	assert.Nil(t, s.Delete("file"))
+	_, r, err := s.Get("file")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.True(t, bytes.Equal(expected, data))
+
+	// A peer with another transport key decrypts garbage, which doesn't
+	// match the checksum of the file.
+	nodes[2].EncKey = cipher.NewEncryptionKey()
+	assert.Nil(t, s.Store("other", bytes.NewReader(expected)))
+	key = s.KeyHash.HashKey("other")
+	eventually(t, func() bool { return nodes[1].Has(key) })
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, nodes[2].Has(key))
+}
+
+func TestConcurrentGets(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+
+	const n = 8
+	for i := range n {
+		key := fmt.Sprintf("file%d", i)
+		assert.Nil(t, s.Store(key, bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 100<<10))))
+		eventually(t, func() bool { return peer.Has(s.KeyHash.HashKey(key)) })
+		assert.Nil(t, s.Delete(key))
+	}
+
+	// The answers of the peer to the gets in flight aren't mixed up.
+	start := time.Now()
+	errs := make(chan error, n)
+	for i := range n {
+		go func() {
+			_, r, err := s.Get(fmt.Sprintf("file%d", i))
+			if err == nil {
+				data, _ := io.ReadAll(r)
+				r.(io.Closer).Close()
+				if !bytes.Equal(bytes.Repeat([]byte{byte(i)}, 100<<10), data) {
+					err = fmt.Errorf("file%d doesn't match", i)
+				}
+			}
+			errs <- err
+		}()
+	}
+	for range n {
+		assert.Nil(t, <-errs)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestGetFromCorruptedPeer(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+
+	assert.Nil(t, s.Store("file", bytes.NewReader([]byte("Hello World"))))
+	key := s.KeyHash.HashKey("file")
+	eventually(t, func() bool { return peer.Has(key) })
+
+	path := peer.StorageRoot + "/" + peer.PathTransformFunc(key).FullPath()
+	blob, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	blob[len(blob)/2] ^= 0x10
+	assert.Nil(t, os.WriteFile(path, blob, 0o644))
+
+	assert.Nil(t, s.Delete("file"))
+	_, _, err = s.Get("file")
+	assert.NotNil(t, err)
+
+	// The stream of the bad copy was closed, the peer is still heard.
+	assert.Nil(t, peer.Store("theirs", bytes.NewReader([]byte("Hello World"))))
+	eventually(t, func() bool { return s.Has(peer.KeyHash.HashKey("theirs")) })
+}
+
+func TestMetrics(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+
+	assert.Nil(t, s.Store("file", bytes.NewReader([]byte("Hello World"))))
+	eventually(t, func() bool { return peer.Has(s.KeyHash.HashKey("file")) })
+	// The stream of the copy is encrypted, with its IV in front.
+	assert.Equal(t, float64(11), metricValue(t, peer.Metrics, "dfs_bytes_stored_total", "from", "peer"))
+	assert.Greater(t, metricValue(t, s.Metrics, "dfs_peer_bytes_out_total"), float64(11+cipher.IVSize))
+	assert.Greater(t, metricValue(t, peer.Metrics, "dfs_peer_bytes_in_total"), float64(11+cipher.IVSize))
+
+	_, _, err := s.Get("file")
+	assert.Nil(t, err)
+	// An expired file is a miss.
+	assert.Nil(t, s.StoreWith("expired", bytes.NewReader([]byte("Hello World")), StoreOpts{TTL: time.Millisecond}))
+	time.Sleep(5 * time.Millisecond)
+	_, _, err = s.Get("expired")
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 1.0, metricValue(t, s.Metrics, "dfs_peers_connected"))
+	assert.Equal(t, 22.0, metricValue(t, s.Metrics, "dfs_bytes_stored_total", "from", "client"))
+	assert.Equal(t, 11.0, metricValue(t, s.Metrics, "dfs_bytes_served_total", "to", "client"))
+	assert.Equal(t, 1.0, metricValue(t, s.Metrics, "dfs_get_total", "source", metrics.SourceLocal))
+	assert.Equal(t, 1.0, metricValue(t, s.Metrics, "dfs_get_total", "source", metrics.SourceMiss))
+	assert.Equal(t, 2.0, metricValue(t, s.Metrics, "dfs_get_duration_seconds"))
+	assert.Equal(t, 2.0, metricValue(t, s.Metrics, "dfs_store_duration_seconds"))
+	assert.Equal(t, 2.0, metricValue(t, s.Metrics, "dfs_replication_lag_seconds"))
+
+	// A message which isn't a DataMessage is counted and skipped.
+	assert.Nil(t, sendMessage(s.peerList()[0], []byte("garbage")))
+	eventually(t, func() bool {
+		return metricValue(t, peer.Metrics, "dfs_decode_errors_total", "layer", "message") == 1
+	})
+	assert.Nil(t, s.Store("other", bytes.NewReader([]byte("Hello World"))))
+	eventually(t, func() bool { return peer.Has(s.KeyHash.HashKey("other")) })
+}
+
+func TestStatus(t *testing.T) {
+	// The status is read while the node starts.
+	starting := newServer(t, freeAddr(t))
+	go starting.Start()
+	eventually(t, func() bool {
+		status, err := starting.Status()
+		return err == nil && status.Uptime > 0
+	})
+
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+
+	assert.Nil(t, s.Store("file", bytes.NewReader([]byte("Hello World"))))
+
+	// The peers are pinged once connected.
+	eventually(t, func() bool {
+		status, err := s.Status()
+		return err == nil && len(status.Peers) == 1 && status.Peers[0].RTT > 0
+	})
+	status, err := s.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, s.Transporter.RemoteAddr(), status.ID)
+	assert.Equal(t, Version, status.Version)
+	assert.Greater(t, status.Uptime, time.Duration(0))
+	assert.Equal(t, 1, status.Objects)
+	assert.Greater(t, status.DiskUsage, int64(11))
+	assert.Equal(t, int64(0), status.Transfers)
+	assert.Equal(t, PeerConnected, status.Peers[0].State)
+	assert.False(t, status.Peers[0].LastSeen.IsZero())
+
+	names := []string{}
+	for _, job := range status.Jobs {
+		names = append(names, job.Name)
+	}
+	assert.Equal(t, []string{JobReap, JobRepair, JobScrub}, names)
+
+	// A closed connection is no longer reported.
+	s.peerList()[0].Close()
+	eventually(t, func() bool {
+		status, err := peer.Status()
+		return err == nil && len(status.Peers) == 0
+	})
+	eventually(t, func() bool { return len(s.Peers()) == 0 })
+}
+
+func TestShutdown(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s, peer := nodes[0], nodes[1]
+
+	// A store in flight is drained before the connections are closed.
+	r, w := io.Pipe()
+	stored := make(chan error, 1)
+	go func() { stored <- s.Store("file", r) }()
+	eventually(t, func() bool { return s.calls.Load() == 1 })
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	eventually(t, func() bool { return len(peer.Peers()) == 0 })
+	status, err := peer.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, PeerLeaving, status.Peers[0].State)
+	assert.ErrorIs(t, s.Store("other", bytes.NewReader([]byte("Hello World"))), ErrServerClosed)
+
+	w.Write([]byte("Hello World"))
+	w.Close()
+	assert.Nil(t, <-stored)
+	assert.Nil(t, <-shutdown)
+	assert.True(t, peer.Has(s.KeyHash.HashKey("file")))
+	eventually(t, func() bool {
+		status, err := peer.Status()
+		return err == nil && len(status.Peers) == 0
+	})
+
+	// What's still running once the context is done is aborted.
+	r, w = io.Pipe()
+	defer w.Close()
+	go nodes[2].Store("stuck", r)
+	eventually(t, func() bool { return nodes[2].calls.Load() == 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, nodes[2].Shutdown(ctx), context.DeadlineExceeded)
+}
+
+func TestDisconnect(t *testing.T) {
+	nodes := newNetwork(t, 3)
+	s := nodes[0]
+	removed := s.BootstrapNodes[0]
+
+	assert.NotNil(t, s.Disconnect(freeAddr(t)))
+	assert.Nil(t, s.Disconnect(removed))
+	eventually(t, func() bool { return len(s.Peers()) == 1 })
+	eventually(t, func() bool { return len(nodes[1].Peers()) == 0 })
+	assert.Equal(t, []string{nodes[2].Transporter.RemoteAddr()}, s.BootstrapNodes)
+}
+
+func TestBandwidth(t *testing.T) {
+	nodes := newNetwork(t, 2)
+	s, peer := nodes[0], nodes[1]
+
+	const size = 256 << 10
+	store := func(key string) time.Duration {
+		start := time.Now()
+		assert.Nil(t, s.Store(key, io.LimitReader(&pattern{}, size)))
+		eventually(t, func() bool { return peer.Has(s.KeyHash.HashKey(key)) })
+		return time.Since(start)
+	}
+
+	// The background budget doesn't hold the clients back.
+	s.SetBandwidth(BandwidthLimits{Background: Bandwidth{Outbound: 1, PeerOutbound: 1}})
+	assert.Less(t, store("fast"), time.Second)
+
+	// Half of the stream goes in the burst, the rest a second later.
+	s.SetBandwidth(BandwidthLimits{Foreground: Bandwidth{PeerOutbound: size / 2}})
+	assert.GreaterOrEqual(t, store("outbound"), 900*time.Millisecond)
+
+	// The peer bounds what it receives as well.
+	s.SetBandwidth(BandwidthLimits{})
+	peer.SetBandwidth(BandwidthLimits{Foreground: Bandwidth{Inbound: size / 2}})
+	assert.GreaterOrEqual(t, store("inbound"), 900*time.Millisecond)
+
+	// The streams of the background jobs don't wait for the foreground
+	// budget of the peer, spent by now.
+	start := time.Now()
+	ctx := withBackground(context.Background())
+	data, _ := io.ReadAll(io.LimitReader(&pattern{}, size))
+	assert.Nil(t, s.sendStream(ctx, s.peerList()[0], network.StoreMessagePayload{Key: "background", Size: size}, bytes.NewReader(data)))
+	eventually(t, func() bool { return peer.Has("background") })
+	assert.Less(t, time.Since(start), 900*time.Millisecond)
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	nodes := newNetwork(t, 2)
+	s := nodes[0]
+	for _, node := range nodes {
+		node.tracer = tp.Tracer(tracerName)
+	}
+
+	// The peer writing its copy joins the trace of the store.
+	assert.Nil(t, s.Store("file", bytes.NewReader([]byte("Hello World"))))
+	eventually(t, func() bool { return len(spansNamed(exporter, "local write")) == 2 })
+	store := spansNamed(exporter, "Store")[0]
+	stream := spansNamed(exporter, "network stream")[0]
+	remote := spansNamed(exporter, "local write")[1]
+	assert.Equal(t, store.SpanContext.TraceID(), stream.SpanContext.TraceID())
+	assert.Equal(t, stream.SpanContext.SpanID(), remote.Parent.SpanID())
+	assert.True(t, remote.Parent.IsRemote())
+
+	// So does the peer reading its copy for a get.
+	exporter.Reset()
+	assert.Nil(t, s.Delete("file"))
+	_, r, err := s.Get("file")
+	assert.Nil(t, err)
+	r.(io.Closer).Close()
+	eventually(t, func() bool { return len(spansNamed(exporter, "remote store read")) == 1 })
+
+	get := spansNamed(exporter, "Get")[0]
+	stream = spansNamed(exporter, "network stream")[0]
+	read := spansNamed(exporter, "remote store read")[0]
+	assert.Equal(t, get.SpanContext.SpanID(), stream.Parent.SpanID())
+	assert.Equal(t, stream.SpanContext.SpanID(), read.Parent.SpanID())
+	assert.Equal(t, get.SpanContext.TraceID(), read.SpanContext.TraceID())
+	for _, name := range []string{"network stream", "local write"} {
+		spans := spansNamed(exporter, name)
+		assert.Len(t, spans, 1)
+		assert.Equal(t, get.SpanContext.TraceID(), spans[0].SpanContext.TraceID())
+	}
+	assert.Contains(t, get.Attributes, attrSource.String(metrics.SourceNetwork))
+}
+
+// spansNamed returns the spans of the exporter with the given name, in the
+// order they ended.
+func spansNamed(exporter *tracetest.InMemoryExporter, name string) []tracetest.SpanStub {
+	spans := []tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// metricValue returns the sum of the values of the metric name whose labels
+// include the given name and value pairs, the sample count of histograms.
+func metricValue(t *testing.T, m *metrics.Metrics, name string, labels ...string) float64 {
+	t.Helper()
+	families, err := m.Registry.Gather()
+	assert.Nil(t, err)
+
+	sum := 0.0
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for i := 0; i+1 < len(labels); i += 2 {
+				found := false
+				for _, label := range metric.GetLabel() {
+					found = found || label.GetName() == labels[i] && label.GetValue() == labels[i+1]
+				}
+				if !found {
+					continue metrics
+				}
+			}
+			switch {
+			case metric.Counter != nil:
+				sum += metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				sum += metric.Gauge.GetValue()
+			case metric.Histogram != nil:
+				sum += float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return sum
+}
+
+// assertEncrypted checks that the blob of key on disk isn't the plaintext
+// the store reads.
+func assertEncrypted(t *testing.T, s *FileServer, key string) {
+	t.Helper()
+
+	meta, err := s.Stat(key)
+	assert.Nil(t, err)
+	assert.True(t, meta.Encrypted)
+
+	_, r, err := s.store.Read(key)
+	assert.Nil(t, err)
+	defer r.(io.Closer).Close()
+	plain := make([]byte, 64)
+	_, err = io.ReadFull(r, plain)
+	assert.Nil(t, err)
+
+	blob, err := os.ReadFile(s.StorageRoot + "/" + s.PathTransformFunc(key).FullPath())
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(blob, plain))
+}
+
+// newNetwork starts n nodes, the first one connected to all the others.
+func newNetwork(t *testing.T, n int) []*FileServer {
+	nodes := make([]*FileServer, n)
+	addrs := make([]string, n)
+	for i := range nodes {
+		addrs[i] = freeAddr(t)
+		nodes[i] = newServer(t, addrs[i])
+		if i == 0 {
+			continue
+		}
+		go nodes[i].Start()
+	}
+
+	// The peers have to listen before the first node dials them.
+	time.Sleep(50 * time.Millisecond)
+	nodes[0].BootstrapNodes = addrs[1:]
+	go nodes[0].Start()
+
+	eventually(t, func() bool { return len(nodes[0].Peers()) == n-1 })
+
+	return nodes
+}
+
+// transportKey is the key the streams between the nodes are encrypted with,
+// the same on every node.
+var transportKey = cipher.NewEncryptionKey()
+
+func newServer(t *testing.T, addr string) *FileServer {
+	m := metrics.New()
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: addr,
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+		Metrics:       m,
+	})
+	s := NewFileServer(FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            transportKey,
+		StorageKey:        cipher.NewEncryptionKey(),
+		Metrics:           m,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerClose = s.OnPeerClose
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	return fmt.Sprintf(":%d", lis.Addr().(*net.TCPAddr).Port)
+}
+
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+	assert.Eventually(t, cond, 5*time.Second, 10*time.Millisecond)
+}
+
+// pattern is an endless reader of a repeating byte sequence.
+type pattern struct {
+	off int
+}
+
+func (p *pattern) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = byte(p.off % 251)
+		p.off++
+	}
+	return len(b), nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"natneam.github.io/dfs-core/network"
+)
+
+// drainPollInterval is how often Shutdown checks whether the calls and the
+// transfers in flight are done.
+const drainPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the server gracefully. It stops taking calls and peers,
+// tells the peers it's leaving and waits for the calls and the transfers in
+// flight, then closes the connections and waits for the background jobs to
+// return. When ctx is done first, what's still running is aborted and the
+// error of ctx is returned.
+func (s *FileServer) Shutdown(ctx context.Context) error {
+	s.closing.Store(true)
+	s.log.Info("Shutting down")
+
+	// The message waits for the transfers to the peers, which shouldn't
+	// hold up the draining.
+	left := make(chan struct{})
+	go func() {
+		defer close(left)
+		if err := s.broadcast(network.DataMessage{Payload: network.LeaveMessagePayload{}}); err != nil {
+			s.log.Warn("Failed to tell the peers the node is leaving", "err", err)
+		}
+	}()
+
+	err := s.drain(ctx, left)
+	if err != nil {
+		s.log.Warn("Aborting the transfers in flight", "calls", s.calls.Load(), "transfers", s.transfers.Load())
+	}
+
+	s.Stop()
+	s.Transporter.Close()
+	if werr := wait(ctx, &s.wg); err == nil {
+		err = werr
+	}
+
+	return err
+}
+
+// drain waits for left to be closed and for the calls and the transfers in
+// flight to finish.
+func (s *FileServer) drain(ctx context.Context, left <-chan struct{}) error {
+	select {
+	case <-left:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for s.calls.Load() > 0 || s.transfers.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// wait waits for wg until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// beginCall counts a call of a client until endCall, it fails once the
+// server is shutting down.
+func (s *FileServer) beginCall() error {
+	// Counted first, so Shutdown either sees the call or the call sees
+	// Shutdown.
+	s.calls.Add(1)
+	if s.closing.Load() {
+		s.calls.Add(-1)
+		return ErrServerClosed
+	}
+	return nil
+}
+
+func (s *FileServer) endCall() {
+	s.calls.Add(-1)
+}
+
+// handleMessageLeave stops sending to a peer which is shutting down. It's
+// kept until its connection is closed, to read what it's still sending.
+func (s *FileServer) handleMessageLeave(from string) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if h, ok := s.health[from]; ok {
+		h.leaving = true
+		s.log.Info("Peer is leaving", "peer", from)
+	}
+	return nil
+}
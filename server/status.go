@@ -0,0 +1,325 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"natneam.github.io/dfs-core/network"
+)
+
+// Version is the version of the node, set when building with
+// -ldflags "-X natneam.github.io/dfs-core/server.Version=<version>".
+var Version = "dev"
+
+// DefaultHeartbeatInterval is how often the peers are pinged by default.
+const DefaultHeartbeatInterval = 10 * time.Second
+
+// missedHeartbeats is the number of heartbeats a peer can miss before it's
+// reported unresponsive.
+const missedHeartbeats = 3
+
+// States of the peers.
+const (
+	PeerConnected    = "connected"
+	PeerUnresponsive = "unresponsive"
+	// PeerLeaving is a peer shutting down, which is no longer sent to.
+	PeerLeaving = "leaving"
+)
+
+// Names of the background jobs.
+const (
+	JobRepair = "repair"
+	JobReap   = "reap"
+	JobScrub  = "scrub"
+)
+
+// NodeStatus is the state of a node and of its connections.
+type NodeStatus struct {
+	// ID is the address the node listens on.
+	ID        string        `json:"id"`
+	Version   string        `json:"version"`
+	StartedAt time.Time     `json:"started_at"`
+	Uptime    time.Duration `json:"uptime"`
+	// Peers are the open connections with the peers.
+	Peers []PeerStatus `json:"peers"`
+	// StorageRoot is where the node keeps its files, DiskUsage the bytes
+	// they take there.
+	StorageRoot string `json:"storage_root"`
+	DiskUsage   int64  `json:"disk_usage"`
+	// Objects is the number of files of the node.
+	Objects int `json:"objects"`
+	// Transfers is the number of files being sent to or received from the
+	// peers.
+	Transfers int64       `json:"transfers"`
+	Jobs      []JobStatus `json:"jobs"`
+}
+
+// PeerStatus is the state of the connection with a peer.
+type PeerStatus struct {
+	Address     string    `json:"address"`
+	State       string    `json:"state"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// LastSeen is when the last message of the peer was received.
+	LastSeen time.Time `json:"last_seen"`
+	// RTT is the round trip time of the last ping, zero until the peer
+	// answered one.
+	RTT time.Duration `json:"rtt"`
+}
+
+// JobStatus is the state of a background job.
+type JobStatus struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+	Running  bool          `json:"running"`
+	// LastRun is when the last run started, and LastDuration how long it
+	// took.
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	LastError    string        `json:"last_error,omitempty"`
+}
+
+// peerHealth is what's known of the connection with a peer.
+type peerHealth struct {
+	connectedAt time.Time
+	lastSeen    time.Time
+	rtt         time.Duration
+	leaving     bool
+}
+
+// Status returns the state of the node.
+func (s *FileServer) Status() (NodeStatus, error) {
+	list, err := s.store.List("")
+	if err != nil {
+		return NodeStatus{}, err
+	}
+	usage, err := diskUsage(s.StorageRoot)
+	if err != nil {
+		return NodeStatus{}, err
+	}
+
+	status := NodeStatus{
+		ID:          s.Transporter.RemoteAddr(),
+		Version:     Version,
+		Peers:       s.peerStatus(),
+		StorageRoot: s.StorageRoot,
+		DiskUsage:   usage,
+		Objects:     len(list),
+		Transfers:   s.transfers.Load(),
+		Jobs:        s.jobStatus(),
+	}
+	if startedAt := s.startedAt.Load(); startedAt != nil {
+		status.StartedAt = *startedAt
+		status.Uptime = time.Since(*startedAt)
+	}
+
+	return status, nil
+}
+
+func (s *FileServer) peerStatus() []PeerStatus {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	now := time.Now()
+	timeout := missedHeartbeats * s.heartbeatInterval()
+	peers := make([]PeerStatus, 0, len(s.health))
+	for addr, h := range s.health {
+		state := PeerConnected
+		switch {
+		case h.leaving:
+			state = PeerLeaving
+		case now.Sub(h.lastSeen) > timeout:
+			state = PeerUnresponsive
+		}
+		peers = append(peers, PeerStatus{
+			Address:     addr,
+			State:       state,
+			ConnectedAt: h.connectedAt,
+			LastSeen:    h.lastSeen,
+			RTT:         h.rtt,
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Address < peers[j].Address })
+
+	return peers
+}
+
+func (s *FileServer) jobStatus() []JobStatus {
+	s.jobLock.Lock()
+	jobs := make([]JobStatus, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.jobLock.Unlock()
+
+	// The scrubs started on demand don't go through runJob.
+	scrub := s.ScrubProgress()
+	for i, job := range jobs {
+		if job.Name != JobScrub || !scrub.StartedAt.After(job.LastRun) {
+			continue
+		}
+		jobs[i].Running = scrub.Running
+		jobs[i].LastRun = scrub.StartedAt
+		jobs[i].LastDuration = 0
+		if !scrub.Running {
+			jobs[i].LastDuration = scrub.FinishedAt.Sub(scrub.StartedAt)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	return jobs
+}
+
+// registerJob records a background job running every interval.
+func (s *FileServer) registerJob(name string, interval time.Duration) {
+	s.jobLock.Lock()
+	defer s.jobLock.Unlock()
+	s.jobs[name] = &JobStatus{Name: name, Interval: interval}
+}
+
+// runJob runs a background job and records how it went.
+func (s *FileServer) runJob(name string, run func() error) error {
+	start := time.Now()
+	s.updateJob(name, func(job *JobStatus) {
+		job.Running = true
+		job.LastRun = start.UTC()
+	})
+
+	err := run()
+
+	s.updateJob(name, func(job *JobStatus) {
+		job.Running = false
+		job.LastDuration = time.Since(start)
+		job.LastError = ""
+		if err != nil {
+			job.LastError = err.Error()
+		}
+	})
+	return err
+}
+
+func (s *FileServer) updateJob(name string, update func(*JobStatus)) {
+	s.jobLock.Lock()
+	defer s.jobLock.Unlock()
+
+	job, ok := s.jobs[name]
+	if !ok {
+		job = &JobStatus{Name: name}
+		s.jobs[name] = job
+	}
+	update(job)
+}
+
+// trackTransfer counts a transfer in flight until the returned function is
+// called.
+func (s *FileServer) trackTransfer() func() {
+	s.transfers.Add(1)
+	return func() { s.transfers.Add(-1) }
+}
+
+// seen records that a message of the peer was received.
+func (s *FileServer) seen(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if h, ok := s.health[addr]; ok {
+		h.lastSeen = time.Now()
+	}
+}
+
+// ping sends a ping to the peer, whose pong measures the round trip time.
+func (s *FileServer) ping(peer network.Peer) error {
+	msg, err := encodeMessage(network.DataMessage{
+		Payload: network.PingMessagePayload{Sent: time.Now()},
+	})
+	if err != nil {
+		return err
+	}
+	return s.sendTo(peer, msg)
+}
+
+func (s *FileServer) handleMessagePing(from string, msg network.PingMessagePayload) error {
+	if msg.Pong {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+
+		if h, ok := s.health[from]; ok {
+			h.rtt = time.Since(msg.Sent)
+		}
+		return nil
+	}
+
+	peer, ok := s.peer(from)
+	if !ok {
+		return nil
+	}
+	pong, err := encodeMessage(network.DataMessage{
+		Payload: network.PingMessagePayload{Sent: msg.Sent, Pong: true},
+	})
+	if err != nil {
+		return err
+	}
+	return s.sendTo(peer, pong)
+}
+
+func (s *FileServer) heartbeatInterval() time.Duration {
+	if s.HeartbeatInterval <= 0 {
+		return DefaultHeartbeatInterval
+	}
+	return s.HeartbeatInterval
+}
+
+// heartbeatLoop pings the peers every HeartbeatInterval until the server
+// stops.
+func (s *FileServer) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeatInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range s.peerList() {
+				if err := s.ping(peer); err != nil {
+					s.log.Debug("Failed to ping a peer", "peer", peer.RemoteAddr().String(), "err", err)
+				}
+			}
+		case <-s.quitchan:
+			return
+		}
+	}
+}
+
+// diskUsage returns the size of the files under root, nothing when it
+// doesn't exist.
+func diskUsage(root string) (int64, error) {
+	if len(root) == 0 {
+		return 0, nil
+	}
+
+	var size int64
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may go while the walk runs.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
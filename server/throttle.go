@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Bandwidth bounds the bytes per second transferred with the peers, zero
+// doesn't bound them.
+type Bandwidth struct {
+	// Outbound and Inbound bound the transfers with all the peers
+	// together.
+	Outbound int64
+	Inbound  int64
+	// PeerOutbound and PeerInbound bound the transfers with each peer.
+	PeerOutbound int64
+	PeerInbound  int64
+}
+
+// BandwidthLimits are the budgets of the transfers made for the calls of
+// the clients, and of the ones the background jobs make, so the repairs
+// and the scrubs don't starve the clients and the other way around.
+type BandwidthLimits struct {
+	Foreground Bandwidth
+	Background Bandwidth
+}
+
+type backgroundKey struct{}
+
+// withBackground marks the transfers made with ctx as background ones.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	background, _ := ctx.Value(backgroundKey{}).(bool)
+	return background
+}
+
+// tokenBucket lets rate bytes through per second, in bursts of up to a
+// second of them.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.rate = float64(rate)
+	b.tokens = min(b.tokens, b.rate)
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// they go through. The bucket goes in debt for the bytes it doesn't have,
+// so a transfer larger than the burst only waits longer.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = b.rate
+	} else {
+		b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// bucketKey names a bucket: the one of every peer when peer is empty.
+type bucketKey struct {
+	peer       string
+	background bool
+	inbound    bool
+}
+
+// throttle keeps the buckets of the bandwidth limits, those of a peer are
+// made the first time it's transferred with.
+type throttle struct {
+	lock    sync.Mutex
+	limits  BandwidthLimits
+	buckets map[bucketKey]*tokenBucket
+}
+
+func newThrottle(limits BandwidthLimits) *throttle {
+	return &throttle{
+		limits:  limits,
+		buckets: make(map[bucketKey]*tokenBucket),
+	}
+}
+
+// rate returns the rate of the bucket of key, as limits says.
+func (t *throttle) rate(key bucketKey) int64 {
+	b := t.limits.Foreground
+	if key.background {
+		b = t.limits.Background
+	}
+
+	switch {
+	case len(key.peer) == 0 && key.inbound:
+		return b.Inbound
+	case len(key.peer) == 0:
+		return b.Outbound
+	case key.inbound:
+		return b.PeerInbound
+	default:
+		return b.PeerOutbound
+	}
+}
+
+func (t *throttle) bucket(key bucketKey) *tokenBucket {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &tokenBucket{}
+		b.setRate(t.rate(key))
+		t.buckets[key] = b
+	}
+	return b
+}
+
+func (t *throttle) setLimits(limits BandwidthLimits) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.limits = limits
+	for key, b := range t.buckets {
+		b.setRate(t.rate(key))
+	}
+}
+
+// forget drops the buckets of a peer.
+func (t *throttle) forget(peer string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for key := range t.buckets {
+		if key.peer == peer {
+			delete(t.buckets, key)
+		}
+	}
+}
+
+// wait waits until n bytes may be transferred with peer, both for all the
+// peers and for this one, or until quit is closed.
+func (t *throttle) wait(peer string, background, inbound bool, n int, quit <-chan struct{}) error {
+	delay := max(
+		t.bucket(bucketKey{background: background, inbound: inbound}).reserve(n),
+		t.bucket(bucketKey{peer: peer, background: background, inbound: inbound}).reserve(n),
+	)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-quit:
+		return ErrServerClosed
+	}
+}
+
+// SetBandwidth changes the bandwidth limits of the server while it runs.
+func (s *FileServer) SetBandwidth(limits BandwidthLimits) {
+	s.throttle.setLimits(limits)
+}
+
+// limitReader reads from r, a stream of peer, within the inbound bandwidth.
+// The bytes are counted once they're read, the peer is slowed down by TCP
+// flow control while the reads wait.
+func (s *FileServer) limitReader(r io.Reader, peer string, background bool) io.Reader {
+	return &throttledReader{r: r, wait: func(n int) error {
+		return s.throttle.wait(peer, background, true, n, s.quitchan)
+	}}
+}
+
+// limitWriter writes to w, a stream to peer, within the outbound bandwidth.
+func (s *FileServer) limitWriter(w io.Writer, peer string, background bool) io.Writer {
+	return &throttledWriter{w: w, wait: func(n int) error {
+		return s.throttle.wait(peer, background, false, n, s.quitchan)
+	}}
+}
+
+type throttledReader struct {
+	r    io.Reader
+	wait func(n int) error
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.wait(n); werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	w    io.Writer
+	wait func(n int) error
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	if err := t.wait(len(p)); err != nil {
+		return 0, err
+	}
+	return t.w.Write(p)
+}
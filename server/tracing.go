@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of the server.
+const tracerName = "natneam.github.io/dfs-core/server"
+
+// Attributes of the spans.
+const (
+	attrKey    = attribute.Key("dfs.key")
+	attrPeer   = attribute.Key("dfs.peer")
+	attrSource = attribute.Key("dfs.source")
+	attrBytes  = attribute.Key("dfs.bytes")
+)
+
+// propagator carries the trace context of a request to the peers, in the
+// messages sent to them.
+var propagator = propagation.TraceContext{}
+
+// injectTrace returns the trace context of ctx to send along a message.
+func injectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// extractTrace returns a context with the trace context a message came
+// with, the spans of its handling belong to the trace of the sender.
+func extractTrace(carrier map[string]string) context.Context {
+	return propagator.Extract(context.Background(), propagation.MapCarrier(carrier))
+}
+
+func (s *FileServer) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends the span, failed when err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
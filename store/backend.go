@@ -0,0 +1,167 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+
+	"natneam.github.io/dfs-core/cipher"
+)
+
+// Backend keeps the files of a node. Store keeps them on disk, MemoryStore
+// in memory and BoltStore in a single file database.
+type Backend interface {
+	// Write stores the content read from r under key. The previous content
+	// is only replaced once r is read in full.
+	Write(key string, r io.Reader) (int64, error)
+	// WriteWith is Write recording the attributes of opts.
+	WriteWith(key string, r io.Reader, opts WriteOpts) (int64, error)
+	// Read returns the size and the content of key. The reader is an
+	// io.Closer when it holds resources which have to be released.
+	Read(key string) (int64, io.Reader, error)
+	Has(key string) bool
+	Delete(key string) error
+	// List returns the metadata of the files whose key starts with prefix,
+	// sorted by key.
+	List(prefix string) ([]Metadata, error)
+	Stat(key string) (Metadata, error)
+}
+
+var (
+	_ Backend = (*Store)(nil)
+	_ Backend = (*MemoryStore)(nil)
+	_ Backend = (*BoltStore)(nil)
+)
+
+// encodeBlob lets copyFn write the content of key into blob, compressed as
+// opts say and then encrypted with encKey when it's set unless opts say
+// otherwise, and returns the metadata of the content.
+func encodeBlob(blob io.Writer, key string, encKey []byte, opts WriteOpts, copyFn func(io.Writer) (int64, error)) (int64, Metadata, error) {
+	if opts.Plaintext {
+		encKey = nil
+	}
+
+	w := blob
+	if encKey != nil {
+		var err error
+		if w, err = cipher.NewEncryptWriter(encKey, blob); err != nil {
+			return 0, Metadata{}, err
+		}
+	}
+
+	// The content is written through the compress writer even when it's
+	// not to be compressed, for the one starting like the compression
+	// header to be compressed anyway.
+	cw, err := newCompressWriter(w, opts.Compression)
+	if err != nil {
+		return 0, Metadata{}, err
+	}
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	n, err := copyFn(io.MultiWriter(cw, hash, counter))
+	if err != nil {
+		return 0, Metadata{}, err
+	}
+
+	compressed, err := cw.Close()
+	if err != nil {
+		return 0, Metadata{}, err
+	}
+	compression := ""
+	if compressed {
+		compression = cw.name
+	}
+
+	return n, Metadata{
+		Key:         key,
+		Size:        counter.n,
+		ModTime:     time.Now().UTC(),
+		Checksum:    hex.EncodeToString(hash.Sum(nil)),
+		Encrypted:   encKey != nil,
+		WrappedKey:  opts.WrappedKey,
+		Erasure:     opts.Erasure,
+		ExpiresAt:   opts.ExpiresAt,
+		Compression: compression,
+		ETag:        opts.ETag,
+		Replica:     opts.Replica,
+	}, nil
+}
+
+// decodeBlob returns the reader of the content of the blob described by
+// meta, decrypting it if the blob is encrypted and decompressing it if it
+// starts with the compression header. The header tells the algorithm, so
+// the blob is read back whatever meta and the settings it was written with
+// say.
+func decodeBlob(meta Metadata, encKey []byte, blob io.ReadCloser) (io.ReadCloser, error) {
+	r := blob
+	if meta.Encrypted {
+		if encKey == nil {
+			return nil, ErrNoKey
+		}
+		var err error
+		if r, err = cipher.NewDecryptReader(encKey, blob); err != nil {
+			return nil, err
+		}
+	}
+
+	header := make([]byte, len(compressionMagic))
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	r = rewind(r, header[:n])
+	if !bytes.Equal(header[:n], compressionMagic) {
+		return r, nil
+	}
+
+	zr, err := newDecompressReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &multiCloser{Reader: zr, closers: []io.Closer{zr, r}}, nil
+}
+
+// rewind returns r as it was before head was read from it, seeking back
+// when it can so the reader of the content still seeks.
+func rewind(r io.ReadCloser, head []byte) io.ReadCloser {
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+			return r
+		}
+	}
+	return &multiCloser{Reader: io.MultiReader(bytes.NewReader(head), r), closers: []io.Closer{r}}
+}
+
+// multiCloser closes every closer of the reader.
+type multiCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (m *multiCloser) Close() error {
+	errs := []error{}
+	for _, c := range m.closers {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// notExist is the error of the backends which don't keep files on disk for
+// a missing key, it matches os.ErrNotExist like the errors of Store.
+func notExist(op, key string) error {
+	return &fs.PathError{Op: op, Path: key, Err: fs.ErrNotExist}
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
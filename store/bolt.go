@@ -0,0 +1,178 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket = []byte("meta")
+	blobBucket = []byte("blobs")
+)
+
+type BoltStoreOpts struct {
+	// Path is the database file, it's created when missing.
+	Path string
+	// EncKey encrypts the blobs written to the database, they're written
+	// in clear when it's nil.
+	EncKey []byte
+}
+
+// BoltStore keeps the files in a single file database, which suits many
+// small files better than a file each. Every file is held in memory while
+// it's written or read.
+type BoltStore struct {
+	BoltStoreOpts
+
+	db *bolt.DB
+}
+
+// OpenBoltStore opens the database at opts.Path, the store has to be closed
+// once done with.
+func OpenBoltStore(opts BoltStoreOpts) (*BoltStore, error) {
+	db, err := bolt.Open(opts.Path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(metaBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(blobBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{BoltStoreOpts: opts, db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Write(key string, r io.Reader) (int64, error) {
+	return s.WriteWith(key, r, WriteOpts{})
+}
+
+// WriteWith reads the whole content before replacing the file, the blob
+// and its metadata are replaced in a single transaction.
+func (s *BoltStore) WriteWith(key string, r io.Reader, opts WriteOpts) (int64, error) {
+	blob := new(bytes.Buffer)
+	n, meta, err := encodeBlob(blob, key, s.EncKey, opts, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(metaBucket).Put([]byte(key), data); err != nil {
+			return err
+		}
+		return tx.Bucket(blobBucket).Put([]byte(key), blob.Bytes())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (s *BoltStore) Read(key string) (int64, io.Reader, error) {
+	var meta Metadata
+	var blob []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if meta, err = s.stat(tx, key); err != nil {
+			return err
+		}
+		// The values are only valid during the transaction.
+		blob = bytes.Clone(tx.Bucket(blobBucket).Get([]byte(key)))
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r, err := decodeBlob(meta, s.EncKey, io.NopCloser(bytes.NewReader(blob)))
+	if err != nil {
+		return 0, nil, err
+	}
+	return meta.Size, r, nil
+}
+
+func (s *BoltStore) Has(key string) bool {
+	_, err := s.Stat(key)
+	return err == nil
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta.Get([]byte(key)) == nil {
+			return notExist("remove", key)
+		}
+
+		if err := meta.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(blobBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltStore) List(prefix string) ([]Metadata, error) {
+	list := []Metadata{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// The cursor walks the keys in order.
+		c := tx.Bucket(metaBucket).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			var meta Metadata
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return err
+			}
+			list = append(list, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (s *BoltStore) Stat(key string) (Metadata, error) {
+	var meta Metadata
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		meta, err = s.stat(tx, key)
+		return err
+	})
+	return meta, err
+}
+
+func (s *BoltStore) stat(tx *bolt.Tx, key string) (Metadata, error) {
+	data := tx.Bucket(metaBucket).Get([]byte(key))
+	if data == nil {
+		return Metadata{}, notExist("stat", key)
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Metadata{}, err
+	}
+	return meta, nil
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of the compression algorithms.
+const (
+	CompressionZstd   = "zstd"
+	CompressionGzip   = "gzip"
+	CompressionSnappy = "snappy"
+)
+
+// compressionMagic starts the header of a compressed object, followed by the
+// id of the algorithm.
+var compressionMagic = []byte("DFSZ")
+
+const (
+	// compressionSample is how much of the content the decision to
+	// compress it is taken on.
+	compressionSample = 64 << 10
+	// minCompressedSize is the size below which content isn't worth
+	// compressing.
+	minCompressedSize = 256
+	// minCompressibility is the estimate of compress.Estimate below which
+	// the content is taken as compressed already.
+	minCompressibility = 0.1
+)
+
+type compression struct {
+	// id is the byte recorded in the object header, never to be changed.
+	id     byte
+	writer func(io.Writer) (io.WriteCloser, error)
+	reader func(io.Reader) (io.ReadCloser, error)
+}
+
+var compressions = map[string]compression{
+	CompressionZstd: {
+		id: 1,
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	CompressionGzip: {
+		id: 2,
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	CompressionSnappy: {
+		id: 3,
+		writer: func(w io.Writer) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		reader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(snappy.NewReader(r)), nil
+		},
+	},
+}
+
+// Compressions returns the names of the supported compression algorithms.
+func Compressions() []string {
+	names := make([]string, 0, len(compressions))
+	for name := range compressions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validCompression(name string) bool {
+	_, ok := compressions[name]
+	return ok
+}
+
+// compressWriter compresses what it's written to dst, behind the object
+// header. It holds the start of the content back to tell whether it's
+// worth compressing, and writes it as is otherwise.
+type compressWriter struct {
+	dst    io.Writer
+	name   string
+	c      compression
+	sample []byte
+	// plain is set when no compression is asked for, only the content
+	// starting like the object header is compressed then, so it isn't
+	// taken for the header when it's read back.
+	plain bool
+	// w is where the content goes once the decision is taken, zw when
+	// it's compressed.
+	w  io.Writer
+	zw io.WriteCloser
+}
+
+func newCompressWriter(dst io.Writer, name string) (*compressWriter, error) {
+	if len(name) == 0 {
+		return &compressWriter{dst: dst, name: CompressionZstd, c: compressions[CompressionZstd], plain: true}, nil
+	}
+	c, ok := compressions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return &compressWriter{dst: dst, name: name, c: c}, nil
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.w != nil {
+		return cw.w.Write(p)
+	}
+
+	cw.sample = append(cw.sample, p...)
+	if len(cw.sample) < compressionSample && !(cw.plain && len(cw.sample) >= len(compressionMagic)) {
+		return len(p), nil
+	}
+	if err := cw.decide(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes what's held back and ends the compressed stream, and
+// reports whether the content was compressed.
+func (cw *compressWriter) Close() (bool, error) {
+	if cw.w == nil {
+		if err := cw.decide(); err != nil {
+			return false, err
+		}
+	}
+	if cw.zw == nil {
+		return false, nil
+	}
+	return true, cw.zw.Close()
+}
+
+func (cw *compressWriter) decide() error {
+	sample := cw.sample
+	cw.sample = nil
+
+	raw := len(sample) < minCompressedSize || compressed(sample)
+	if cw.plain {
+		raw = !bytes.HasPrefix(sample, compressionMagic)
+	}
+	if raw {
+		cw.w = cw.dst
+		_, err := cw.dst.Write(sample)
+		return err
+	}
+
+	header := append(bytes.Clone(compressionMagic), cw.c.id)
+	if _, err := cw.dst.Write(header); err != nil {
+		return err
+	}
+	zw, err := cw.c.writer(cw.dst)
+	if err != nil {
+		return err
+	}
+	cw.w, cw.zw = zw, zw
+	_, err = zw.Write(sample)
+	return err
+}
+
+// compressedMagic are the signatures of the common formats which are
+// compressed already.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},             // gzip
+	{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+	{0xff, 0x06, 0x00, 0x00, 0x73, 0x4e, 0x61, 0x50, 0x70, 0x59}, // snappy
+	[]byte("BZh"),                      // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	[]byte("PK\x03\x04"),               // zip, jar, docx...
+	[]byte("Rar!"),                     // rar
+	{0xff, 0xd8, 0xff},                 // jpeg
+	[]byte("\x89PNG"),                  // png
+	[]byte("GIF8"),                     // gif
+	[]byte("OggS"),                     // ogg
+	[]byte("fLaC"),                     // flac
+	[]byte("ID3"),                      // mp3
+}
+
+// compressed tells whether the content starting with sample looks
+// compressed already, by its signature or by how little it would shrink.
+func compressed(sample []byte) bool {
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(sample, magic) {
+			return true
+		}
+	}
+	// The mp4 family has its signature after the size of the first box.
+	if len(sample) >= 8 && string(sample[4:8]) == "ftyp" {
+		return true
+	}
+
+	return compress.Estimate(sample) < minCompressibility
+}
+
+// newDecompressReader reads the object header of r and returns the reader
+// of the decompressed content.
+func newDecompressReader(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, len(compressionMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read the compression header: %w", err)
+	}
+	if !bytes.HasPrefix(header, compressionMagic) {
+		return nil, fmt.Errorf("invalid compression header")
+	}
+
+	id := header[len(header)-1]
+	for _, c := range compressions {
+		if c.id == id {
+			return c.reader(r)
+		}
+	}
+	return nil, fmt.Errorf("unknown compression %d", id)
+}
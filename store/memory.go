@@ -0,0 +1,117 @@
+package store
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MemoryStoreOpts struct {
+	// EncKey encrypts the content kept in memory, it's kept in clear when
+	// it's nil.
+	EncKey []byte
+}
+
+// MemoryStore keeps the files in memory, they're lost when the process
+// exits. It's meant for tests.
+type MemoryStore struct {
+	MemoryStoreOpts
+
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	meta Metadata
+	blob []byte
+}
+
+func NewMemoryStore(opts MemoryStoreOpts) *MemoryStore {
+	return &MemoryStore{
+		MemoryStoreOpts: opts,
+		objects:         make(map[string]memoryObject),
+	}
+}
+
+func (s *MemoryStore) Write(key string, r io.Reader) (int64, error) {
+	return s.WriteWith(key, r, WriteOpts{})
+}
+
+func (s *MemoryStore) WriteWith(key string, r io.Reader, opts WriteOpts) (int64, error) {
+	blob := new(bytes.Buffer)
+	n, meta, err := encodeBlob(blob, key, s.EncKey, opts, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	s.objects[key] = memoryObject{meta: meta, blob: blob.Bytes()}
+	s.mu.Unlock()
+
+	return n, nil
+}
+
+func (s *MemoryStore) Read(key string) (int64, io.Reader, error) {
+	s.mu.RLock()
+	obj, ok := s.objects[key]
+	s.mu.RUnlock()
+	if !ok {
+		return 0, nil, notExist("open", key)
+	}
+
+	// The blob is never modified, a new one replaces it.
+	r, err := decodeBlob(obj.meta, s.EncKey, io.NopCloser(bytes.NewReader(obj.blob)))
+	if err != nil {
+		return 0, nil, err
+	}
+	return obj.meta.Size, r, nil
+}
+
+func (s *MemoryStore) Has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.objects[key]
+	return ok
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.objects[key]; !ok {
+		return notExist("remove", key)
+	}
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *MemoryStore) List(prefix string) ([]Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []Metadata{}
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			list = append(list, obj.meta)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list, nil
+}
+
+func (s *MemoryStore) Stat(key string) (Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return Metadata{}, notExist("stat", key)
+	}
+	return obj.meta, nil
+}
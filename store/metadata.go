@@ -0,0 +1,287 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metaSuffix is appended to the blob path to get the path of its metadata
+// file. The metadata lives next to the blob so it moves and gets deleted
+// together with it.
+const metaSuffix = ".meta"
+
+// pendingSuffix ends the names of the metadata files being written, which
+// are the metadata path followed by a random number and the suffix.
+const pendingSuffix = ".tmp"
+
+// Metadata describes an object kept in the store. Since the path transform
+// may be a one way hash, the metadata is the only place the original key is
+// recorded, which makes it the index used for listing the store.
+type Metadata struct {
+	Key      string    `json:"key"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Checksum string    `json:"checksum"`
+	// Encrypted is set when the blob is encrypted with the key of the
+	// store. Size and Checksum always describe the plaintext.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// WrappedKey is the data key of a file encrypted end to end by the
+	// client, wrapped by the client's key. The node can't read such files,
+	// Size and Checksum describe the ciphertext.
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	// Hash is the name of the key hash the blob is laid out with, empty
+	// when the store doesn't know it.
+	Hash string `json:"hash,omitempty"`
+	// Erasure is set when the file is erasure coded into shards kept by
+	// the peers, the blob is then empty.
+	Erasure *Erasure `json:"erasure,omitempty"`
+	// ExpiresAt is when the file expires, the zero time when it doesn't.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Compression is the algorithm the blob is compressed with, behind a
+	// header naming it, empty when it isn't.
+	Compression string `json:"compression,omitempty"`
+	// ETag is the entity tag of an object stored through the S3 gateway,
+	// the MD5 of its content like S3 reports it.
+	ETag string `json:"etag,omitempty"`
+	// Replica is set on the copies kept for a peer, whose key is the hash
+	// of the key of the file on the peer.
+	Replica bool `json:"replica,omitempty"`
+}
+
+// Expired reports whether the file has expired by t.
+func (m Metadata) Expired(t time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !t.Before(m.ExpiresAt)
+}
+
+// Erasure describes a file erasure coded into DataShards+ParityShards
+// shards, any DataShards of which rebuild the file.
+type Erasure struct {
+	DataShards   int `json:"data_shards"`
+	ParityShards int `json:"parity_shards"`
+	// ShardSize is the size of every shard.
+	ShardSize int64 `json:"shard_size"`
+	// Size and Checksum describe the file.
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+	// Peers are the addresses of the peers keeping the shards, by index.
+	// It's empty for the shards which couldn't be placed.
+	Peers []string `json:"peers"`
+	// Replica is set on the copies of the shard map the peers keep, the
+	// node the file was stored on is the one repairing its shards.
+	Replica bool `json:"replica,omitempty"`
+}
+
+// pendingMetadata is the metadata of a write under way, along with the
+// name of the temporary blob it describes. The blob is in place already
+// when the name is empty.
+type pendingMetadata struct {
+	Metadata
+	Blob string `json:"blob,omitempty"`
+}
+
+// Stat returns the metadata of the given key. Blobs written before the
+// metadata index existed get their metadata derived from the file itself.
+func (s *Store) Stat(key string) (Metadata, error) {
+	meta, err := s.readMetadata(key)
+	if err == nil {
+		return meta, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Metadata{}, err
+	}
+
+	fi, err := os.Stat(s.fullPath(key))
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	return Metadata{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// List returns the metadata of every object whose key starts with prefix,
+// sorted by key.
+func (s *Store) List(prefix string) ([]Metadata, error) {
+	list := []Metadata{}
+
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(path, metaSuffix) {
+			return nil
+		}
+
+		meta, err := loadMetadata(path, strings.TrimSuffix(path, metaSuffix))
+		if err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(meta.Key, prefix) {
+			list = append(list, meta)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	return list, nil
+}
+
+func (s *Store) metadataPath(key string) string {
+	return s.fullPath(key) + metaSuffix
+}
+
+func (s *Store) readMetadata(key string) (Metadata, error) {
+	return loadMetadata(s.metadataPath(key), s.fullPath(key))
+}
+
+func (s *Store) writeMetadata(meta Metadata) error {
+	unlock := s.writes.lock(meta.Key)
+	defer unlock()
+
+	pending, err := s.writePendingMetadata(meta, "")
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(pending, s.metadataPath(meta.Key)); err != nil {
+		os.Remove(pending)
+		return err
+	}
+	s.removePending(meta.Key)
+	return nil
+}
+
+// writePendingMetadata writes the metadata of the temporary blob next to
+// the current one and returns its path, it replaces the current one once
+// it's renamed. Until then a crash never leaves a half written metadata
+// file behind.
+func (s *Store) writePendingMetadata(meta Metadata, blob string) (string, error) {
+	data, err := json.Marshal(pendingMetadata{Metadata: meta, Blob: filepath.Base(blob)})
+	if err != nil {
+		return "", err
+	}
+
+	path := s.metadataPath(meta.Key)
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+pendingSuffix)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// removePending removes the pending metadata of the key, left by the
+// writes a crash cut short.
+func (s *Store) removePending(key string) {
+	for _, path := range pendingPaths(s.metadataPath(key)) {
+		os.Remove(path)
+	}
+}
+
+// pendingPaths returns the paths of the pending metadata files of the
+// metadata at path.
+func pendingPaths(path string) []string {
+	dir, base := filepath.Split(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok {
+			continue
+		}
+		// Only the random number os.CreateTemp puts in is left, the
+		// metadata of another key may share the prefix otherwise.
+		name, ok = strings.CutSuffix(name, pendingSuffix)
+		if ok && len(name) > 0 && strings.Trim(name, "0123456789") == "" {
+			paths = append(paths, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return paths
+}
+
+// loadMetadata returns the metadata at path of the blob at blobPath. The
+// pending metadata is the one of the blob when the blob was renamed but the
+// metadata wasn't yet, by a write under way or cut short by a crash: its
+// temporary blob is gone.
+func loadMetadata(path, blobPath string) (Metadata, error) {
+	meta, err := decodeMetadata(path)
+
+	found := false
+	latest := pendingMetadata{}
+	for _, pendingPath := range pendingPaths(path) {
+		pending, pendingErr := decodePendingMetadata(pendingPath)
+		if pendingErr != nil {
+			continue
+		}
+		if len(pending.Blob) > 0 {
+			if _, statErr := os.Stat(filepath.Join(filepath.Dir(blobPath), pending.Blob)); !errors.Is(statErr, os.ErrNotExist) {
+				continue
+			}
+		}
+		if !found || pending.ModTime.After(latest.ModTime) {
+			found, latest = true, pending
+		}
+	}
+	if found {
+		return latest.Metadata, nil
+	}
+
+	return meta, err
+}
+
+func decodePendingMetadata(path string) (pendingMetadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return pendingMetadata{}, err
+	}
+
+	var pending pendingMetadata
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return pendingMetadata{}, err
+	}
+
+	return pending, nil
+}
+
+func decodeMetadata(path string) (Metadata, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Metadata{}, err
+	}
+
+	return meta, nil
+}
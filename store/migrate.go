@@ -0,0 +1,175 @@
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"natneam.github.io/dfs-core/cipher"
+)
+
+// Migration reports what Migrate did.
+type Migration struct {
+	// Moved is the number of files laid out with the new layout.
+	Moved int
+	// Skipped is the number of files which already were.
+	Skipped int
+	// Unknown are the blobs without metadata, their key is unknown so they
+	// can't be moved.
+	Unknown []string
+	// Replicas are the blobs of the copies kept for the peers, which are
+	// left in place. Their key is the hash of the key of the file on the
+	// peer, which can't be hashed again into the new layout.
+	Replicas []string
+}
+
+// Migrate moves the files of the store described by from to the layout of
+// to, e.g. when switching from DefaultPathTransformFunc to a hashed layout.
+// Both usually share their root. The blobs are moved as they are, so the
+// keys of the stores don't matter. The node using the store must be
+// stopped.
+//
+// The keys can't be recovered from their paths, so files are found through
+// their metadata and blobs written before the metadata existed are left
+// where they are.
+//
+// Every file is moved by renaming its blob and then replacing its metadata,
+// so a file is always whole in one of the layouts and a migration that was
+// interrupted finishes when it's run again. The copies kept for the peers
+// are left in place, see Migration.Replicas.
+func Migrate(from, to StoreOpts) (Migration, error) {
+	return migrate(NewStore(from), NewStore(to))
+}
+
+// MigrateHash lays the store at root out with the to hash instead of from,
+// e.g. to move a store off MD5.
+func MigrateHash(root string, from, to cipher.KeyHash) (Migration, error) {
+	return Migrate(StoreOpts{Root: root, KeyHash: from}, StoreOpts{Root: root, KeyHash: to})
+}
+
+func migrate(src, dst *Store) (Migration, error) {
+	result := Migration{}
+	metaPaths, blobs := []string{}, []string{}
+	err := filepath.WalkDir(src.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		if strings.HasSuffix(path, metaSuffix) {
+			metaPaths = append(metaPaths, path)
+			return nil
+		}
+		blobs = append(blobs, path)
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, metaPath := range metaPaths {
+		meta, err := decodeMetadata(metaPath)
+		if err != nil {
+			return result, err
+		}
+		if isReplica(src, meta) {
+			result.Replicas = append(result.Replicas, src.fullPath(meta.Key))
+			continue
+		}
+
+		moved, err := migrateFile(src, dst, metaPath, meta)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", meta.Key, err)
+		}
+		if moved {
+			result.Moved++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	// Checked once the files are moved, as the blobs moved by an
+	// interrupted run are only joined by their metadata now.
+	for _, path := range blobs {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if _, err := os.Stat(path + metaSuffix); errors.Is(err, os.ErrNotExist) {
+			result.Unknown = append(result.Unknown, path)
+		}
+	}
+
+	return result, nil
+}
+
+// isReplica reports whether the file is a copy kept for a peer. The copies
+// written before they were marked as such are told by their key, shaped
+// like a hash of the source layout.
+func isReplica(src *Store, meta Metadata) bool {
+	if meta.Replica {
+		return true
+	}
+	if src.KeyHash == nil || len(meta.Key) != len(src.KeyHash.HashKey("")) {
+		return false
+	}
+	_, err := hex.DecodeString(meta.Key)
+	return err == nil
+}
+
+// migrateFile moves the file described by the metadata at metaPath from
+// the layout of src to the one of dst.
+func migrateFile(src, dst *Store, metaPath string, meta Metadata) (bool, error) {
+	from, to := src.fullPath(meta.Key), dst.fullPath(meta.Key)
+
+	hash := ""
+	if dst.KeyHash != nil {
+		hash = dst.KeyHash.Name()
+	}
+
+	if filepath.Clean(metaPath) == filepath.Clean(dst.metadataPath(meta.Key)) {
+		if meta.Hash == hash {
+			return false, nil
+		}
+		// Laid out by the new hash but not recorded as such.
+		meta.Hash = hash
+		return false, dst.writeMetadata(meta)
+	}
+
+	if filepath.Clean(metaPath) != filepath.Clean(src.metadataPath(meta.Key)) {
+		return false, fmt.Errorf("%s is in neither layout", metaPath)
+	}
+
+	if other, err := decodeMetadata(dst.metadataPath(meta.Key)); err == nil && other.Key != meta.Key {
+		return false, fmt.Errorf("%s is taken by %s", to, other.Key)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return false, err
+	}
+
+	// The blob is already in place when a previous run was interrupted
+	// before the metadata was.
+	if err := os.Rename(from, to); err != nil {
+		if _, statErr := os.Stat(to); !errors.Is(err, os.ErrNotExist) || statErr != nil {
+			return false, err
+		}
+	}
+
+	meta.Hash = hash
+	if err := dst.writeMetadata(meta); err != nil {
+		return false, err
+	}
+	if err := os.Remove(metaPath); err != nil {
+		return false, err
+	}
+
+	pruneDirs(src.Root, filepath.Dir(from))
+
+	return true, nil
+}
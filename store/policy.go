@@ -0,0 +1,66 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy is how the files whose key starts with Prefix are stored.
+type Policy struct {
+	Prefix string `json:"prefix"`
+	// Replicas is the number of peers the files are copied to, every
+	// peer when it's zero.
+	Replicas int `json:"replicas,omitempty"`
+	// DataShards and ParityShards erasure code the files instead of
+	// copying them, when DataShards is set.
+	DataShards   int `json:"data_shards,omitempty"`
+	ParityShards int `json:"parity_shards,omitempty"`
+	// Plaintext keeps the files unencrypted at rest.
+	Plaintext bool `json:"plaintext,omitempty"`
+	// Compression is the algorithm the files are compressed with, they
+	// aren't when it's empty.
+	Compression string `json:"compression,omitempty"`
+	// TTL is how long the files are kept after they're stored, forever
+	// when it's zero.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// UpdatedAt orders the changes made to the policy of a prefix on
+	// different nodes, the latest one wins.
+	UpdatedAt time.Time `json:"updated_at"`
+	// Deleted marks a removed policy, so the removal wins over the older
+	// changes still going around.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// Validate checks that the policy can be applied.
+func (p Policy) Validate() error {
+	switch {
+	case len(p.Prefix) > 256:
+		// It's sent to every peer and kept in the policy file of every node.
+		return fmt.Errorf("the prefix is longer than 256 bytes")
+	case p.Replicas < 0:
+		return fmt.Errorf("negative number of replicas")
+	case p.DataShards < 0 || p.ParityShards < 0:
+		return fmt.Errorf("negative number of shards")
+	case p.DataShards == 0 && p.ParityShards > 0:
+		return fmt.Errorf("parity shards without data shards")
+	case p.DataShards+p.ParityShards > 256:
+		return fmt.Errorf("at most 256 shards are supported")
+	case p.DataShards > 0 && p.Replicas > 0:
+		return fmt.Errorf("the files are either erasure coded or replicated")
+	case len(p.Compression) > 0 && !validCompression(p.Compression):
+		return fmt.Errorf("unknown compression %q", p.Compression)
+	case p.TTL < 0:
+		return fmt.Errorf("negative TTL")
+	}
+	return nil
+}
+
+// ExpiresAt is when a file stored at t under the policy expires, the zero
+// time when it doesn't.
+func (p Policy) ExpiresAt(t time.Time) time.Time {
+	if p.TTL == 0 {
+		return time.Time{}
+	}
+	return t.Add(p.TTL).UTC()
+}
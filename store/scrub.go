@@ -0,0 +1,78 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrCorrupt is returned when the content of a blob doesn't match the
+// checksum in its metadata.
+var ErrCorrupt = errors.New("the content doesn't match its checksum")
+
+// quarantineSuffix is appended to the root of the store to get the folder
+// the corrupted blobs are moved to, out of the reach of List.
+const quarantineSuffix = ".quarantine"
+
+// Verify reads the content of key in full and checks it against the
+// checksum in its metadata. Blobs which can't be read back, like the ones
+// whose encryption or compression is damaged, are corrupted as well.
+func Verify(b Backend, key string) error {
+	meta, err := b.Stat(key)
+	if err != nil {
+		return err
+	}
+	// The checksum of an erasure coded file is the one of the shards put
+	// together, and the blobs written before the metadata have none.
+	if meta.Erasure != nil || len(meta.Checksum) == 0 {
+		return nil
+	}
+
+	_, r, err := b.Read(key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNoKey) {
+			return err
+		}
+		return fmt.Errorf("%w: %s", ErrCorrupt, err)
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return fmt.Errorf("%w: %s", ErrCorrupt, err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != meta.Checksum {
+		return fmt.Errorf("%w: got %s instead of %s", ErrCorrupt, sum, meta.Checksum)
+	}
+
+	return nil
+}
+
+// Quarantine moves the blob of key and its metadata out of the store, next
+// to its root, and returns where the blob went.
+func (s *Store) Quarantine(key string) (string, error) {
+	dir := filepath.Clean(s.Root) + quarantineSuffix
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+
+	blob := s.fullPath(key)
+	dst := filepath.Join(dir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(blob)))
+	if err := os.Rename(blob, dst); err != nil {
+		return "", err
+	}
+	if err := os.Rename(s.metadataPath(key), dst+metaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	pruneDirs(s.Root, filepath.Dir(blob))
+
+	return dst, nil
+}
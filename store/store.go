@@ -1,13 +1,14 @@
 package store
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"natneam.github.io/dfs-core/cipher"
 )
@@ -37,14 +38,27 @@ type PathTransformFunc func(string) PathKey
 
 type StoreOpts struct {
 	PathTransformFunc
-	Root string
+	// KeyHash is the hash PathTransformFunc lays the keys out with, it's
+	// recorded in the metadata. PathTransformFunc defaults to
+	// HashPathTransform(KeyHash) when it's set.
+	KeyHash cipher.KeyHash
+	Root    string
+	// EncKey encrypts the blobs written to disk, they're written in clear
+	// when it's nil. Reads decrypt on the fly whichever way a blob was
+	// written, as recorded in its metadata.
+	EncKey []byte
 }
 
 type Store struct {
 	StoreOpts
+
+	writes keyLocks
 }
 
 func NewStore(opts StoreOpts) *Store {
+	if opts.PathTransformFunc == nil && opts.KeyHash != nil {
+		opts.PathTransformFunc = HashPathTransform(opts.KeyHash)
+	}
 	if opts.PathTransformFunc == nil {
 		opts.PathTransformFunc = DefaultPathTransformFunc
 	}
@@ -54,33 +68,78 @@ func NewStore(opts StoreOpts) *Store {
 	return &Store{StoreOpts: opts}
 }
 
+// WriteOpts are the attributes of a file recorded in its metadata.
+type WriteOpts struct {
+	// WrappedKey is the data key of a file the client encrypted end to
+	// end, wrapped by the client's key.
+	WrappedKey []byte
+	// Erasure describes the shards of an erasure coded file.
+	Erasure *Erasure
+	// Plaintext writes the file unencrypted even if the store has a key.
+	Plaintext bool
+	// ExpiresAt is when the file expires, it doesn't when it's zero.
+	ExpiresAt time.Time
+	// Compression is the algorithm the file is compressed with before
+	// it's encrypted, unless it looks compressed already. It isn't
+	// compressed when it's empty.
+	Compression string
+	// ETag is the entity tag the S3 gateway reports for the file.
+	ETag string
+	// Replica marks the copy of a file kept for a peer.
+	Replica bool
+}
+
 func (s *Store) WriteDecrypt(key string, encryptionKey []byte, r io.Reader) (int64, error) {
-	return s.writeDecryptStream(key, encryptionKey, r)
+	return s.writeDecryptStream(key, encryptionKey, r, WriteOpts{})
 }
 
 func (s *Store) Write(key string, r io.Reader) (int64, error) {
-	return s.writeStream(key, r)
+	return s.writeStream(key, r, WriteOpts{})
+}
+
+func (s *Store) WriteWith(key string, r io.Reader, opts WriteOpts) (int64, error) {
+	return s.writeStream(key, r, opts)
 }
 
 func (s *Store) Read(key string) (int64, io.Reader, error) {
 	return s.readStream(key)
 }
 
+// Delete removes the blob and its metadata, then prunes the folders left
+// empty. Only the key's own folders are removed so keys sharing a prefix
+// of their path are left untouched.
 func (s *Store) Delete(key string) error {
-	pathName := s.PathTransformFunc(key)
+	fullPathWithRoot := s.fullPath(key)
+	unlock := s.writes.lock(key)
+	defer unlock()
 
-	folder, err := pathName.BaseFolder()
-	if err != nil {
+	if err := os.Remove(fullPathWithRoot); err != nil {
 		return err
 	}
-	return os.RemoveAll(fmt.Sprintf("%s/%s", s.Root, folder))
+
+	if err := os.Remove(s.metadataPath(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.removePending(key)
+
+	pruneDirs(s.Root, filepath.Dir(fullPathWithRoot))
+
+	return nil
 }
 
-func (s *Store) Has(key string) bool {
-	pathName := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s", s.Root, pathName.PathName)
+// pruneDirs removes dir and its parents up to root as long as they're
+// empty.
+func pruneDirs(root, dir string) {
+	root = filepath.Clean(root)
+	for ; dir != root && dir != "."; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+}
 
-	_, err := os.Stat(pathNameWithRoot)
+func (s *Store) Has(key string) bool {
+	_, err := os.Stat(s.fullPath(key))
 	return !errors.Is(err, os.ErrNotExist)
 }
 
@@ -88,49 +147,146 @@ func (s *Store) Clear() error {
 	return os.RemoveAll(s.Root)
 }
 
-func (s *Store) writeDecryptStream(key string, encryptionKey []byte, r io.Reader) (int64, error) {
+// ErrNoKey is returned when reading an encrypted blob from a store
+// without a key.
+var ErrNoKey = errors.New("the blob is encrypted but the store has no key")
+
+func (s *Store) writeDecryptStream(key string, encryptionKey []byte, r io.Reader, opts WriteOpts) (int64, error) {
+	return s.writeFile(key, opts, func(w io.Writer) (int64, error) {
+		return cipher.CopyDecrypt(encryptionKey, r, w)
+	})
+}
+
+func (s *Store) writeStream(key string, r io.Reader, opts WriteOpts) (int64, error) {
+	return s.writeFile(key, opts, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// writeFile lets copyFn fill the blob of the key and records the metadata
+// of the content. The content is encrypted on its way to disk when the
+// store has a key. The blob is written to a temporary file first, so a
+// failed write never replaces or truncates an existing blob.
+func (s *Store) writeFile(key string, opts WriteOpts, copyFn func(io.Writer) (int64, error)) (int64, error) {
 	f, err := s.openFileForWriting(key)
 	if err != nil {
 		return 0, err
 	}
-	return cipher.CopyDecrypt(encryptionKey, r, f)
-}
+	defer os.Remove(f.Name())
+	defer f.Close()
 
-func (s *Store) writeStream(key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(key)
+	n, meta, err := encodeBlob(f, key, s.EncKey, opts, copyFn)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	// The blob is dated like its metadata.
+	if err := os.Chtimes(f.Name(), meta.ModTime, meta.ModTime); err != nil {
+		return 0, err
+	}
+
+	// The metadata is written before the blob is renamed and renamed last,
+	// so a crash in between leaves it pending for readMetadata to find. The
+	// concurrent writes of the key take turns from there.
+	if s.KeyHash != nil {
+		meta.Hash = s.KeyHash.Name()
+	}
+	unlock := s.writes.lock(key)
+	defer unlock()
+
+	pending, err := s.writePendingMetadata(meta, f.Name())
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	if err := os.Rename(f.Name(), s.fullPath(key)); err != nil {
+		os.Remove(pending)
+		return 0, err
+	}
+	if err := os.Rename(pending, s.metadataPath(key)); err != nil {
+		return 0, err
+	}
+	s.removePending(key)
+
+	return n, nil
 }
 
+// keyLocks serializes the writes of every key.
+type keyLocks struct {
+	mapLock sync.Mutex
+	locks   map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the key until the returned function is called.
+func (l *keyLocks) lock(key string) func() {
+	l.mapLock.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.refs++
+	l.mapLock.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		l.mapLock.Lock()
+		defer l.mapLock.Unlock()
+		if kl.refs--; kl.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// openFileForWriting creates a temporary file next to the blob of the key.
 func (s *Store) openFileForWriting(key string) (*os.File, error) {
-	pathName := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s", s.Root, pathName.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
+	fullPathWithRoot := s.fullPath(key)
+	dir := filepath.Dir(fullPathWithRoot)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return nil, err
 	}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathName.FullPath())
+	return os.CreateTemp(dir, filepath.Base(fullPathWithRoot)+".*.tmp")
+}
 
-	return os.Create(fullPathWithRoot)
+func (s *Store) fullPath(key string) string {
+	pathName := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s", s.Root, pathName.FullPath())
 }
 
+// readStream returns the size and a reader of the content of the key,
+// decrypting it if the blob is encrypted.
 func (s *Store) readStream(key string) (int64, io.ReadCloser, error) {
-	pathName := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s", s.Root, pathName.FullPath())
+	file, err := os.Open(s.fullPath(key))
+	if err != nil {
+		return 0, nil, err
+	}
 
-	file, err := os.Open(fullPathWithRoot)
+	meta, err := s.Stat(key)
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
-	fi, err := file.Stat()
+	r, err := decodeBlob(meta, s.EncKey, file)
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
-	return fi.Size(), file, nil
+	return meta.Size, r, nil
 }
 
 func DefaultPathTransformFunc(key string) PathKey {
@@ -140,9 +296,21 @@ func DefaultPathTransformFunc(key string) PathKey {
 	}
 }
 
+// HashPathTransformFunc lays the keys out by their MD5 hash, the original
+// layout. New stores should use HashPathTransform with a stronger hash.
 func HashPathTransformFunc(key string) PathKey {
-	hash := md5.Sum([]byte(key))
-	hashString := hex.EncodeToString(hash[:])
+	return hashPathKey(cipher.MD5.HashKey(key))
+}
+
+// HashPathTransform lays the keys out by their hash, in five levels of
+// folders named after the leading parts of the hash.
+func HashPathTransform(h cipher.KeyHash) PathTransformFunc {
+	return func(key string) PathKey {
+		return hashPathKey(h.HashKey(key))
+	}
+}
+
+func hashPathKey(hashString string) PathKey {
 	paths := []string{}
 
 	folderNameLength := len(hashString) / 5
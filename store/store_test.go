@@ -2,11 +2,19 @@ package store
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"natneam.github.io/dfs-core/cipher"
 )
 
 func TestPathTransformFunc(t *testing.T) {
@@ -82,6 +90,424 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestInterruptedWrite(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncKey: cipher.NewEncryptionKey()})
+	metaPath := s.metadataPath("key")
+	old := []byte("Hello World")
+	text := bytes.Repeat([]byte("Hello World "), 1000)
+
+	_, err := s.Write("key", bytes.NewReader(old))
+	assert.Nil(t, err)
+	oldBlob, _ := os.ReadFile(s.fullPath("key"))
+	oldMeta, _ := os.ReadFile(metaPath)
+	_, err = s.WriteWith("key", bytes.NewReader(text), WriteOpts{Plaintext: true, Compression: CompressionZstd})
+	assert.Nil(t, err)
+	newBlob, _ := os.ReadFile(s.fullPath("key"))
+	newMeta, err := decodeMetadata(metaPath)
+	assert.Nil(t, err)
+
+	read := func() []byte {
+		_, r, err := s.Read("key")
+		assert.Nil(t, err)
+		data, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		return data
+	}
+
+	// The crash came before the blob was renamed, the blob and its
+	// metadata are the old ones.
+	tmpBlob := s.fullPath("key") + ".123.tmp"
+	assert.Nil(t, os.WriteFile(tmpBlob, newBlob, 0o644))
+	pending, _ := json.Marshal(pendingMetadata{Metadata: newMeta, Blob: filepath.Base(tmpBlob)})
+	assert.Nil(t, os.WriteFile(metaPath+".456"+pendingSuffix, pending, 0o644))
+	assert.Nil(t, os.WriteFile(s.fullPath("key"), oldBlob, 0o644))
+	assert.Nil(t, os.WriteFile(metaPath, oldMeta, 0o644))
+	assert.Equal(t, old, read())
+
+	// The crash came once the blob was renamed, the metadata is pending.
+	assert.Nil(t, os.Rename(tmpBlob, s.fullPath("key")))
+	assert.Equal(t, text, read())
+	list, err := s.List("")
+	assert.Nil(t, err)
+	assert.Equal(t, CompressionZstd, list[0].Compression)
+
+	assert.Nil(t, s.Delete("key"))
+	entries, err := os.ReadDir(s.Root)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncKey: cipher.NewEncryptionKey()})
+
+	wg := sync.WaitGroup{}
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Write("key", bytes.NewReader(bytes.Repeat([]byte{byte(i)}, 1000*(i+1))))
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+
+	// The blob is the one of a write and the metadata describes it.
+	assert.Nil(t, Verify(s, "key"))
+	meta, err := s.Stat("key")
+	assert.Nil(t, err)
+	_, r, err := s.Read("key")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, meta.Size, int64(len(data)))
+	assert.Equal(t, bytes.Repeat(data[:1], int(data[0]+1)*1000), data)
+
+	err = filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		assert.False(t, strings.HasSuffix(path, ".tmp"), path)
+		return err
+	})
+	assert.Nil(t, err)
+}
+
+func TestList(t *testing.T) {
+	s := newStore()
+	defer tearDown(t, s)
+
+	keys := []string{"photos/b.png", "photos/a.png", "docs/a.txt"}
+	for _, key := range keys {
+		if _, err := s.Write(key, bytes.NewReader([]byte("Hello World"))); err != nil {
+			t.Error(err)
+		}
+	}
+
+	list, err := s.List("photos/")
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "photos/a.png", list[0].Key)
+	assert.Equal(t, "photos/b.png", list[1].Key)
+
+	meta, err := s.Stat("docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len("Hello World")), meta.Size)
+	assert.Equal(t, "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e", meta.Checksum)
+
+	if err := s.Delete("photos/a.png"); err != nil {
+		t.Error(err)
+	}
+
+	list, err = s.List("")
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	root := t.TempDir()
+	plain := NewStore(StoreOpts{Root: root, PathTransformFunc: HashPathTransformFunc})
+	if _, err := plain.Write("old", bytes.NewReader([]byte("Hello World"))); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewStore(StoreOpts{Root: root, PathTransformFunc: HashPathTransformFunc, EncKey: cipher.NewEncryptionKey()})
+	n, err := s.Write("new", bytes.NewReader([]byte("Hello World")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), n)
+
+	blob, err := os.ReadFile(s.fullPath("new"))
+	assert.Nil(t, err)
+	assert.Len(t, blob, 11+cipher.IVSize)
+	assert.NotContains(t, string(blob), "Hello")
+
+	meta, err := s.Stat("new")
+	assert.Nil(t, err)
+	assert.True(t, meta.Encrypted)
+	assert.Equal(t, int64(11), meta.Size)
+	assert.Equal(t, "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e", meta.Checksum)
+
+	// Both the encrypted blob and the one written before the key was set
+	// read as plaintext.
+	for _, key := range []string{"new", "old"} {
+		size, r, err := s.Read(key)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(11), size)
+
+		_, err = r.(io.Seeker).Seek(6, io.SeekStart)
+		assert.Nil(t, err)
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "World", string(data))
+		r.(io.Closer).Close()
+	}
+
+	_, _, err = plain.Read("new")
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestMigrateHash(t *testing.T) {
+	root := t.TempDir()
+	old := NewStore(StoreOpts{Root: root, PathTransformFunc: HashPathTransformFunc})
+
+	keys := []string{"a", "b", "dir/c"}
+	for _, key := range keys {
+		_, err := old.Write(key, bytes.NewReader([]byte(key+" content")))
+		assert.Nil(t, err)
+	}
+
+	// A blob written before the metadata existed, its key is lost.
+	legacy := HashPathTransformFunc("legacy")
+	legacyPath := fmt.Sprintf("%s/%s", root, legacy.FullPath())
+	assert.Nil(t, os.MkdirAll(fmt.Sprintf("%s/%s", root, legacy.PathName), os.ModePerm))
+	assert.Nil(t, os.WriteFile(legacyPath, []byte("legacy"), 0o644))
+
+	// The copies kept for a peer are left in place, whether they're marked
+	// or were written before they were.
+	replicas := []string{"replica", cipher.MD5.HashKey("unmarked")}
+	_, err := old.WriteWith(replicas[0], bytes.NewReader([]byte("copy")), WriteOpts{Replica: true})
+	assert.Nil(t, err)
+	_, err = old.Write(replicas[1], bytes.NewReader([]byte("copy")))
+	assert.Nil(t, err)
+
+	result, err := MigrateHash(root, cipher.MD5, cipher.SHA256)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), result.Moved)
+	assert.Equal(t, []string{legacyPath}, result.Unknown)
+	assert.ElementsMatch(t, []string{old.fullPath(replicas[0]), old.fullPath(replicas[1])}, result.Replicas)
+	for _, key := range replicas {
+		assert.True(t, old.Has(key))
+	}
+
+	s := NewStore(StoreOpts{Root: root, KeyHash: cipher.SHA256})
+	for _, key := range keys {
+		assert.False(t, old.Has(key))
+
+		_, r, err := s.Read(key)
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, key+" content", string(b))
+
+		meta, err := s.Stat(key)
+		assert.Nil(t, err)
+		assert.Equal(t, cipher.HashSHA256, meta.Hash)
+	}
+
+	result, err = MigrateHash(root, cipher.MD5, cipher.SHA256)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, result.Moved)
+	assert.Equal(t, len(keys), result.Skipped)
+}
+
+func TestMigrate(t *testing.T) {
+	root := t.TempDir()
+	from := StoreOpts{Root: root, PathTransformFunc: DefaultPathTransformFunc}
+	to := StoreOpts{Root: root, PathTransformFunc: HashPathTransformFunc}
+	old, s := NewStore(from), NewStore(to)
+
+	keys := []string{"a", "b", "dir/c"}
+	for _, key := range keys {
+		_, err := old.Write(key, bytes.NewReader([]byte(key+" content")))
+		assert.Nil(t, err)
+	}
+
+	// An interrupted run moved the blob of "b" but not its metadata.
+	assert.Nil(t, os.MkdirAll(filepath.Dir(s.fullPath("b")), os.ModePerm))
+	assert.Nil(t, os.Rename(old.fullPath("b"), s.fullPath("b")))
+
+	result, err := Migrate(from, to)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keys), result.Moved)
+	assert.Empty(t, result.Unknown)
+
+	for _, key := range keys {
+		assert.False(t, old.Has(key))
+
+		_, r, err := s.Read(key)
+		assert.Nil(t, err)
+		b, _ := io.ReadAll(r)
+		r.(io.Closer).Close()
+		assert.Equal(t, key+" content", string(b))
+	}
+
+	list, err := s.List("")
+	assert.Nil(t, err)
+	assert.Len(t, list, len(keys))
+
+	entries, err := os.ReadDir(root)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		assert.NotContains(t, []string{"a", "b", "dir"}, entry.Name())
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for _, encKey := range [][]byte{nil, cipher.NewEncryptionKey()} {
+		bolt, err := OpenBoltStore(BoltStoreOpts{Path: filepath.Join(t.TempDir(), "files.db"), EncKey: encKey})
+		assert.Nil(t, err)
+		defer bolt.Close()
+
+		backends := map[string]Backend{
+			"disk":   NewStore(StoreOpts{Root: t.TempDir(), KeyHash: cipher.SHA256, EncKey: encKey}),
+			"memory": NewMemoryStore(MemoryStoreOpts{EncKey: encKey}),
+			"bolt":   bolt,
+		}
+
+		for name, b := range backends {
+			t.Run(name, func(t *testing.T) {
+				data := []byte("Hello World")
+				for _, key := range []string{"b", "a/1", "a/2"} {
+					n, err := b.WriteWith(key, bytes.NewReader(data), WriteOpts{WrappedKey: []byte(key)})
+					assert.Nil(t, err)
+					assert.Equal(t, int64(len(data)), n)
+				}
+				_, err := b.Write("b", bytes.NewReader([]byte("replaced")))
+				assert.Nil(t, err)
+
+				size, r, err := b.Read("a/1")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(len(data)), size)
+				got, _ := io.ReadAll(r)
+				r.(io.Closer).Close()
+				assert.Equal(t, data, got)
+
+				meta, err := b.Stat("a/1")
+				assert.Nil(t, err)
+				assert.Equal(t, "a/1", meta.Key)
+				assert.Equal(t, []byte("a/1"), meta.WrappedKey)
+				assert.Equal(t, encKey != nil, meta.Encrypted)
+
+				list, err := b.List("a/")
+				assert.Nil(t, err)
+				assert.Len(t, list, 2)
+				assert.Equal(t, "a/1", list[0].Key)
+				assert.Equal(t, "a/2", list[1].Key)
+
+				meta, err = b.Stat("b")
+				assert.Nil(t, err)
+				assert.Equal(t, int64(len("replaced")), meta.Size)
+				assert.Nil(t, meta.WrappedKey)
+
+				assert.True(t, b.Has("b"))
+				assert.Nil(t, b.Delete("b"))
+				assert.False(t, b.Has("b"))
+
+				_, _, err = b.Read("b")
+				assert.ErrorIs(t, err, os.ErrNotExist)
+				_, err = b.Stat("b")
+				assert.ErrorIs(t, err, os.ErrNotExist)
+				assert.ErrorIs(t, b.Delete("b"), os.ErrNotExist)
+			})
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("2026-10-19 12:00:00 INFO request served in 12ms\n"), 10000)
+	random := make([]byte, 1<<20)
+	rand.Read(random)
+
+	for _, compression := range Compressions() {
+		for _, encKey := range [][]byte{nil, cipher.NewEncryptionKey()} {
+			s := NewStore(StoreOpts{Root: t.TempDir(), KeyHash: cipher.SHA256, EncKey: encKey})
+			opts := WriteOpts{Compression: compression}
+
+			for name, data := range map[string][]byte{"text": text, "random": random, "small": []byte("Hello World")} {
+				n, err := s.WriteWith(name, bytes.NewReader(data), opts)
+				assert.Nil(t, err)
+				assert.Equal(t, int64(len(data)), n)
+
+				size, r, err := s.Read(name)
+				assert.Nil(t, err)
+				assert.Equal(t, int64(len(data)), size)
+				got, _ := io.ReadAll(r)
+				r.(io.Closer).Close()
+				assert.True(t, bytes.Equal(data, got), "%s %s", compression, name)
+			}
+
+			meta, err := s.Stat("text")
+			assert.Nil(t, err)
+			assert.Equal(t, compression, meta.Compression)
+			assert.Equal(t, encKey != nil, meta.Encrypted)
+			fi, err := os.Stat(s.fullPath("text"))
+			assert.Nil(t, err)
+			assert.Less(t, fi.Size(), int64(len(text)/5))
+
+			// Compressing them wouldn't pay off.
+			for _, name := range []string{"random", "small"} {
+				meta, err = s.Stat(name)
+				assert.Nil(t, err)
+				assert.Empty(t, meta.Compression)
+			}
+		}
+	}
+
+	s := NewStore(StoreOpts{Root: t.TempDir()})
+	_, err := s.WriteWith("gzip", bytes.NewReader(text), WriteOpts{Compression: "gzip"})
+	assert.Nil(t, err)
+	blob, err := os.ReadFile(s.fullPath("gzip"))
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(blob, []byte("DFSZ\x02")))
+	// Compressed content is left as is.
+	_, err = s.WriteWith("twice", bytes.NewReader(blob[5:]), WriteOpts{Compression: "zstd"})
+	assert.Nil(t, err)
+	meta, err := s.Stat("twice")
+	assert.Nil(t, err)
+	assert.Empty(t, meta.Compression)
+
+	// The header tells the blob is compressed, not the metadata.
+	assert.Nil(t, os.MkdirAll(filepath.Dir(s.fullPath("copy")), 0o755))
+	assert.Nil(t, os.WriteFile(s.fullPath("copy"), blob, 0o644))
+	_, r, err := s.Read("copy")
+	assert.Nil(t, err)
+	got, _ := io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.True(t, bytes.Equal(text, got))
+
+	// Content starting like the header isn't taken for it.
+	header := []byte("DFSZ\x02 isn't compressed")
+	_, err = s.WriteWith("header", bytes.NewReader(header), WriteOpts{})
+	assert.Nil(t, err)
+	_, r, err = s.Read("header")
+	assert.Nil(t, err)
+	got, _ = io.ReadAll(r)
+	r.(io.Closer).Close()
+	assert.Equal(t, header, got)
+
+	_, err = s.WriteWith("key", bytes.NewReader(text), WriteOpts{Compression: "lz4"})
+	assert.NotNil(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), EncKey: cipher.NewEncryptionKey()})
+	for _, key := range []string{"good", "bad", "compressed"} {
+		_, err := s.WriteWith(key, bytes.NewReader(bytes.Repeat([]byte(key), 1000)), WriteOpts{Compression: "zstd"})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, Verify(s, "good"))
+
+	for _, key := range []string{"bad", "compressed"} {
+		blob, err := os.ReadFile(s.fullPath(key))
+		assert.Nil(t, err)
+		if key == "bad" {
+			blob[len(blob)-1] ^= 1
+		} else {
+			// The compression header is damaged.
+			blob[cipher.IVSize] ^= 1
+		}
+		assert.Nil(t, os.WriteFile(s.fullPath(key), blob, 0o644))
+		assert.ErrorIs(t, Verify(s, key), ErrCorrupt)
+	}
+	assert.ErrorIs(t, Verify(s, "missing"), os.ErrNotExist)
+
+	path, err := s.Quarantine("bad")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Clean(s.Root)+quarantineSuffix, filepath.Dir(path))
+	assert.FileExists(t, path)
+	assert.FileExists(t, path+metaSuffix)
+	assert.False(t, s.Has("bad"))
+	list, err := s.List("")
+	assert.Nil(t, err)
+	assert.Len(t, list, 2)
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: HashPathTransformFunc,
@@ -0,0 +1,35 @@
+// Package tracing exports the traces of a node to an OpenTelemetry
+// collector.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName is the name the nodes report their spans under.
+const ServiceName = "dfs-core"
+
+// NewProvider returns a tracer provider sending the spans of the node to
+// the OTLP collector at endpoint over gRPC, e.g. http://localhost:4317. The
+// connection is only encrypted for https endpoints. Shut the provider down
+// to flush the spans which weren't sent yet.
+func NewProvider(ctx context.Context, endpoint, node string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	res := resource.NewSchemaless(
+		attribute.String("service.name", ServiceName),
+		attribute.String("service.instance.id", node),
+	)
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
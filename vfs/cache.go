@@ -0,0 +1,169 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 256 << 20
+
+type cacheEntry struct {
+	checksum string
+	size     int64
+	lastUsed time.Time
+}
+
+// cache keeps local copies of the files read through the file system. A
+// copy is used as long as the checksum in the metadata index matches the
+// one it was fetched with, the least recently used copies are evicted once
+// the cache grows beyond its size.
+type cache struct {
+	files Files
+	dir   string
+	size  int64
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	used    int64
+}
+
+func newCache(files Files, dir string, size int64) (*cache, error) {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+
+	// Copies left by a previous run aren't indexed, start from scratch.
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &cache{
+		files:   files,
+		dir:     dir,
+		size:    size,
+		entries: make(map[string]*cacheEntry),
+	}, nil
+}
+
+// open returns the cached copy of the key, fetching it first if there's no
+// up to date copy.
+func (c *cache) open(key string) (*os.File, error) {
+	checksum := ""
+	if meta, err := c.files.Stat(key); err == nil {
+		checksum = meta.Checksum
+	}
+
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	fresh := ok && len(checksum) > 0 && entry.checksum == checksum
+	if fresh {
+		entry.lastUsed = time.Now()
+	}
+	c.lock.Unlock()
+
+	if fresh {
+		if f, err := os.Open(c.path(key)); err == nil {
+			return f, nil
+		}
+	}
+
+	return c.fetch(key)
+}
+
+func (c *cache) fetch(key string) (*os.File, error) {
+	_, r, err := c.files.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "fetch-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		return nil, err
+	}
+
+	// Open before the copy gets a chance to be evicted.
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &cacheEntry{size: n, lastUsed: time.Now()}
+	if meta, err := c.files.Stat(key); err == nil {
+		entry.checksum = meta.Checksum
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.entries[key]; ok {
+		c.used -= old.size
+	}
+	c.entries[key] = entry
+	c.used += n
+	c.evict(key)
+
+	return f, nil
+}
+
+func (c *cache) invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.remove(key)
+}
+
+// evict removes the least recently used copies until the cache fits its
+// size again, keeping the copy of keep.
+func (c *cache) evict(keep string) {
+	for c.used > c.size {
+		oldest := ""
+		for key, entry := range c.entries {
+			if key != keep && (len(oldest) == 0 || entry.lastUsed.Before(c.entries[oldest].lastUsed)) {
+				oldest = key
+			}
+		}
+		if len(oldest) == 0 {
+			return
+		}
+		c.remove(oldest)
+	}
+}
+
+func (c *cache) remove(key string) {
+	entry, ok := c.entries[key]
+	if !ok {
+		return
+	}
+
+	// Handles still reading the copy keep their open file.
+	os.Remove(c.path(key))
+	delete(c.entries, key)
+	c.used -= entry.size
+}
+
+func (c *cache) path(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:]))
+}
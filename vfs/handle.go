@@ -0,0 +1,100 @@
+package vfs
+
+import (
+	"os"
+	"sync"
+)
+
+// Handle is an open file. Reads are served from the read cache, writes go
+// to a local copy which is stored when the handle is flushed or closed.
+type Handle struct {
+	fs   *FS
+	key  string
+	file *os.File
+
+	lock     sync.Mutex
+	writable bool
+	dirty    bool
+	closed   bool
+}
+
+func (h *Handle) ReadAt(p []byte, off int64) (int, error) {
+	return h.file.ReadAt(p, off)
+}
+
+func (h *Handle) WriteAt(p []byte, off int64) (int, error) {
+	if !h.writable {
+		return 0, os.ErrPermission
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.dirty = true
+	return h.file.WriteAt(p, off)
+}
+
+func (h *Handle) Truncate(size int64) error {
+	if !h.writable {
+		return os.ErrPermission
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.dirty = true
+	return h.file.Truncate(size)
+}
+
+func (h *Handle) Size() int64 {
+	fi, err := h.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Flush stores the file if it was written to since the last flush.
+func (h *Handle) Flush() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.dirty {
+		return nil
+	}
+
+	if err := h.fs.store(h); err != nil {
+		return err
+	}
+	h.dirty = false
+
+	return nil
+}
+
+// Close flushes the file and releases the handle.
+func (h *Handle) Close() error {
+	err := h.Flush()
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return err
+	}
+	h.closed = true
+
+	if h.writable {
+		h.fs.release(h)
+		h.discard()
+		return err
+	}
+
+	h.file.Close()
+	return err
+}
+
+// discard removes the local copy of a writable handle.
+func (h *Handle) discard() {
+	h.file.Close()
+	os.Remove(h.file.Name())
+}
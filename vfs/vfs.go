@@ -0,0 +1,417 @@
+// Package vfs presents the flat key space of the file server as a tree of
+// directories and files. Directories are derived from the "/" separated
+// keys in the metadata index, files are read through a local cache and
+// written back when they're closed. It has no FUSE dependency so it can be
+// used and tested on its own, the mount package serves it over FUSE.
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"natneam.github.io/dfs-core/store"
+)
+
+var (
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotDir   = errors.New("not a directory")
+	ErrNotEmpty = errors.New("directory not empty")
+)
+
+// Files is the store the file system is backed by, a FileServer satisfies
+// it.
+type Files interface {
+	Get(key string) (int64, io.Reader, error)
+	Store(key string, r io.Reader) error
+	Stat(key string) (store.Metadata, error)
+	List(prefix string) ([]store.Metadata, error)
+	DeleteNetwork(key string) error
+}
+
+type Opts struct {
+	// CacheDir holds the read cache and the files being written.
+	CacheDir string
+	// CacheSize is the number of bytes the read cache may hold.
+	CacheSize int64
+}
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+type FS struct {
+	Opts
+
+	files Files
+	cache *cache
+
+	lock sync.Mutex
+	// dirs are the directories made with Mkdir, they only exist in memory
+	// until a file is stored in them.
+	dirs map[string]time.Time
+	// writers are the files open for writing, they're visible before
+	// they get stored on close.
+	writers map[string]*Handle
+}
+
+func New(files Files, opts Opts) (*FS, error) {
+	if len(opts.CacheDir) == 0 {
+		opts.CacheDir = filepath.Join(os.TempDir(), "dfs-vfs")
+	}
+
+	c, err := newCache(files, filepath.Join(opts.CacheDir, "read"), opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(opts.CacheDir, "write"), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	return &FS{
+		Opts:    opts,
+		files:   files,
+		cache:   c,
+		dirs:    make(map[string]time.Time),
+		writers: make(map[string]*Handle),
+	}, nil
+}
+
+func (fs *FS) Stat(name string) (FileInfo, error) {
+	key := clean(name)
+	if len(key) == 0 {
+		return FileInfo{Name: "/", IsDir: true}, nil
+	}
+
+	fs.lock.Lock()
+	w, writing := fs.writers[key]
+	fs.lock.Unlock()
+
+	if writing {
+		return FileInfo{Name: path.Base(key), Size: w.Size(), ModTime: time.Now(), IsDir: false}, nil
+	}
+
+	if meta, err := fs.files.Stat(key); err == nil {
+		return FileInfo{Name: path.Base(key), Size: meta.Size, ModTime: meta.ModTime}, nil
+	}
+
+	entries, err := fs.readDir(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fs.lock.Lock()
+	modTime, made := fs.dirs[key]
+	fs.lock.Unlock()
+
+	if len(entries) == 0 && !made {
+		return FileInfo{}, os.ErrNotExist
+	}
+
+	// Directories derived from keys are as recent as their newest entry.
+	for _, entry := range entries {
+		if entry.ModTime.After(modTime) {
+			modTime = entry.ModTime
+		}
+	}
+
+	return FileInfo{Name: path.Base(key), ModTime: modTime, IsDir: true}, nil
+}
+
+func (fs *FS) ReadDir(name string) ([]FileInfo, error) {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir {
+		return nil, ErrNotDir
+	}
+
+	return fs.readDir(clean(name))
+}
+
+// readDir lists the direct children of the directory key, both the stored
+// files and the ones only known in memory.
+func (fs *FS) readDir(key string) ([]FileInfo, error) {
+	prefix := ""
+	if len(key) > 0 {
+		prefix = key + "/"
+	}
+
+	list, err := fs.files.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]FileInfo)
+	add := func(rest string, info FileInfo) {
+		name, _, isSub := strings.Cut(rest, "/")
+		if len(name) == 0 {
+			return
+		}
+		if isSub {
+			if _, ok := entries[name]; !ok {
+				entries[name] = FileInfo{Name: name, ModTime: info.ModTime, IsDir: true}
+			}
+			return
+		}
+		info.Name = name
+		entries[name] = info
+	}
+
+	for _, meta := range list {
+		add(strings.TrimPrefix(meta.Key, prefix), FileInfo{Size: meta.Size, ModTime: meta.ModTime})
+	}
+
+	fs.lock.Lock()
+	for dir, modTime := range fs.dirs {
+		if rest, ok := strings.CutPrefix(dir, prefix); ok {
+			add(rest+"/", FileInfo{ModTime: modTime})
+		}
+	}
+	for k, w := range fs.writers {
+		if rest, ok := strings.CutPrefix(k, prefix); ok {
+			add(rest, FileInfo{Size: w.Size(), ModTime: time.Now()})
+		}
+	}
+	fs.lock.Unlock()
+
+	infos := make([]FileInfo, 0, len(entries))
+	for _, info := range entries {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos, nil
+}
+
+func (fs *FS) Mkdir(name string) error {
+	key := clean(name)
+	if _, err := fs.Stat(name); err == nil {
+		return os.ErrExist
+	}
+	if err := fs.checkParent(key); err != nil {
+		return err
+	}
+
+	fs.lock.Lock()
+	fs.dirs[key] = time.Now()
+	fs.lock.Unlock()
+
+	return nil
+}
+
+func (fs *FS) Rmdir(name string) error {
+	entries, err := fs.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrNotEmpty
+	}
+
+	fs.lock.Lock()
+	delete(fs.dirs, clean(name))
+	fs.lock.Unlock()
+
+	return nil
+}
+
+// Remove deletes the file from the whole network.
+func (fs *FS) Remove(name string) error {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return ErrIsDir
+	}
+
+	key := clean(name)
+	fs.cache.invalidate(key)
+
+	fs.lock.Lock()
+	_, writing := fs.writers[key]
+	delete(fs.writers, key)
+	fs.lock.Unlock()
+
+	// A file which was never stored only has to be forgotten.
+	if writing {
+		if _, err := fs.files.Stat(key); err != nil {
+			return nil
+		}
+	}
+
+	return fs.files.DeleteNetwork(key)
+}
+
+// Rename moves a file by storing its content under the new key and
+// deleting the old one. Directories can't be renamed.
+func (fs *FS) Rename(oldName, newName string) error {
+	info, err := fs.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if info.IsDir {
+		return ErrIsDir
+	}
+
+	if err := fs.checkParent(clean(newName)); err != nil {
+		return err
+	}
+
+	src, err := fs.Open(oldName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := fs.files.Store(clean(newName), io.NewSectionReader(src, 0, src.Size())); err != nil {
+		return err
+	}
+	fs.cache.invalidate(clean(newName))
+
+	return fs.Remove(oldName)
+}
+
+// Truncate changes the size of the file, which gets stored right away.
+func (fs *FS) Truncate(name string, size int64) error {
+	h, err := fs.OpenFile(name, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Truncate(size); err != nil {
+		h.Close()
+		return err
+	}
+
+	return h.Close()
+}
+
+// Open opens the file for reading.
+func (fs *FS) Open(name string) (*Handle, error) {
+	return fs.OpenFile(name, os.O_RDONLY)
+}
+
+// OpenFile opens the file with the os.OpenFile flags. Files opened for
+// writing are written to a local copy which is stored once closed.
+func (fs *FS) OpenFile(name string, flag int) (*Handle, error) {
+	key := clean(name)
+	if len(key) == 0 {
+		return nil, ErrIsDir
+	}
+
+	info, err := fs.Stat(name)
+	switch {
+	case err == nil && info.IsDir:
+		return nil, ErrIsDir
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, os.ErrExist
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, err
+	case errors.Is(err, os.ErrNotExist):
+		if err := fs.checkParent(key); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := fs.cache.open(key)
+		if err != nil {
+			return nil, err
+		}
+		return &Handle{fs: fs, key: key, file: f}, nil
+	}
+
+	return fs.openWriter(key, info.Size > 0 && flag&os.O_TRUNC == 0)
+}
+
+func (fs *FS) openWriter(key string, keepContent bool) (*Handle, error) {
+	f, err := os.CreateTemp(filepath.Join(fs.CacheDir, "write"), "file-*")
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handle{fs: fs, key: key, file: f, writable: true, dirty: !keepContent}
+
+	if keepContent {
+		src, err := fs.cache.open(key)
+		if err != nil {
+			h.discard()
+			return nil, err
+		}
+		_, err = io.Copy(f, src)
+		src.Close()
+		if err != nil {
+			h.discard()
+			return nil, err
+		}
+	}
+
+	fs.lock.Lock()
+	fs.writers[key] = h
+	fs.lock.Unlock()
+
+	return h, nil
+}
+
+// store writes the content of a handle back to the file server.
+func (fs *FS) store(h *Handle) error {
+	if err := fs.files.Store(h.key, io.NewSectionReader(h.file, 0, h.Size())); err != nil {
+		return err
+	}
+	fs.cache.invalidate(h.key)
+
+	// The file is stored, it no longer needs to exist in memory.
+	fs.lock.Lock()
+	for dir := path.Dir(h.key); dir != "."; dir = path.Dir(dir) {
+		delete(fs.dirs, dir)
+	}
+	fs.lock.Unlock()
+
+	return nil
+}
+
+func (fs *FS) release(h *Handle) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.writers[h.key] == h {
+		delete(fs.writers, h.key)
+	}
+}
+
+func (fs *FS) checkParent(key string) error {
+	parent := path.Dir(key)
+	if parent == "." {
+		return nil
+	}
+
+	info, err := fs.Stat(parent)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir {
+		return ErrNotDir
+	}
+
+	return nil
+}
+
+// clean turns a path into the key it's stored under.
+func clean(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
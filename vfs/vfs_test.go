@@ -0,0 +1,161 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"natneam.github.io/dfs-core/cipher"
+	"natneam.github.io/dfs-core/network"
+	"natneam.github.io/dfs-core/server"
+	"natneam.github.io/dfs-core/store"
+)
+
+func TestWriteOnClose(t *testing.T) {
+	fsys, files := newFS(t)
+
+	h, err := fsys.OpenFile("/docs/hello.txt", os.O_CREATE|os.O_WRONLY)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Nil(t, fsys.Mkdir("/docs"))
+	h, err = fsys.OpenFile("/docs/hello.txt", os.O_CREATE|os.O_WRONLY)
+	assert.Nil(t, err)
+
+	_, err = h.WriteAt([]byte("Hello World"), 0)
+	assert.Nil(t, err)
+
+	// Visible while being written, but not stored before it's closed.
+	info, err := fsys.Stat("/docs/hello.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), info.Size)
+	assert.False(t, files.Has("docs/hello.txt"))
+
+	assert.Nil(t, h.Close())
+	assert.True(t, files.Has("docs/hello.txt"))
+
+	entries, err := fsys.ReadDir("/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"docs"}, names(entries))
+	assert.True(t, entries[0].IsDir)
+
+	entries, err = fsys.ReadDir("/docs")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"hello.txt"}, names(entries))
+}
+
+func TestReadThroughCache(t *testing.T) {
+	fsys, _ := newFS(t)
+	write(t, fsys, "a/b/c.txt", "Hello World")
+
+	assert.Equal(t, "Hello World", read(t, fsys, "a/b/c.txt"))
+	assert.Contains(t, fsys.cache.entries, "a/b/c.txt")
+
+	// Overwriting the file must not serve the stale copy.
+	write(t, fsys, "a/b/c.txt", "Bye")
+	assert.Equal(t, "Bye", read(t, fsys, "a/b/c.txt"))
+
+	h, err := fsys.OpenFile("a/b/c.txt", os.O_RDWR)
+	assert.Nil(t, err)
+	_, err = h.WriteAt([]byte("!"), 3)
+	assert.Nil(t, err)
+	assert.Nil(t, h.Close())
+	assert.Equal(t, "Bye!", read(t, fsys, "a/b/c.txt"))
+}
+
+func TestCacheEviction(t *testing.T) {
+	fsys, _ := newFS(t)
+	fsys.cache.size = 15
+
+	write(t, fsys, "one", "0123456789")
+	write(t, fsys, "two", "0123456789")
+
+	read(t, fsys, "one")
+	read(t, fsys, "two")
+
+	assert.NotContains(t, fsys.cache.entries, "one")
+	assert.Contains(t, fsys.cache.entries, "two")
+	assert.Equal(t, "0123456789", read(t, fsys, "one"))
+}
+
+func TestRemoveAndRename(t *testing.T) {
+	fsys, files := newFS(t)
+	write(t, fsys, "dir/a.txt", "Hello World")
+
+	assert.ErrorIs(t, fsys.Rmdir("dir"), ErrNotEmpty)
+	assert.ErrorIs(t, fsys.Remove("dir"), ErrIsDir)
+
+	assert.Nil(t, fsys.Rename("dir/a.txt", "dir/b.txt"))
+	assert.False(t, files.Has("dir/a.txt"))
+	assert.Equal(t, "Hello World", read(t, fsys, "dir/b.txt"))
+
+	assert.Nil(t, fsys.Remove("dir/b.txt"))
+	_, err := fsys.Stat("dir/b.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = fsys.Stat("dir")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func newFS(t *testing.T) (*FS, *server.FileServer) {
+	tr := network.NewTCPTransporter(network.TCPTransporterOpts{
+		ListenAddress: ":0",
+		HandshakeFunc: network.NOPHandshakeFunc,
+		Decoder:       network.DefaultDecoder{},
+	})
+	files := server.NewFileServer(server.FileServerOpts{
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: store.HashPathTransformFunc,
+		Transporter:       tr,
+		EncKey:            cipher.NewEncryptionKey(),
+	})
+
+	fsys, err := New(files, Opts{CacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys, files
+}
+
+func write(t *testing.T, fsys *FS, name, data string) {
+	for i := range name {
+		if name[i] == '/' {
+			if err := fsys.Mkdir(name[:i]); err != nil && !errors.Is(err, os.ErrExist) {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	h, err := fsys.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt([]byte(data), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, fsys *FS, name string) string {
+	h, err := fsys.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	data, err := io.ReadAll(io.NewSectionReader(h, 0, h.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func names(entries []FileInfo) []string {
+	list := []string{}
+	for _, entry := range entries {
+		list = append(list, entry.Name)
+	}
+	return list
+}